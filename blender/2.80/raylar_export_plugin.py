@@ -167,21 +167,30 @@ def export_object(obj):
 
 
 def export_light(light):
+    light_data = bpy.data.lights[light.name]
     directional = False
     direction = [0, 0, 0, 0]
-    if bpy.data.lights[light.name].type == 'SUN':
-        directional = True
+    if light_data.type in ('SUN', 'SPOT'):
+        directional = light_data.type == 'SUN'
         lmw = light.matrix_world
         direction = lmw.to_quaternion() @ Vector((0.0, 0.0, -1.0))
 
-    return {
+    result = {
         "position": list(light.location),
-        "color": list(bpy.data.lights[light.name].color),
+        "color": list(light_data.color),
         "active": True,
-        "light_strength": bpy.data.lights[light.name].energy / 10,
+        "light_strength": light_data.energy / 10,
         "directional_light": directional,
         "direction": list(direction)
     }
+    if light_data.type == 'SPOT':
+        # Spot size is the full cone angle, blend softens it from the inside.
+        size = light_data.spot_size * 180 / math.pi
+        result["spot_light"] = True
+        result["outer_cone_angle"] = size
+        result["inner_cone_angle"] = size * (1 - light_data.spot_blend)
+        result["spot_falloff"] = 1
+    return result
 
 
 def _conv_matrix(matrix):
@@ -203,29 +212,91 @@ def export_camera(camera):
     z = (cam_direction[2] * 10) + position[2]
     target = [x, y, z, 1]
 
-    fov = bpy.data.cameras[camera.name].angle * 180 / math.pi
+    cam_data = bpy.data.cameras[camera.name]
+    fov = cam_data.angle * 180 / math.pi
     aspect = (
         bpy.context.scene.render.resolution_x /
         bpy.context.scene.render.resolution_y
     )
 
+    aperture = 0
+    focus_distance = 0
+    focus_target = None
+    dof = cam_data.dof
+    if dof.use_dof:
+        # Blender keeps the aperture as f-stop, raylar wants the lens radius.
+        aperture = cam_data.lens / dof.aperture_fstop / 2.0 / 1000.0
+        focus_distance = dof.focus_distance
+        if dof.focus_object is not None:
+            focus_target = list(dof.focus_object.matrix_world.translation) + [1]
+
+    camera_type = ""
+    if cam_data.type == "PANO":
+        # Raylar panoramas are in world axes, like the environment map lookup.
+        panorama = getattr(cam_data.cycles, "panorama_type", "")
+        if panorama == "EQUIRECTANGULAR":
+            camera_type = "equirectangular"
+        elif panorama.startswith("FISHEYE"):
+            camera_type = "fisheye"
+            fov = cam_data.cycles.fisheye_fov * 180 / math.pi
+
+    stereo = ""
+    render = bpy.context.scene.render
+    if render.use_multiview and render.views_format == "STEREO_3D":
+        stereo = "side_by_side"
+        if render.image_settings.views_format == "INDIVIDUAL":
+            stereo = "separate"
+        elif render.image_settings.stereo_3d_format.display_mode == "TOPBOTTOM":
+            stereo = "top_bottom"
+
     return {
+        "name": camera.name,
+        "type": camera_type,
         "position": list(position),
         "target": list(target),
         "up": list(up),
         "fov": fov,
         "aspect_ratio": aspect,
-        "near": 0.01,
-        "far": 10000,
-        "perspective": True,
+        "near": cam_data.clip_start,
+        "far": cam_data.clip_end,
+        "perspective": cam_data.type != "ORTHO",
+        "zoom": cam_data.ortho_scale,
+        "aperture": aperture,
+        "focus_distance": focus_distance,
+        "focus_target": focus_target,
+        "aperture_blades": dof.aperture_blades,
+        "aperture_rotation": dof.aperture_rotation * 180 / math.pi,
+        "stereo": stereo,
+        "interpupillary_distance": cam_data.stereo.interocular_distance,
+        "convergence_distance": cam_data.stereo.convergence_distance,
     }
 
 
 def construct_scene():
-    scene = {"objects": {}, "lights": [], "observers": []}
+    scene = {"objects": {}, "meshes": {}, "lights": [], "observers": []}
 
     bpy_scene = bpy.context.scene
+    # Linked duplicates share their mesh, they are exported as its instances.
+    # Collected first, exporting a mesh replaces the data of its object.
+    shared = {}
     for obj in bpy_scene.objects:
+        if obj.type == "MESH" and obj.data.users > 1:
+            shared[obj.name] = obj.data.name
+
+    for obj in bpy_scene.objects:
+        if obj.name in shared:
+            mesh_name = shared[obj.name]
+            matrix = _conv_matrix(obj.matrix_world)
+            if mesh_name not in scene["meshes"]:
+                mesh = export_object(obj)
+                mesh["matrix"] = _conv_matrix(Matrix.Identity(4))
+                scene["meshes"][mesh_name] = mesh
+            scene["objects"][obj.name] = {
+                "instance": mesh_name,
+                "matrix": matrix,
+            }
+            continue
+
         obj.select_set(True)
         bpy.context.view_layer.objects.active = obj
         bpy.ops.object.transform_apply(location=True,
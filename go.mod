@@ -1,6 +1,6 @@
 module github.com/sinanislekdemir/raylar
 
-go 1.15
+go 1.16
 
 require (
 	github.com/VividCortex/ewma v1.1.1
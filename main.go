@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"runtime/pprof"
+	"strings"
+	"syscall"
 
 	"github.com/sinanislekdemir/raylar/raytracer"
 )
@@ -15,6 +20,21 @@ var buildTime string
 func main() {
 	s := raytracer.Scene{}
 
+	worker := false
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "merge":
+			mergeCommand(os.Args[2:])
+			return
+		case "convert":
+			convertCommand(os.Args[2:])
+			return
+		case "worker":
+			worker = true
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+
 	sceneFile := ""
 
 	configFile := flag.String("config", "", "Scene Config JSON")
@@ -29,9 +49,23 @@ func main() {
 	profiling := flag.Bool("profile", false, "Set 1 for debugging")
 	showHelp := flag.Bool("help", false, "Show help!")
 	createConfig := flag.Bool("createconfig", false, "Create config")
+	camera := flag.String("camera", "", "Camera name or index to render from")
+	allCameras := flag.Bool("allcameras", false, "Render one image per camera")
+	threads := flag.Int("threads", 0, "Number of render threads, defaults to number of CPUs")
+	sampleMap := flag.Bool("samplemap", false, "Save samples per pixel as <output>_samples.png")
+	resume := flag.Bool("resume", false, "Resume an interrupted render from <output>.checkpoint")
+	workers := flag.Int("workers", 0, "Number of local worker processes to render tiles")
+	listen := flag.String("listen", "", "Address to accept remote workers on, eg: :7070")
+	connect := flag.String("connect", "", "Coordinator address for a worker, stdin/stdout if empty")
 
 	flag.Parse()
 
+	// Workers talk to the coordinator over stdout, everything else goes to stderr.
+	protocolOut := os.Stdout
+	if worker {
+		os.Stdout = os.Stderr
+	}
+
 	if flag.NArg() == 0 {
 		sceneFile = "scene.json"
 	} else {
@@ -49,6 +83,18 @@ func main() {
 		fmt.Println("--size <width>x<height> : Set width x height explicitly, overwriting config. 1600x900 eg.")
 		fmt.Println("--createconfig          : Create a default config.json to modify scene parameters")
 		fmt.Println("--environment           : Environment map image file for infinite reflections")
+		fmt.Println("--camera <name|index>   : Render from the given camera instead of the first one")
+		fmt.Println("--allcameras            : Render each camera into <output>_<camera>.png")
+		fmt.Println("--threads <n>           : Number of render threads, defaults to number of CPUs")
+		fmt.Println("--samplemap             : Save samples taken per pixel as <output>_samples.png")
+		fmt.Println("--resume                : Resume an interrupted render from <output>.checkpoint")
+		fmt.Println("--workers <n>           : Render tiles on n local worker processes")
+		fmt.Println("--listen <address>      : Accept remote workers on the address, eg: :7070")
+		fmt.Println("worker [flags] <scene>  : Render tiles for a coordinator over stdin/stdout")
+		fmt.Println("worker --connect <addr> : Render tiles for a coordinator over TCP")
+		fmt.Println("merge --output <out.png> <tiles.rlt...> : Merge tile files into one image")
+		fmt.Println("convert [--compress] <scene> <out.rlb> : Convert a scene to the fast loading binary format")
+		fmt.Println("Output files with .rlt extension keep only the rendered region, for merge.")
 		os.Exit(0)
 	}
 
@@ -57,6 +103,8 @@ func main() {
 	} else {
 		s.OutputFilename = *outputFilename
 	}
+	s.SampleMap = *sampleMap
+	s.Resume = *resume
 
 	if *profiling {
 		fx, _ := os.Create("profiling.prof")
@@ -83,12 +131,130 @@ func main() {
 		configFile = &cf
 	}
 
-	err := s.Init(sceneFile, *configFile, *environmentMap)
+	renderer := raytracer.NewRenderer()
+	if *configFile == "" {
+		log.Print("No config set, setting defaults")
+	} else if err := renderer.LoadConfig(*configFile); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if *environmentMap != "" {
+		renderer.Config.EnvironmentMap = *environmentMap
+	}
+
+	err := s.Init(sceneFile)
 	if err != nil {
 		log.Println(err.Error())
 		return
 	}
+	if *camera != "" {
+		err = s.SelectCamera(*camera)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+	}
 	log.Printf("Render %d percent of the image", *percent)
-	raytracer.GlobalConfig.Percentage = *percent
-	_ = raytracer.Render(&s, *left, *right, *top, *bottom, *percent, size)
+	renderer.Config.Percentage = *percent
+	if *threads > 0 {
+		renderer.Config.Threads = *threads
+	}
+
+	// First Ctrl-C stops the render and saves what is done, second one kills.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Printf("Interrupted, saving partial render")
+		signal.Stop(signals)
+		cancel()
+	}()
+
+	switch {
+	case worker:
+		err = serveWorker(ctx, renderer, &s, *connect, protocolOut)
+	case *workers > 0 || *listen != "":
+		if *allCameras {
+			log.Println("--allcameras can't be used with --workers or --listen")
+			return
+		}
+		coordinator := raytracer.Coordinator{Workers: *workers, Listen: *listen, Command: workerCommand()}
+		err = coordinator.Render(ctx, renderer, &s, *left, *right, *top, *bottom, size)
+	case *allCameras:
+		err = renderer.RenderAllCameras(ctx, &s, *left, *right, *top, *bottom, *percent, size)
+	default:
+		err = renderer.RenderToFile(ctx, &s, *left, *right, *top, *bottom, *percent, size)
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// workerCommand starts this executable in worker mode with the same flags,
+// except the coordinator ones.
+func workerCommand() []string {
+	executable, err := os.Executable()
+	if err != nil {
+		executable = os.Args[0]
+	}
+	command := []string{executable, "worker"}
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if name == "workers" || name == "listen" {
+			i++ // skip the value
+			continue
+		}
+		if strings.HasPrefix(name, "workers=") || strings.HasPrefix(name, "listen=") {
+			continue
+		}
+		command = append(command, args[i])
+	}
+	return command
+}
+
+func serveWorker(ctx context.Context, renderer *raytracer.Renderer, s *raytracer.Scene, address string, out *os.File) error {
+	if address == "" {
+		return renderer.ServeWorker(ctx, s, os.Stdin, out)
+	}
+	log.Printf("Connecting to coordinator %s", address)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return renderer.ServeWorker(ctx, s, conn, conn)
+}
+
+func mergeCommand(args []string) {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	outputFilename := flags.String("output", "awesome.png", "Merged image filename")
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Println("raylar merge --output <out.png> <tile.rlt> [tile.rlt...]")
+		return
+	}
+	if err := raytracer.MergeTiles(*outputFilename, flags.Args()); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func convertCommand(args []string) {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	compress := flags.Bool("compress", false, "Gzip compress the binary scene")
+	_ = flags.Parse(args)
+	if flags.NArg() != 2 {
+		fmt.Println("raylar convert [--compress] <scene.json> <scene.rlb>")
+		return
+	}
+	s := raytracer.Scene{}
+	if err := s.Init(flags.Arg(0)); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if err := s.SaveBinary(flags.Arg(1), *compress); err != nil {
+		log.Println(err.Error())
+	}
 }
@@ -4,8 +4,8 @@ package raytracer
 func ambientLightCalc(scene *Scene, intersection *Intersection, samples []Intersection, totalDirs int) float64 {
 	totalHits := 0.0
 	rad := scene.ShortRadius
-	if GlobalConfig.AmbientRadius > 0 {
-		rad = GlobalConfig.AmbientRadius
+	if scene.renderer.Config.AmbientRadius > 0 {
+		rad = scene.renderer.Config.AmbientRadius
 	}
 	for i := 0; i < len(samples); i++ {
 		if samples[i].Dist < rad {
@@ -24,7 +24,7 @@ func ambientColor(scene *Scene, intersection *Intersection, samples []Intersecti
 	totalColor := Vector{}
 	sampleCount := len(samples)
 	for i := 0; i < sampleCount; i++ {
-		color := samples[i].getColor()
+		color := samples[i].getColor(scene)
 		if vectorLength(color) < DIFF {
 			continue
 		}
@@ -39,18 +39,11 @@ func ambientColor(scene *Scene, intersection *Intersection, samples []Intersecti
 }
 
 func ambientSampling(scene *Scene, intersection *Intersection) []Intersection {
-	sampleDirs := createSamples(intersection.IntersectionNormal, GlobalConfig.SamplerLimit, 0)
-	hitChannel := make(chan Intersection, len(sampleDirs))
-	for i := range sampleDirs {
-		go func(scene *Scene, intersection *Intersection, dir Vector, channel chan Intersection) {
-			hit := raycastSceneIntersect(scene, intersection.Intersection, dir)
-			channel <- hit
-		}(scene, intersection, sampleDirs[i], hitChannel)
-	}
+	sampleDirs := scene.renderer.createSamples(intersection.IntersectionNormal, scene.renderer.Config.SamplerLimit, 0)
 	samples := make([]Intersection, 0, len(sampleDirs))
-	for i := 0; i < len(sampleDirs); i++ {
-		hit := <-hitChannel
-		if hit.Hit && hit.Triangle.id != intersection.Triangle.id {
+	for i := range sampleDirs {
+		hit := raycastSceneBounce(scene, intersection, sampleDirs[i])
+		if hit.Hit && hit.id() != intersection.id() {
 			samples = append(samples, hit)
 		}
 	}
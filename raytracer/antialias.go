@@ -1,33 +1,33 @@
 package raytracer
 
 import (
-	"math"
 	"math/rand"
 )
 
-func getPixel(scene *Scene, x, y int) Vector {
-	if GlobalConfig.AntialiasSamples > 64 {
-		GlobalConfig.AntialiasSamples = 64
+// adaptiveSample keeps adding samples to the pixel until its noise drops
+// below noise_threshold or it reaches antialias_samples. Noise is measured
+// on the pixel itself, so glossy and rough surfaces get more samples too, not
+// only the geometric edges.
+func adaptiveSample(scene *Scene, x, y int) {
+	if scene.renderer.Config.Percentage < 100 {
+		return
 	}
-	if GlobalConfig.AntialiasSamples == 0 {
-		return scene.Pixels[x][y].Color
+	pixel := &scene.Pixels[x][y]
+	for pixel.Samples < scene.renderer.Config.AntialiasSamples {
+		pixel.addSample(samplePixel(scene, x, y))
+		if pixel.converged(&scene.renderer.Config) {
+			return
+		}
 	}
-	observer := scene.Cameras[0]
-	sw := scene.Width * 8
-	sh := scene.Height * 8
-	totalColor := Vector{}
-	totalHits := 0.0
-	p := rand.Perm(64)
-	for _, n := range p[:GlobalConfig.AntialiasSamples] {
-		yi := int(math.Floor(float64(n)/float64(8))) + (y * 8) - 4
-		xi := (n % 8) + (x * 8) - 4
-		rayDir := screenToWorld(xi, yi, sw, sh, observer.Position, *observer.Projection, observer.view)
-		hit := raycastSceneIntersect(scene, scene.Cameras[0].Position, rayDir)
-		render := hit.render(scene, 0)
-		totalColor = addVector(totalColor, render)
-		totalHits += 1.0
-	}
-	totalColor = scaleVector(totalColor, 1.0/totalHits)
-	totalColor[3] = 1
-	return totalColor
+}
+
+// samplePixel shades one ray through a random point inside the pixel.
+func samplePixel(scene *Scene, x, y int) Vector {
+	observer := scene.camera()
+	n := rand.Intn(64)
+	yi := n/8 + (y * 8) - 4
+	xi := (n % 8) + (x * 8) - 4
+	rayStart, rayDir := observer.ray(xi, yi, scene.Width*8, scene.Height*8)
+	hit := raycastSceneIntersect(scene, rayStart, rayDir)
+	return shade(scene, &hit)
 }
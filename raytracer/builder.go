@@ -0,0 +1,134 @@
+package raytracer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrObjectNotFound is returned when a name matches no object of the scene.
+var ErrObjectNotFound = errors.New("object not found")
+
+// ErrMaterialNotFound is returned when a name matches no material of the object.
+var ErrMaterialNotFound = errors.New("material not found")
+
+// NewScene without objects, lights or cameras, to be built with the Add methods.
+func NewScene(opts SceneOptions) *Scene {
+	return &Scene{
+		Objects: make(map[string]*Object),
+		files:   opts.Files,
+	}
+}
+
+// NewObject with an identity matrix and no geometry.
+func NewObject() *Object {
+	return &Object{
+		Matrix:    identityHmgMatrix,
+		Materials: make(map[string]Material),
+	}
+}
+
+// AddVertex with its normal and texture coordinate, returns the vertex index for AddFace.
+func (o *Object) AddVertex(position, normal, texCoord Vector) int64 {
+	o.Vertices = append(o.Vertices, position)
+	o.Normals = append(o.Normals, normal)
+	o.TexCoords = append(o.TexCoords, texCoord)
+	return int64(len(o.Vertices) - 1)
+}
+
+// AddFace of three vertices with the material, smooth faces interpolate the vertex normals.
+func (o *Object) AddFace(material string, a, b, c int64, smooth bool) error {
+	mat, ok := o.Materials[material]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrMaterialNotFound, material)
+	}
+	for _, v := range []int64{a, b, c} {
+		if v < 0 || v >= int64(len(o.Vertices)) {
+			return fmt.Errorf("vertex %d out of %d vertices", v, len(o.Vertices))
+		}
+	}
+	face := indice{a, b, c, 0}
+	if smooth {
+		face[3] = 1
+	}
+	mat.Indices = append(mat.Indices, face)
+	o.Materials[material] = mat
+	return nil
+}
+
+// AddObject to the scene with a unique name, the object can still be changed
+// until the scene is rendered.
+func (s *Scene) AddObject(name string, obj *Object) error {
+	if s.MasterObject != nil {
+		return ErrScenePrepared
+	}
+	if s.Objects == nil {
+		s.Objects = make(map[string]*Object)
+	}
+	if _, ok := s.Objects[name]; ok {
+		return fmt.Errorf("object %s already exists", name)
+	}
+	if obj.Materials == nil {
+		obj.Materials = make(map[string]Material)
+	}
+	s.Objects[name] = obj
+	return nil
+}
+
+// AddMesh to the scene with a unique name, shared by the objects with their
+// Instance set to the name. The mesh is in its own space, instances place it
+// in the scene with their matrix.
+func (s *Scene) AddMesh(name string, mesh *Object) error {
+	if s.MasterObject != nil {
+		return ErrScenePrepared
+	}
+	if s.Meshes == nil {
+		s.Meshes = make(map[string]*Object)
+	}
+	if _, ok := s.Meshes[name]; ok {
+		return fmt.Errorf("mesh %s already exists", name)
+	}
+	if mesh.Materials == nil {
+		mesh.Materials = make(map[string]Material)
+	}
+	s.Meshes[name] = mesh
+	return nil
+}
+
+// AddMaterial to the object with the given name, replacing the material with
+// the same name.
+func (s *Scene) AddMaterial(object, name string, mat Material) error {
+	if s.MasterObject != nil {
+		return ErrScenePrepared
+	}
+	obj, ok := s.Objects[object]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, object)
+	}
+	obj.Materials[name] = mat
+	return nil
+}
+
+// AddPrimitive to the scene, see Primitive for the types and their parameters.
+func (s *Scene) AddPrimitive(p Primitive) error {
+	if s.MasterObject != nil {
+		return ErrScenePrepared
+	}
+	s.Primitives = append(s.Primitives, p)
+	return nil
+}
+
+// AddLight to the scene.
+func (s *Scene) AddLight(light Light) error {
+	if s.MasterObject != nil {
+		return ErrScenePrepared
+	}
+	s.Lights = append(s.Lights, light)
+	return nil
+}
+
+// AddCamera to the scene, returns the camera index for ActiveCamera.
+// Cameras can be added after rendering too.
+func (s *Scene) AddCamera(camera Camera) int {
+	s.Cameras = append(s.Cameras, camera)
+	return len(s.Cameras) - 1
+}
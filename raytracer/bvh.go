@@ -0,0 +1,376 @@
+package raytracer
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Accelerators to choose from in config.
+const (
+	AcceleratorKDTree = "kdtree"
+	AcceleratorBVH    = "bvh"
+)
+
+const (
+	// Triangle centroids are binned along the split axis, splits are between bins.
+	bvhBins = 16
+	// Smaller nodes become leaves when splitting them doesn't pay off.
+	bvhMaxLeafTriangles = 8
+	// Cost of visiting a node relative to intersecting a triangle.
+	bvhTraversalCost = 1.0
+	// Smaller subtrees are built on the goroutine of their parent.
+	bvhParallelTriangles = 4096
+)
+
+// bvh is a bounding volume hierarchy over the triangles of an object, or
+// the instances of a scene.
+// Nodes are stored depth first, the left child of an inner node follows it.
+// Leaves refer to a range of indices, which refer to the triangles.
+type bvh struct {
+	nodes   []bvhNode
+	indices []uint32
+}
+
+// bvhNode of a flattened BVH.
+// Offset is the first index of a leaf and the right child of an inner node,
+// Count is the number of triangles of a leaf and 0 for inner nodes.
+type bvhNode struct {
+	BoundingBox BoundingBox
+	Offset      uint32
+	Count       uint32
+}
+
+// bvhBuildNode is a node while the tree is built, before it's flattened.
+type bvhBuildNode struct {
+	box         BoundingBox
+	left, right *bvhBuildNode
+	first       int
+	count       int
+}
+
+type bvhBuilder struct {
+	boxes     []BoundingBox
+	centroids []Vector
+	indices   []uint32
+	// Free slots for goroutines, building is spread over the render threads.
+	slots chan struct{}
+}
+
+type bvhBin struct {
+	box   BoundingBox
+	count int
+}
+
+// BVH Building with the surface area heuristic, in parallel on threads.
+func (o *Object) BVH(threads int) {
+	start := time.Now()
+	boxes := make([]BoundingBox, len(o.Triangles))
+	centroids := make([]Vector, len(o.Triangles))
+	for i := range o.Triangles {
+		boxes[i] = o.Triangles[i].getBoundingBox()
+		centroids[i] = o.Triangles[i].midPoint()
+	}
+	h, maxDepth := newBVH(boxes, centroids, threads)
+	log.Printf("Built %d BVH nodes with %d max depth in %f seconds", len(h.nodes), maxDepth, time.Since(start).Seconds())
+	o.bvh = h
+}
+
+// newBVH over the primitives with the given bounds, returns the tree and its max depth.
+func newBVH(boxes []BoundingBox, centroids []Vector, threads int) (*bvh, int) {
+	b := bvhBuilder{
+		boxes:     boxes,
+		centroids: centroids,
+		indices:   make([]uint32, len(boxes)),
+		slots:     make(chan struct{}, threads),
+	}
+	for i := range b.indices {
+		b.indices[i] = uint32(i)
+	}
+	h := &bvh{indices: b.indices}
+	if len(boxes) == 0 {
+		return h, 0
+	}
+	h.nodes = make([]bvhNode, 0, 2*len(boxes)-1)
+	root := b.build(0, len(boxes))
+	return h, h.flatten(root, 0)
+}
+
+// build the subtree of count indices from first on, indices are partitioned in place.
+func (b *bvhBuilder) build(first, count int) *bvhBuildNode {
+	node := &bvhBuildNode{first: first, count: count}
+	node.box = b.boxes[b.indices[first]]
+	centroids := BoundingBox{b.centroids[b.indices[first]], b.centroids[b.indices[first]]}
+	for _, i := range b.indices[first+1 : first+count] {
+		node.box.extend(b.boxes[i])
+		centroids.extendVector(b.centroids[i])
+	}
+	if count <= 2 {
+		return node
+	}
+
+	mid := first
+	axis, split, cost := b.split(first, count, &node.box, &centroids)
+	if axis >= 0 && (cost < float64(count) || count > bvhMaxLeafTriangles) {
+		mid = b.partition(first, count, axis, split, &centroids)
+	}
+	if mid == first || mid == first+count {
+		if count <= bvhMaxLeafTriangles {
+			return node
+		}
+		// Centroids are on top of each other, any split is as good.
+		mid = first + count/2
+	}
+
+	wg := sync.WaitGroup{}
+	if count >= bvhParallelTriangles && b.acquire() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			node.left = b.build(first, mid-first)
+			<-b.slots
+		}()
+	} else {
+		node.left = b.build(first, mid-first)
+	}
+	node.right = b.build(mid, first+count-mid)
+	wg.Wait()
+	return node
+}
+
+// acquire a goroutine slot, false if all of them are busy.
+func (b *bvhBuilder) acquire() bool {
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// split with the lowest SAH cost, the bins below split go to the left child.
+// Axis is -1 when the centroids can't be told apart.
+func (b *bvhBuilder) split(first, count int, box, centroids *BoundingBox) (axis, split int, cost float64) {
+	axis = -1
+	cost = math.Inf(1)
+	area := box.surfaceArea()
+	for a := 0; a < 3; a++ {
+		if centroids[1][a]-centroids[0][a] < DIFF {
+			continue
+		}
+		bins := [bvhBins]bvhBin{}
+		for _, i := range b.indices[first : first+count] {
+			bin := &bins[binIndex(b.centroids[i][a], a, centroids)]
+			if bin.count == 0 {
+				bin.box = b.boxes[i]
+			} else {
+				bin.box.extend(b.boxes[i])
+			}
+			bin.count++
+		}
+
+		// Right side costs are swept from the end, left side while looking for the best.
+		rightArea := [bvhBins]float64{}
+		rightCount := [bvhBins]int{}
+		right := bvhBin{}
+		for i := bvhBins - 1; i > 0; i-- {
+			right.add(&bins[i])
+			rightArea[i] = right.area()
+			rightCount[i] = right.count
+		}
+		left := bvhBin{}
+		for i := 1; i < bvhBins; i++ {
+			left.add(&bins[i-1])
+			if left.count == 0 || rightCount[i] == 0 {
+				continue
+			}
+			c := bvhTraversalCost + (left.area()*float64(left.count)+rightArea[i]*float64(rightCount[i]))/area
+			if c < cost {
+				axis, split, cost = a, i, c
+			}
+		}
+	}
+	return
+}
+
+// partition the indices on the split bin, returns the first index of the right side.
+func (b *bvhBuilder) partition(first, count, axis, split int, centroids *BoundingBox) int {
+	i := first
+	j := first + count - 1
+	for i <= j {
+		if binIndex(b.centroids[b.indices[i]][axis], axis, centroids) < split {
+			i++
+			continue
+		}
+		b.indices[i], b.indices[j] = b.indices[j], b.indices[i]
+		j--
+	}
+	return i
+}
+
+func binIndex(centroid float64, axis int, centroids *BoundingBox) int {
+	bin := int(bvhBins * (centroid - centroids[0][axis]) / (centroids[1][axis] - centroids[0][axis]))
+	if bin >= bvhBins {
+		return bvhBins - 1
+	}
+	if bin < 0 {
+		return 0
+	}
+	return bin
+}
+
+func (b *bvhBin) add(o *bvhBin) {
+	if o.count == 0 {
+		return
+	}
+	if b.count == 0 {
+		b.box = o.box
+	} else {
+		b.box.extend(o.box)
+	}
+	b.count += o.count
+}
+
+func (b *bvhBin) area() float64 {
+	if b.count == 0 {
+		return 0
+	}
+	return b.box.surfaceArea()
+}
+
+func (b *BoundingBox) surfaceArea() float64 {
+	x := b[1][0] - b[0][0]
+	y := b[1][1] - b[0][1]
+	z := b[1][2] - b[0][2]
+	return 2 * (x*y + y*z + z*x)
+}
+
+// flatten the subtree depth first, returns its max depth.
+func (h *bvh) flatten(n *bvhBuildNode, depth int) int {
+	index := len(h.nodes)
+	h.nodes = append(h.nodes, bvhNode{BoundingBox: n.box})
+	if n.left == nil {
+		h.nodes[index].Offset = uint32(n.first)
+		h.nodes[index].Count = uint32(n.count)
+		return depth
+	}
+	leftDepth := h.flatten(n.left, depth+1)
+	h.nodes[index].Offset = uint32(len(h.nodes))
+	rightDepth := h.flatten(n.right, depth+1)
+	if leftDepth > rightDepth {
+		return leftDepth
+	}
+	return rightDepth
+}
+
+// raycastBoxDistance to where the ray enters the box, in units of the ray vector.
+// Ray starts inside the box are at 0.
+func raycastBoxDistance(rayStart, invDir *Vector, box *BoundingBox) (float64, bool) {
+	// Unrolled like raycastBoxIntersect. NaNs from rays parallel to a box side
+	// fail the comparisons and leave the range as it is.
+	tMin := 0.0
+	tMax := math.Inf(1)
+
+	t1 := (box[0][0] - rayStart[0]) * invDir[0]
+	t2 := (box[1][0] - rayStart[0]) * invDir[0]
+	if t1 > t2 {
+		t1, t2 = t2, t1
+	}
+	if t1 > tMin {
+		tMin = t1
+	}
+	if t2 < tMax {
+		tMax = t2
+	}
+
+	t1 = (box[0][1] - rayStart[1]) * invDir[1]
+	t2 = (box[1][1] - rayStart[1]) * invDir[1]
+	if t1 > t2 {
+		t1, t2 = t2, t1
+	}
+	if t1 > tMin {
+		tMin = t1
+	}
+	if t2 < tMax {
+		tMax = t2
+	}
+
+	t1 = (box[0][2] - rayStart[2]) * invDir[2]
+	t2 = (box[1][2] - rayStart[2]) * invDir[2]
+	if t1 > t2 {
+		t1, t2 = t2, t1
+	}
+	if t1 > tMin {
+		tMin = t1
+	}
+	if t2 < tMax {
+		tMax = t2
+	}
+
+	return tMin, tMin <= tMax
+}
+
+// bvhVisit is a node waiting on the traversal stack, t is where the ray enters it.
+type bvhVisit struct {
+	node uint32
+	t    float64
+}
+
+// raycastBVHIntersect keeps the closest triangle hit in the intersection.
+func raycastBVHIntersect(rayStart, rayDir *Vector, h *bvh, triangles []Triangle, intersection *Intersection) {
+	h.traverse(rayStart, rayDir, intersection, func(indices []uint32) {
+		for _, i := range indices {
+			raycastTriangle(rayStart, rayDir, &triangles[i], intersection)
+		}
+	})
+}
+
+// traverse the leaves the ray enters, nearer nodes first. Nodes behind the
+// closest hit of the intersection so far are skipped.
+func (h *bvh) traverse(rayStart, rayDir *Vector, intersection *Intersection, leaf func(indices []uint32)) {
+	if len(h.nodes) == 0 {
+		return
+	}
+	invDir := Vector{1 / rayDir[0], 1 / rayDir[1], 1 / rayDir[2]}
+	dirLength := vectorLength(*rayDir)
+	behind := func(t float64) bool {
+		return intersection.Dist != -1 && t*dirLength > intersection.Dist
+	}
+	t, hit := raycastBoxDistance(rayStart, &invDir, &h.nodes[0].BoundingBox)
+	if !hit {
+		return
+	}
+
+	stack := make([]bvhVisit, 0, 64)
+	stack = append(stack, bvhVisit{0, t})
+	for len(stack) > 0 {
+		visit := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		// A closer hit may have been found since it was pushed.
+		if behind(visit.t) {
+			continue
+		}
+		node := &h.nodes[visit.node]
+		if node.Count > 0 {
+			leaf(h.indices[node.Offset : node.Offset+node.Count])
+			continue
+		}
+
+		near := bvhVisit{node: visit.node + 1}
+		far := bvhVisit{node: node.Offset}
+		hitNear, hitFar := false, false
+		near.t, hitNear = raycastBoxDistance(rayStart, &invDir, &h.nodes[near.node].BoundingBox)
+		far.t, hitFar = raycastBoxDistance(rayStart, &invDir, &h.nodes[far.node].BoundingBox)
+		if hitNear && hitFar && far.t < near.t {
+			near, far = far, near
+		}
+		// Pushed last, popped first.
+		if hitFar {
+			stack = append(stack, far)
+		}
+		if hitNear {
+			stack = append(stack, near)
+		}
+	}
+}
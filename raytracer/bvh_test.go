@@ -0,0 +1,86 @@
+package raytracer
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// triangleSoup of count random triangles in the unit cube, flat ones give
+// all triangles the same z and stacked ones the same corners.
+func triangleSoup(rng *rand.Rand, count int, flat, stacked bool) *Object {
+	obj := NewObject()
+	obj.Materials["soup"] = Material{Color: Vector{1, 1, 1, 1}}
+	point := func() Vector {
+		p := Vector{rng.Float64(), rng.Float64(), rng.Float64(), 1}
+		if flat {
+			p[2] = 0.5
+		}
+		return p
+	}
+	corners := [3]Vector{point(), point(), point()}
+	for i := 0; i < count; i++ {
+		if !stacked {
+			corners = [3]Vector{point(), point(), point()}
+		}
+		normal := normalizeVector(crossProduct(subVector(corners[1], corners[0]), subVector(corners[2], corners[0])))
+		normal[3] = 0
+		a := obj.AddVertex(corners[0], normal, Vector{})
+		b := obj.AddVertex(corners[1], normal, Vector{})
+		c := obj.AddVertex(corners[2], normal, Vector{})
+		_ = obj.AddFace("soup", a, b, c, false)
+	}
+	obj.UnifyTriangles()
+	return obj
+}
+
+func TestBVHIntersect(t *testing.T) {
+	tests := []struct {
+		name      string
+		triangles int
+		threads   int
+		flat      bool
+		stacked   bool
+	}{
+		{"single triangle", 1, 1, false, false},
+		{"one leaf", bvhMaxLeafTriangles - 1, 1, false, false},
+		{"small", 100, 1, false, false},
+		{"parallel build", 2 * bvhParallelTriangles, 4, false, false},
+		{"flat", 500, 2, true, false},
+		{"stacked", 50, 1, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(int64(test.triangles)))
+			obj := triangleSoup(rng, test.triangles, test.flat, test.stacked)
+			obj.BVH(test.threads)
+
+			hits := 0
+			for i := 0; i < 1000; i++ {
+				start := Vector{rng.Float64()*3 - 1, rng.Float64()*3 - 1, rng.Float64()*3 - 1, 1}
+				target := Vector{rng.Float64(), rng.Float64(), rng.Float64(), 1}
+				dir := normalizeVector(subVector(target, start))
+				dir[3] = 0
+
+				got := raycastObjectIntersect(obj, &start, &dir)
+				want := Intersection{Dist: -1}
+				for j := range obj.Triangles {
+					raycastTriangle(&start, &dir, &obj.Triangles[j], &want)
+				}
+				if got.Hit != want.Hit || got.Dist != want.Dist {
+					t.Fatalf("ray from %v to %v hits %v at %v, want %v at %v", start, target, got.Hit, got.Dist, want.Hit, want.Dist)
+				}
+				// Flat and stacked triangles overlap, any of them hit at the
+				// distance is right.
+				if !test.flat && !test.stacked && got.Triangle != want.Triangle {
+					t.Fatalf("ray from %v to %v hits another triangle", start, target)
+				}
+				if got.Hit {
+					hits++
+				}
+			}
+			if hits == 0 {
+				t.Error("no ray hits")
+			}
+		})
+	}
+}
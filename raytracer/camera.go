@@ -0,0 +1,267 @@
+package raytracer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrNoCamera is returned when the scene has no observers to render from.
+var ErrNoCamera = errors.New("scene has no cameras")
+
+// ErrCameraNotFound is returned when a camera reference matches no observer.
+var ErrCameraNotFound = errors.New("camera not found")
+
+// Stereo output layouts.
+const (
+	StereoSideBySide = "side_by_side"
+	StereoTopBottom  = "top_bottom"
+	StereoSeparate   = "separate"
+)
+
+// Eye offsets of a stereo camera.
+const (
+	leftEye  = -1.0
+	rightEye = 1.0
+)
+
+const defaultInterpupillaryDistance = 0.064
+
+// Camera types, empty type is the regular pinhole (or orthographic) camera.
+const (
+	CameraEquirectangular = "equirectangular"
+	CameraFisheye         = "fisheye"
+)
+
+// Camera structure.
+// Perspective cameras use Fov, orthographic cameras (perspective: false) use Zoom
+// as the width of the view in scene units, or the height if the image is taller
+// than wide, same as Blender's orthographic scale.
+// Depth of field is enabled with a non-zero Aperture (lens radius). Focus is at
+// FocusTarget if set, FocusDistance otherwise, or at Target when both are empty.
+// ApertureBlades above 2 gives polygonal bokeh instead of a round lens.
+// Equirectangular cameras render a 360 degree panorama in world axes, the same
+// mapping environment maps use, so renders can be fed back as environment maps.
+// Fisheye cameras are equidistant with Fov as the full angle of the image circle.
+// Stereo cameras render a left and a right eye InterpupillaryDistance apart,
+// converging at ConvergenceDistance (focus distance by default).
+type Camera struct {
+	Name        string  `json:"name"`
+	Type        string  `json:"type"`
+	Position    Vector  `json:"position"`
+	Target      Vector  `json:"target"`
+	Up          Vector  `json:"up"`
+	Fov         float64 `json:"fov"`
+	AspectRatio float64 `json:"aspect_ratio"`
+	Zoom        float64 `json:"zoom"`
+	Near        float64 `json:"near"`
+	Far         float64 `json:"far"`
+	Perspective bool    `json:"perspective"`
+	Projection  *Matrix `json:"projection"`
+
+	Aperture         float64 `json:"aperture"`
+	FocusDistance    float64 `json:"focus_distance"`
+	FocusTarget      *Vector `json:"focus_target"`
+	ApertureBlades   int     `json:"aperture_blades"`
+	ApertureRotation float64 `json:"aperture_rotation"`
+
+	Stereo                 string  `json:"stereo"`
+	InterpupillaryDistance float64 `json:"interpupillary_distance"`
+	ConvergenceDistance    float64 `json:"convergence_distance"`
+
+	view       Matrix
+	projection Matrix
+	width      int
+	height     int
+	origin     Vector
+	side       Vector
+	up         Vector
+	forward    Vector
+	focus      float64
+	eye        float64
+}
+
+// prepare view and projection matrices for the given image size.
+func (c *Camera) prepare(width, height int) {
+	aspect := float64(width) / float64(height)
+	if !c.Perspective && c.Zoom <= 0 {
+		log.Printf("Orthographic camera without zoom, falling back to perspective")
+		c.Perspective = true
+	}
+
+	// Stereo eyes are moved sideways and keep looking parallel to the camera.
+	forward := normalizeVector(subVector(c.Target, c.Position))
+	side := normalizeVector(crossProduct(forward, c.Up))
+	eyeShift := c.eye * c.interpupillaryDistance() / 2.0
+	c.origin = combine(c.Position, side, 1.0, eyeShift)
+	c.origin[3] = 1.0
+	target := combine(c.Target, side, 1.0, eyeShift)
+	target[3] = 1.0
+
+	view := viewMatrix(c.origin, target, c.Up)
+	c.view = view
+	c.width = width
+	c.height = height
+	c.side = Vector{view[0][0], view[1][0], view[2][0], 0}
+	c.up = Vector{view[0][1], view[1][1], view[2][1], 0}
+	c.forward = Vector{-view[0][2], -view[1][2], -view[2][2], 0}
+	c.focus = c.focusDistance()
+
+	if c.Projection != nil {
+		c.projection = *c.Projection
+		return
+	}
+	if c.Perspective {
+		ymax := c.Near * math.Tan(c.Fov*math.Pi/360.0)
+		xmax := ymax * aspect
+		// Off-axis frustum, both eyes have zero parallax on the convergence plane.
+		shift := eyeShift * c.Near / c.convergenceDistance()
+		c.projection = frustumProjection(-xmax-shift, xmax-shift, -ymax, ymax, c.Near, c.Far)
+		return
+	}
+	halfWidth := c.Zoom / 2.0
+	halfHeight := c.Zoom / 2.0
+	if aspect >= 1 {
+		halfHeight = halfWidth / aspect
+	} else {
+		halfWidth = halfHeight * aspect
+	}
+	c.projection = orthographicProjection(-halfWidth, halfWidth, -halfHeight, halfHeight, c.Near, c.Far)
+}
+
+func (c *Camera) interpupillaryDistance() float64 {
+	if c.InterpupillaryDistance > 0 {
+		return c.InterpupillaryDistance
+	}
+	return defaultInterpupillaryDistance
+}
+
+func (c *Camera) convergenceDistance() float64 {
+	if c.ConvergenceDistance > 0 {
+		return c.ConvergenceDistance
+	}
+	return c.focus
+}
+
+func (c *Camera) focusDistance() float64 {
+	if c.FocusTarget != nil {
+		return dot(subVector(*c.FocusTarget, c.Position), c.forward)
+	}
+	if c.FocusDistance > 0 {
+		return c.FocusDistance
+	}
+	return dot(subVector(c.Target, c.Position), c.forward)
+}
+
+// ray from the camera through the given point on a width x height screen.
+// Points outside of the fisheye circle get an empty direction.
+func (c *Camera) ray(x, y, width, height int) (start, dir Vector) {
+	switch c.Type {
+	case CameraEquirectangular:
+		return c.origin, c.equirectangularDir(x, y, width, height)
+	case CameraFisheye:
+		return c.origin, c.fisheyeDir(x, y, width, height)
+	}
+	if !c.Perspective {
+		start, dir = screenToWorldOrtho(x, y, width, height, c.projection, c.view)
+	} else {
+		start, dir = c.origin, screenToWorld(x, y, width, height, c.origin, c.projection, c.view)
+	}
+	if c.Aperture > 0 {
+		return c.lensRay(start, dir)
+	}
+	return start, dir
+}
+
+// equirectangularDir is the inverse of the environment map lookup in
+// Intersection.render; longitude from atan2(x, y) and v linear on z.
+func (c *Camera) equirectangularDir(x, y, width, height int) Vector {
+	u := float64(x) / float64(width)
+	v := 1.0 - float64(y)/float64(height)
+	phi := (u - 0.5) * 2 * math.Pi
+	z := 2*v - 1
+	r := math.Sqrt(math.Max(0, 1-z*z))
+	return Vector{r * math.Sin(phi), r * math.Cos(phi), z, 0}
+}
+
+func (c *Camera) fisheyeDir(x, y, width, height int) Vector {
+	shortSide := float64(width)
+	if height < width {
+		shortSide = float64(height)
+	}
+	nx := (2*float64(x) - float64(width)) / shortSide
+	ny := (float64(height) - 2*float64(y)) / shortSide
+	r := math.Sqrt(nx*nx + ny*ny)
+	if r > 1 {
+		return Vector{}
+	}
+	theta := r * c.Fov * math.Pi / 360.0
+	sx, sy := 0.0, 0.0
+	if r > 0 {
+		sx = math.Sin(theta) * nx / r
+		sy = math.Sin(theta) * ny / r
+	}
+	dir := addVectors(scaleVector(c.side, sx), scaleVector(c.up, sy), scaleVector(c.forward, math.Cos(theta)))
+	dir[3] = 0
+	return normalizeVector(dir)
+}
+
+// lensRay moves the ray origin to a random point on the thin lens and aims it
+// at the point where the pinhole ray crosses the focal plane.
+func (c *Camera) lensRay(start, dir Vector) (Vector, Vector) {
+	t := (c.focus - dot(subVector(start, c.origin), c.forward)) / dot(dir, c.forward)
+	focusPoint := combine(start, dir, 1.0, t)
+	focusPoint[3] = 1.0
+
+	lx, ly := sampleAperture(c.ApertureBlades, c.ApertureRotation)
+	lensPoint := addVectors(start, scaleVector(c.side, lx*c.Aperture), scaleVector(c.up, ly*c.Aperture))
+	lensPoint[3] = 1.0
+	return lensPoint, normalizeVector(subVector(focusPoint, lensPoint))
+}
+
+// label is used for logging and file names, falls back to camera index.
+func (c *Camera) label(index int) string {
+	if c.Name == "" {
+		return strconv.Itoa(index)
+	}
+	return c.Name
+}
+
+func (s *Scene) camera() *Camera {
+	return &s.Cameras[s.ActiveCamera]
+}
+
+// SelectCamera sets the active camera by name or by index in the observers list.
+func (s *Scene) SelectCamera(ref string) error {
+	if len(s.Cameras) == 0 {
+		return ErrNoCamera
+	}
+	for i := range s.Cameras {
+		if s.Cameras[i].Name == ref {
+			s.ActiveCamera = i
+			return nil
+		}
+	}
+	index, err := strconv.Atoi(ref)
+	if err != nil || index < 0 || index >= len(s.Cameras) {
+		return fmt.Errorf("%w: %s", ErrCameraNotFound, ref)
+	}
+	s.ActiveCamera = index
+	return nil
+}
+
+// cameraFilename adds the camera label to the output filename.
+// awesome.png becomes awesome_Camera.001.png for the camera named Camera.001.
+func cameraFilename(filename string, c *Camera, index int) string {
+	label := strings.NewReplacer("/", "_", "\\", "_").Replace(c.label(index))
+	return suffixFilename(filename, label)
+}
+
+func suffixFilename(filename, suffix string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "_" + suffix + ext
+}
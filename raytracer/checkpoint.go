@@ -0,0 +1,290 @@
+package raytracer
+
+/*
+Checkpoints keep the finished pixels of a long render on disk, so a render
+killed halfway can continue with --resume instead of starting from zero.
+The file sits next to the output as <output>.checkpoint and is removed once
+the render completes. A checkpoint keeps the hash of the scene geometry and
+the config, it is only resumed by the same render.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// checkpoint is the state of a render written to disk.
+// Pass is the last completed pass of a progressive render.
+type checkpoint struct {
+	Width       int
+	Height      int
+	Camera      string
+	Progressive bool
+	Pass        int
+	Scene       [sha256.Size]byte
+	Pixels      []checkpointPixel
+}
+
+// checkpointPixel is a finished pixel, Index is y * width + x.
+type checkpointPixel struct {
+	Index   int
+	Color   Vector
+	Depth   float64
+	Samples int
+	M2      float64
+}
+
+// checkpointer collects finished pixels from the render workers and writes
+// them to disk every checkpoint_seconds. The state is copied under mu and
+// written under writing, workers don't wait for the disk.
+type checkpointer struct {
+	filename string
+	scene    *Scene
+	hash     [sha256.Size]byte
+	done     []int
+	pass     int
+	last     time.Time
+	mu       sync.Mutex
+	writing  sync.Mutex
+}
+
+// checkpointFilename is empty for renders without output file, they have no checkpoints.
+func checkpointFilename(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	return filename + ".checkpoint"
+}
+
+func newCheckpointer(scene *Scene, filename string) *checkpointer {
+	return &checkpointer{
+		filename: checkpointFilename(filename),
+		scene:    scene,
+		hash:     scene.hash,
+		done:     make([]int, 0),
+		last:     time.Now(),
+	}
+}
+
+// finish marks a pixel as done, called by the workers once the pixel won't change anymore.
+func (c *checkpointer) finish(x, y int) {
+	c.mu.Lock()
+	c.done = append(c.done, y*c.scene.Width+x)
+	var state *checkpoint
+	if c.due() {
+		state = c.state()
+	}
+	c.mu.Unlock()
+	c.write(state)
+}
+
+// finishPass records a completed progressive pass, pixels are marked done
+// one by one during the first pass. Workers are idle between passes.
+func (c *checkpointer) finishPass(pass int) {
+	c.mu.Lock()
+	c.pass = pass
+	var state *checkpoint
+	if c.due() {
+		state = c.state()
+	}
+	c.mu.Unlock()
+	c.write(state)
+}
+
+func (c *checkpointer) due() bool {
+	seconds := c.scene.renderer.Config.CheckpointSeconds
+	return c.filename != "" && seconds > 0 && time.Since(c.last).Seconds() >= seconds
+}
+
+// save writes the checkpoint right away, used when the render is interrupted.
+func (c *checkpointer) save() {
+	if c.filename == "" {
+		return
+	}
+	c.mu.Lock()
+	state := c.state()
+	c.mu.Unlock()
+	c.write(state)
+}
+
+// remove the checkpoint of a completed render.
+func (c *checkpointer) remove() {
+	if c.filename == "" {
+		return
+	}
+	if err := os.Remove(c.filename); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing checkpoint: %s", err.Error())
+	}
+}
+
+// state of the render to write, the next checkpoint is due from now on.
+func (c *checkpointer) state() *checkpoint {
+	state := &checkpoint{
+		Width:       c.scene.Width,
+		Height:      c.scene.Height,
+		Camera:      c.scene.camera().label(c.scene.ActiveCamera),
+		Progressive: c.scene.renderer.Config.ProgressivePasses > 0,
+		Pass:        c.pass,
+		Scene:       c.hash,
+		Pixels:      make([]checkpointPixel, len(c.done)),
+	}
+	for i, index := range c.done {
+		p := &c.scene.Pixels[index%c.scene.Width][index/c.scene.Width]
+		state.Pixels[i] = checkpointPixel{
+			Index:   index,
+			Color:   p.Color,
+			Depth:   p.Depth,
+			Samples: p.Samples,
+			M2:      p.m2,
+		}
+	}
+	c.last = time.Now()
+	return state
+}
+
+// write the state to disk, nothing when there is no state.
+func (c *checkpointer) write(state *checkpoint) {
+	if state == nil {
+		return
+	}
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	// Write next to the old one and swap, a kill while writing keeps the old checkpoint.
+	tmp := c.filename + ".tmp"
+	if err := writeCheckpoint(tmp, state); err != nil {
+		log.Printf("Error writing checkpoint: %s", err.Error())
+		return
+	}
+	if err := os.Rename(tmp, c.filename); err != nil {
+		log.Printf("Error writing checkpoint: %s", err.Error())
+		return
+	}
+	log.Printf("Checkpoint %s saved with %d pixels", c.filename, len(state.Pixels))
+}
+
+func writeCheckpoint(filename string, state *checkpoint) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(state); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readCheckpoint(filename string) (*checkpoint, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	state := checkpoint{}
+	if err := gob.NewDecoder(f).Decode(&state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// resume loads the checkpoint into the scene pixels and returns which pixels
+// are done, indexed by y * width + x. Checkpoints of a different render are ignored.
+func (c *checkpointer) resume() []bool {
+	done := make([]bool, c.scene.Width*c.scene.Height)
+	state, err := readCheckpoint(c.filename)
+	if err != nil {
+		log.Printf("No checkpoint to resume from: %s", err.Error())
+		return done
+	}
+	if err := c.check(state); err != nil {
+		log.Printf("Ignoring checkpoint %s: %s", c.filename, err.Error())
+		return done
+	}
+	for _, pixel := range state.Pixels {
+		p := &c.scene.Pixels[pixel.Index%c.scene.Width][pixel.Index/c.scene.Width]
+		p.Color = pixel.Color
+		p.Depth = pixel.Depth
+		p.Samples = pixel.Samples
+		p.m2 = pixel.M2
+		done[pixel.Index] = true
+		c.done = append(c.done, pixel.Index)
+	}
+	c.pass = state.Pass
+	log.Printf("Resuming from %s with %d finished pixels", c.filename, len(state.Pixels))
+	return done
+}
+
+func (c *checkpointer) check(state *checkpoint) error {
+	if state.Width != c.scene.Width || state.Height != c.scene.Height {
+		return fmt.Errorf("size is %dx%d, rendering %dx%d", state.Width, state.Height, c.scene.Width, c.scene.Height)
+	}
+	camera := c.scene.camera().label(c.scene.ActiveCamera)
+	if state.Camera != camera {
+		return fmt.Errorf("camera is %s, rendering %s", state.Camera, camera)
+	}
+	if state.Progressive != (c.scene.renderer.Config.ProgressivePasses > 0) {
+		return fmt.Errorf("progressive setting changed")
+	}
+	if state.Scene != c.hash {
+		return fmt.Errorf("scene or config changed")
+	}
+	for _, pixel := range state.Pixels {
+		if pixel.Index < 0 || pixel.Index >= state.Width*state.Height {
+			return fmt.Errorf("pixel %d out of image", pixel.Index)
+		}
+	}
+	return nil
+}
+
+// renderHash of the scene geometry, lights, primitives and the config that
+// change the image. Taken while the lights are the ones of the scene.
+func (s *Scene) renderHash() [sha256.Size]byte {
+	config := imageConfig(s.renderer.Config)
+	h := sha256.New()
+	_, _ = h.Write(s.geometry[:])
+	e := json.NewEncoder(h)
+	_ = e.Encode(&config)
+	_ = e.Encode(s.Lights)
+	_ = e.Encode(s.Primitives)
+	result := [sha256.Size]byte{}
+	copy(result[:], h.Sum(nil))
+	return result
+}
+
+// imageConfig without the settings that don't change the image, the image
+// size is checked on its own.
+func imageConfig(config Config) Config {
+	config.CheckpointSeconds = 0
+	config.Height = 0
+	config.KDTreeCache = false
+	config.Percentage = 0
+	config.SnapshotPasses = 0
+	config.SnapshotSeconds = 0
+	config.Threads = 0
+	config.Width = 0
+	return config
+}
+
+// remainingTiles drops the finished pixels from the tiles.
+func remainingTiles(tiles []tile, done []bool, width int) []tile {
+	result := make([]tile, 0, len(tiles))
+	for i := range tiles {
+		pixels := make([]image.Point, 0, len(tiles[i].pixels))
+		for _, p := range tiles[i].pixels {
+			if !done[p.Y*width+p.X] {
+				pixels = append(pixels, p)
+			}
+		}
+		if len(pixels) > 0 {
+			result = append(result, tile{bounds: tiles[i].bounds, pixels: pixels})
+		}
+	}
+	return result
+}
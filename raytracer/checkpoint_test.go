@@ -0,0 +1,87 @@
+package raytracer
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// checkpointScene with the lights that are sampled while preparing, emissive
+// faces and a directional light.
+func checkpointScene(config Config) *Scene {
+	r := NewRenderer()
+	r.Config = config
+	s := NewScene(SceneOptions{})
+	obj := heightField(4)
+	obj.Materials["lamp"] = Material{Color: Vector{1, 1, 1, 1}, Light: true, LightStrength: 2}
+	a := obj.AddVertex(Vector{0, 0, 2, 1}, Vector{0, 0, -1, 0}, Vector{})
+	b := obj.AddVertex(Vector{1, 0, 2, 1}, Vector{0, 0, -1, 0}, Vector{})
+	c := obj.AddVertex(Vector{0, 1, 2, 1}, Vector{0, 0, -1, 0}, Vector{})
+	obj.Colors = append(obj.Colors, Vector{1, 1, 1, 1}, Vector{1, 1, 1, 1}, Vector{1, 1, 1, 1})
+	_ = obj.AddFace("lamp", a, c, b, false)
+	_ = s.AddObject("grid", obj)
+	_ = s.AddLight(Light{Color: Vector{1, 1, 1, 1}, Active: true, LightStrength: 1, Directional: true, Direction: Vector{0, 0, -1, 0}})
+	_ = s.AddLight(Light{Position: Vector{0.5, 0.5, 3, 1}, Color: Vector{1, 1, 1, 1}, Active: true, LightStrength: 1})
+	s.AddCamera(Camera{
+		Position:    Vector{0.5, 0.5, 3, 1},
+		Target:      Vector{0.5, 0.5, 0, 1},
+		Up:          Vector{0, 1, 0, 0},
+		Fov:         40,
+		AspectRatio: 1,
+		Near:        0.01,
+		Far:         100,
+		Perspective: true,
+	})
+	r.prepare(s, 4, 4)
+	s.prepareMatrices()
+	s.allocatePixels()
+	return s
+}
+
+func TestCheckpointSceneHash(t *testing.T) {
+	config := DEFAULT
+	config.KDTreeCache = false
+	a := checkpointScene(config)
+	b := checkpointScene(config)
+	if a.hash != b.hash {
+		t.Fatal("the same scene has different hashes")
+	}
+	config.Exposure *= 2
+	if c := checkpointScene(config); c.hash == a.hash {
+		t.Fatal("changed config has the same hash")
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	config := DEFAULT
+	config.KDTreeCache = false
+	output := filepath.Join(t.TempDir(), "render.png")
+	tests := []struct {
+		name     string
+		exposure float64
+		resumed  int
+	}{
+		{"same scene", config.Exposure, 5},
+		{"changed config", config.Exposure * 2, 0},
+	}
+	saved := checkpointScene(config)
+	checkpoints := newCheckpointer(saved, output)
+	for i := 0; i < 5; i++ {
+		checkpoints.finish(i%4, i/4)
+	}
+	checkpoints.save()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := config
+			config.Exposure = test.exposure
+			resumed := 0
+			for _, done := range newCheckpointer(checkpointScene(config), output).resume() {
+				if done {
+					resumed++
+				}
+			}
+			if resumed != test.resumed {
+				t.Errorf("resumed %d pixels, want %d", resumed, test.resumed)
+			}
+		})
+	}
+}
@@ -2,25 +2,33 @@ package raytracer
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 )
 
 // Config keeps Raytracer Configuration.
 type Config struct {
+	Accelerator              string  `json:"accelerator"`
 	AmbientColorSharingRatio float64 `json:"ambient_color_ratio"`
 	AmbientRadius            float64 `json:"ambient_occlusion_radius"`
 	AntialiasSamples         int     `json:"antialias_samples"`
 	CausticsSamplerLimit     int     `json:"caustics_samples"`
-	EdgeDetechThreshold      float64 `json:"edge_detect_threshold"`
+	CheckpointSeconds        float64 `json:"checkpoint_seconds"`
 	EnvironmentMap           string  `json:"environment_map"`
 	Exposure                 float64 `json:"exposure"`
 	Height                   int     `json:"height"`
+	Integrator               string  `json:"integrator"`
+	KDTreeCache              bool    `json:"kd_tree_cache"`
 	LightSampleCount         int     `json:"light_sample_count"`
 	MaxReflectionDepth       int     `json:"max_reflection_depth"`
+	MinSamples               int     `json:"min_samples"`
+	NoiseThreshold           float64 `json:"noise_threshold"`
 	OcclusionRate            float64 `json:"occlusion_rate"`
+	PathMaxDepth             int     `json:"path_max_depth"`
+	PathSamples              int     `json:"path_samples"`
 	PhotonSpacing            float64 `json:"photon_spacing"`
-	RayCorrection            float64 `json:"ray_correction"`
+	ProgressivePasses        int     `json:"progressive_passes"`
 	RenderAmbientColors      bool    `json:"render_ambient_color"`
 	RenderBumpMap            bool    `json:"render_bump_map"`
 	RenderCaustics           bool    `json:"render_caustics"`
@@ -30,6 +38,10 @@ type Config struct {
 	RenderReflections        bool    `json:"render_reflections"`
 	RenderRefractions        bool    `json:"render_refractions"`
 	SamplerLimit             int     `json:"sampler_limit"`
+	SnapshotPasses           int     `json:"snapshot_passes"`
+	SnapshotSeconds          float64 `json:"snapshot_seconds"`
+	Threads                  int     `json:"threads"`
+	TileSize                 int     `json:"tile_size"`
 	TransparentColor         Vector  `json:"transparent_color"`
 	Width                    int     `json:"width"`
 	Percentage               int
@@ -39,20 +51,27 @@ type Config struct {
 // These are likely incorrect :D.
 var DEFAULT = Config{
 	// Default Config Settings
+	Accelerator:              AcceleratorKDTree,
 	AmbientColorSharingRatio: 0.5,
 	AmbientRadius:            2.1,
-	AntialiasSamples:         8,
+	AntialiasSamples:         16,
 	CausticsSamplerLimit:     10000,
+	CheckpointSeconds:        300,
 	EnvironmentMap:           "",
-	EdgeDetechThreshold:      0.7,
 	Exposure:                 0.2,
 	Height:                   900,
+	Integrator:               IntegratorPreview,
+	KDTreeCache:              true,
 	LightSampleCount:         16,
 	MaxReflectionDepth:       3,
+	MinSamples:               4,
+	NoiseThreshold:           0.02,
 	OcclusionRate:            0.2,
+	PathMaxDepth:             8,
+	PathSamples:              16,
 	Percentage:               100,
 	PhotonSpacing:            0.005,
-	RayCorrection:            0.002,
+	ProgressivePasses:        0,
 	RenderAmbientColors:      true,
 	RenderBumpMap:            true,
 	RenderCaustics:           false,
@@ -62,32 +81,30 @@ var DEFAULT = Config{
 	RenderReflections:        true,
 	RenderRefractions:        true,
 	SamplerLimit:             16,
+	SnapshotPasses:           0,
+	SnapshotSeconds:          60,
+	Threads:                  0,
+	TileSize:                 32,
 	TransparentColor:         Vector{0, 0, 0, 0},
 	Width:                    1600,
 }
 
-// GlobalConfig is reachable from all app context
-// I know that Globals are evil but believe me it's better to have it in global
-// in this application.
-var GlobalConfig = Config{}
-
 // LoadConfig file for the render.
-func loadConfig(jsonFile string) error {
-	var config Config
+func loadConfig(jsonFile string) (Config, error) {
+	// Start from defaults, so older config files get sane values for newer keys.
+	config := DEFAULT
 	log.Printf("Loading configuration from %s", jsonFile)
 	file, err := ioutil.ReadFile(jsonFile)
 	if err != nil {
 		log.Printf("Error while reading file: %s", err.Error())
-		return nil
+		return config, nil
 	}
 	log.Printf("Unmarshal JSON\n")
 	err = json.Unmarshal(file, &config)
 	if err != nil {
-		log.Fatalf("Error unmarshalling %s", err.Error())
-		return err
+		return config, fmt.Errorf("%s: %w", jsonFile, err)
 	}
-	GlobalConfig = config
-	return nil
+	return config, nil
 }
 
 // CreateConfig file.
@@ -95,7 +112,6 @@ func CreateConfig(jsonfile string) error {
 	file, _ := json.MarshalIndent(DEFAULT, "", " ")
 	ferr := ioutil.WriteFile(jsonfile, file, 0600)
 	if ferr != nil {
-		log.Fatal(ferr.Error())
 		return ferr
 	}
 	log.Printf("Created config.json")
@@ -1,23 +1,22 @@
 package raytracer
 
 import (
+	"context"
 	"image"
+	"image/draw"
 	"image/png"
 	"log"
-	"math"
-	"math/rand"
 	"os"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/cheggaaa/pb"
 )
 
-func getWidthHeight(size string) (int, int, error) {
+// getWidthHeight is the configured image size, unless --size overrides it.
+func getWidthHeight(config *Config, size string) (int, int, error) {
 	var err error
-	width := GlobalConfig.Width
-	height := GlobalConfig.Height
+	width := config.Width
+	height := config.Height
 	if strings.Contains(size, "x") {
 		log.Printf("Set size to %s", size)
 		split := strings.Split(size, "x")
@@ -33,39 +32,118 @@ func getWidthHeight(size string) (int, int, error) {
 	return width, height, nil
 }
 
-func getPixelList(width, height, left, right, top, bottom, percent int) (int, []int) {
-	actualWidth := width
-	actualHeight := height
-	if right+left > 0 {
-		actualWidth = right - left
-		actualHeight = bottom - top
+// RenderToFile renders the scene from the active camera to the scene output
+// file, main processor.
+// Cancelling ctx, or its deadline passing, stops the render; pixels finished so
+// far are still written to the output file, the rest are left as the
+// transparent color, and the context error is returned.
+func (r *Renderer) RenderToFile(ctx context.Context, scene *Scene, left, right, top, bottom, percent int, size *string) error {
+	if len(scene.Cameras) == 0 {
+		return ErrNoCamera
+	}
+	width, height, err := getWidthHeight(&r.Config, *size)
+	if err != nil {
+		return err
 	}
 
-	totalPixels := actualWidth * actualHeight
+	log.Printf("Start rendering scene\n")
+	r.prepare(scene, width, height)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	region := renderRegion(width, height, left, right, top, bottom)
+	return renderCamera(ctx, scene, scene.OutputFilename, region, percent)
+}
 
-	pixelList := make([]int, totalPixels)
-	for i := 0; i < totalPixels; i++ {
-		pixelList[i] = i
+// RenderAllCameras renders one image per observer in the scene.
+// Scene is loaded and prepared only once and shared between the cameras.
+// Cameras after a cancelled one are not rendered.
+func (r *Renderer) RenderAllCameras(ctx context.Context, scene *Scene, left, right, top, bottom, percent int, size *string) error {
+	if len(scene.Cameras) == 0 {
+		return ErrNoCamera
+	}
+	width, height, err := getWidthHeight(&r.Config, *size)
+	if err != nil {
+		return err
 	}
-	rand.Shuffle(totalPixels, func(i, j int) { pixelList[i], pixelList[j] = pixelList[j], pixelList[i] })
 
-	to := percent * totalPixels / 100
-	if percent < 100 {
-		pixelList = pixelList[:to]
-		totalPixels = to
+	log.Printf("Start rendering scene for %d cameras\n", len(scene.Cameras))
+	r.prepare(scene, width, height)
+	region := renderRegion(width, height, left, right, top, bottom)
+	for i := range scene.Cameras {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		scene.ActiveCamera = i
+		filename := cameraFilename(scene.OutputFilename, &scene.Cameras[i], i)
+		if err := renderCamera(ctx, scene, filename, region, percent); err != nil {
+			return err
+		}
 	}
-	return totalPixels, pixelList
+	return nil
 }
 
-// Render the scene, main processor.
-func Render(scene *Scene, left, right, top, bottom, percent int, size *string) error {
-	width, height, err := getWidthHeight(*size)
-	if err != nil {
+// renderCamera renders and saves the active camera. Partial images of a
+// cancelled render are saved too before returning the render error.
+func renderCamera(ctx context.Context, scene *Scene, filename string, region image.Rectangle, percent int) error {
+	observer := scene.camera()
+	if observer.Stereo == "" {
+		img, err := renderView(ctx, scene, filename, region, percent)
+		var saveErr error
+		if isTileFile(filename) {
+			// Only the region goes to tile files, to be merged with the other regions later.
+			saveErr = saveTile(filename, tileFromPixels(scene, region))
+		} else {
+			saveErr = saveImage(filename, img)
+		}
+		if saveErr != nil {
+			return saveErr
+		}
 		return err
 	}
 
-	log.Printf("Start rendering scene\n")
-	scene.prepare(width, height)
+	// Both eyes share the prepared scene, only the camera changes.
+	log.Printf("Render left eye")
+	observer.eye = leftEye
+	leftImg, err := renderView(ctx, scene, suffixFilename(filename, "left"), region, percent)
+	rightImg := image.NewRGBA(leftImg.Bounds())
+	if err == nil {
+		log.Printf("Render right eye")
+		observer.eye = rightEye
+		rightImg, err = renderView(ctx, scene, suffixFilename(filename, "right"), region, percent)
+	}
+	observer.eye = 0
+
+	if saveErr := saveStereo(filename, observer.Stereo, leftImg, rightImg); saveErr != nil {
+		return saveErr
+	}
+	return err
+}
+
+func saveStereo(filename, layout string, leftImg, rightImg *image.RGBA) error {
+	switch layout {
+	case StereoSeparate:
+		if err := saveImage(suffixFilename(filename, "left"), leftImg); err != nil {
+			return err
+		}
+		return saveImage(suffixFilename(filename, "right"), rightImg)
+	case StereoTopBottom:
+		return saveImage(filename, stackImages(leftImg, rightImg, false))
+	case StereoSideBySide:
+		return saveImage(filename, stackImages(leftImg, rightImg, true))
+	default:
+		log.Printf("Unknown stereo mode %s, using %s", layout, StereoSideBySide)
+		return saveImage(filename, stackImages(leftImg, rightImg, true))
+	}
+}
+
+// renderView renders the region of the active camera into an image, progressive
+// renders write their intermediate results to snapshotFile, and checkpoints and
+// sample maps are named after it. Without snapshotFile nothing is written.
+// The image is always returned, with only the finished pixels when ctx is cancelled.
+func renderView(ctx context.Context, scene *Scene, snapshotFile string, region image.Rectangle, percent int) (*image.RGBA, error) {
+	width := scene.Width
+	height := scene.Height
 	start := time.Now()
 
 	upLeft := image.Point{X: 0, Y: 0}
@@ -75,25 +153,73 @@ func Render(scene *Scene, left, right, top, bottom, percent int, size *string) e
 	img := image.NewRGBA(image.Rectangle{Min: upLeft, Max: lowRight})
 
 	// Set color for each pixel.
+	config := &scene.renderer.Config
+	tiles := makeTiles(region, config.TileSize, percent)
+	if err := scene.prepareCamera(ctx, tiles); err != nil {
+		log.Printf("Render cancelled while scanning pixels")
+		return img, err
+	}
 
-	scene.Width = width
-	scene.Height = height
+	if scene.SampleMap && snapshotFile != "" {
+		defer saveSampleMap(scene, suffixFilename(snapshotFile, "samples"))
+	}
+	checkpoints := newCheckpointer(scene, snapshotFile)
+	done := make([]bool, width*height)
+	if scene.Resume {
+		done = checkpoints.resume()
+	}
+	var err error
+	if config.ProgressivePasses > 0 {
+		err = renderProgressive(ctx, scene, img, snapshotFile, tiles, checkpoints, done)
+	} else {
+		err = renderTiles(ctx, scene.renderer.renderThreads(), remainingTiles(tiles, done, width), func(x, y int) {
+			renderPixel(scene, x, y)
+			adaptiveSample(scene, x, y)
+			checkpoints.finish(x, y)
+		})
+		renderImage(scene, img)
+	}
+
+	if err != nil {
+		log.Printf("Render cancelled after %f seconds, keeping finished pixels\n", time.Since(start).Seconds())
+		checkpoints.save()
+		return img, err
+	}
+	checkpoints.remove()
+	log.Printf("Rendered scene in %f seconds\n", time.Since(start).Seconds())
+	return img, nil
+}
 
-	totalPixels, pixellist := getPixelList(width, height, left, right, top, bottom, percent)
-	bar := pb.StartNew(totalPixels)
+// stackImages puts second image next to the first one, or below it.
+func stackImages(first, second *image.RGBA, sideBySide bool) *image.RGBA {
+	size := first.Bounds().Size()
+	offset := image.Point{X: 0, Y: size.Y}
+	if sideBySide {
+		offset = image.Point{X: size.X, Y: 0}
+	}
+	result := image.NewRGBA(image.Rectangle{Max: size.Add(offset)})
+	draw.Draw(result, first.Bounds(), first, image.Point{}, draw.Src)
+	draw.Draw(result, second.Bounds().Add(offset), second, image.Point{}, draw.Src)
+	return result
+}
 
-	for i := 0; i < totalPixels; i++ {
-		y := int(math.Floor(float64(pixellist[i])/float64(width))) + top
-		x := (pixellist[i] % width) + left
-		renderPixel(scene, x, y)
-		bar.Increment()
+func saveSampleMap(scene *Scene, filename string) {
+	img := image.NewRGBA(image.Rectangle{Max: image.Point{X: scene.Width, Y: scene.Height}})
+	renderSampleMap(scene, img)
+	if err := saveImage(filename, img); err != nil {
+		log.Printf("Error saving sample map: %s", err.Error())
 	}
-	bar.Finish()
+}
 
-	log.Printf("Rendered scene in %f seconds\n", time.Since(start).Seconds())
-	log.Printf("Second pass for antialiasing and image generation")
-	renderImage(scene, img)
-	// Encode as PNG.
-	f, _ := os.Create(scene.OutputFilename)
-	return png.Encode(f, img)
+func saveImage(filename string, img image.Image) error {
+	log.Printf("Saving %s", filename)
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
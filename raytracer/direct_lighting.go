@@ -11,15 +11,44 @@ import (
 const sunDist = 99999999999.00
 const sunRadius = 4999999999.95
 
+// prepareSpot direction and cone cosines, the inner cone is kept within the outer one.
+func (l *Light) prepareSpot() {
+	l.Direction[3] = 0
+	l.Direction = normalizeVector(l.Direction)
+	inner := math.Min(l.InnerAngle, l.OuterAngle)
+	l.cosInner = math.Cos(inner * math.Pi / 360.0)
+	l.cosOuter = math.Cos(l.OuterAngle * math.Pi / 360.0)
+	if l.SpotFalloff <= 0 {
+		l.SpotFalloff = 1
+	}
+}
+
+// spotFactor of the light going in the direction, 1 for lights that are not
+// spot lights. Smoothstep between the cones, raised to the falloff.
+func (l *Light) spotFactor(dir Vector) float64 {
+	if !l.Spot {
+		return 1
+	}
+	cos := dot(l.Direction, dir)
+	if cos <= l.cosOuter {
+		return 0
+	}
+	if cos >= l.cosInner {
+		return 1
+	}
+	t := (cos - l.cosOuter) / (l.cosInner - l.cosOuter)
+	return math.Pow(t*t*(3-2*t), l.SpotFalloff)
+}
+
 func isShortestIntersection(inter *Intersection, sInter *Intersection) bool {
-	return (sInter.Triangle != nil && sInter.Triangle.id == inter.Triangle.id) || sInter.Dist < DIFF
+	return (sInter.Triangle != nil && sInter.id() == inter.id()) || sInter.Dist < DIFF
 }
 
-func isFlatGlass(inter *Intersection, sInter *Intersection) bool {
+func isFlatGlass(scene *Scene, inter *Intersection, sInter *Intersection) bool {
 	return (sInter.Hit && sInter.Triangle != nil) &&
-		(sInter.Triangle.id != inter.Triangle.id) && (sInter.Triangle.Material.Transmission > 0) &&
-		(GlobalConfig.RenderRefractions)
-	//  && (!sInter.Triangle.Smooth)
+		(sInter.id() != inter.id()) && (sInter.Triangle.Material.Transmission > 0) &&
+		(scene.renderer.Config.RenderRefractions)
+	//  && (!sInter.Triangle.smooth())
 }
 
 func calculateDirectionalLight(scene *Scene, intersection *Intersection, light *Light, depth int) (result Vector) {
@@ -36,7 +65,7 @@ func calculateDirectionalLight(scene *Scene, intersection *Intersection, light *
 	}
 
 	if light.Samples == nil {
-		light.Samples = sampleSphere(sunRadius, GlobalConfig.LightSampleCount)
+		light.Samples = sampleSphere(sunRadius, scene.renderer.Config.LightSampleCount)
 	}
 
 	totalHits := 0.0
@@ -46,14 +75,14 @@ func calculateDirectionalLight(scene *Scene, intersection *Intersection, light *
 		rayStart := addVectors(scaleVector(lightD, sunDist), intersection.Intersection, light.Samples[i])
 		dir := normalizeVector(subVector(rayStart, intersection.Intersection))
 
-		shortestIntersection = raycastSceneIntersect(scene, intersection.Intersection, dir)
+		shortestIntersection = raycastSceneBounce(scene, intersection, dir)
 		if isShortestIntersection(intersection, &shortestIntersection) {
 			if !sameSideTest(intersection.IntersectionNormal, shortestIntersection.IntersectionNormal, 0) {
 				return
 			}
 
 			intensity := dotP * light.LightStrength
-			intensity *= GlobalConfig.Exposure
+			intensity *= scene.renderer.Config.Exposure
 
 			totalLight = addVector(totalLight, Vector{
 				light.Color[0] * intensity,
@@ -65,8 +94,8 @@ func calculateDirectionalLight(scene *Scene, intersection *Intersection, light *
 		}
 
 		// Let things pass if this is a regular glass
-		if isFlatGlass(intersection, &shortestIntersection) {
-			col := shortestIntersection.getColor()
+		if isFlatGlass(scene, intersection, &shortestIntersection) {
+			col := shortestIntersection.getColor(scene)
 			lColor := Vector{
 				light.Color[0] * col[0],
 				light.Color[1] * col[1],
@@ -74,7 +103,7 @@ func calculateDirectionalLight(scene *Scene, intersection *Intersection, light *
 				1,
 			}
 
-			intensity := (1 / (shortestIntersection.Dist * shortestIntersection.Dist)) * GlobalConfig.Exposure
+			intensity := (1 / (shortestIntersection.Dist * shortestIntersection.Dist)) * scene.renderer.Config.Exposure
 			intensity *= dotP * light.LightStrength * shortestIntersection.Triangle.Material.Transmission
 			if intensity > DIFF && intensity < light.LightStrength {
 				subLight := Light{
@@ -88,7 +117,7 @@ func calculateDirectionalLight(scene *Scene, intersection *Intersection, light *
 		}
 	}
 	if totalHits > 0 {
-		return scaleVector(totalLight, totalHits/float64(GlobalConfig.LightSampleCount))
+		return scaleVector(totalLight, totalHits/float64(scene.renderer.Config.LightSampleCount))
 	}
 
 	return
@@ -108,15 +137,21 @@ func calculateLight(scene *Scene, intersection *Intersection, light *Light, dept
 	if dotP < 0 {
 		return
 	}
+	spot := light.spotFactor(scaleVector(l1, -1))
+	if spot <= 0 {
+		return
+	}
 
 	if intersection.Triangle.Material.Light {
-		if intersection.Triangle.Material.LightStrength == 0 {
-			intersection.Triangle.Material.LightStrength = light.LightStrength
+		// Materials are shared between the render threads, they are only read.
+		strength := intersection.Triangle.Material.LightStrength
+		if strength == 0 {
+			strength = light.LightStrength
 		}
 		return Vector{
-			GlobalConfig.Exposure * light.Color[0] * intersection.Triangle.Material.LightStrength,
-			GlobalConfig.Exposure * light.Color[1] * intersection.Triangle.Material.LightStrength,
-			GlobalConfig.Exposure * light.Color[2] * intersection.Triangle.Material.LightStrength,
+			scene.renderer.Config.Exposure * light.Color[0] * strength,
+			scene.renderer.Config.Exposure * light.Color[1] * strength,
+			scene.renderer.Config.Exposure * light.Color[2] * strength,
 			1,
 		}
 	}
@@ -124,19 +159,19 @@ func calculateLight(scene *Scene, intersection *Intersection, light *Light, dept
 	rayDir := normalizeVector(subVector(intersection.Intersection, light.Position))
 	rayLength := vectorDistance(intersection.Intersection, light.Position)
 
-	shortestIntersection := raycastSceneIntersect(scene, light.Position, rayDir)
+	shortestIntersection := raycastSceneIntersect(scene, light.rayOrigin(rayDir), rayDir)
 	s := math.Abs(rayLength - shortestIntersection.Dist)
 
-	if (shortestIntersection.Triangle != nil && shortestIntersection.Triangle.id == intersection.Triangle.id) || s < DIFF {
+	if (shortestIntersection.Triangle != nil && shortestIntersection.id() == intersection.id()) || s < DIFF {
 		if !sameSideTest(intersection.IntersectionNormal, shortestIntersection.IntersectionNormal, 0) {
 			return
 		}
 
-		intensity := (1 / (rayLength * rayLength)) * GlobalConfig.Exposure
-		intensity *= dotP * light.LightStrength
+		intensity := (1 / (rayLength * rayLength)) * scene.renderer.Config.Exposure
+		intensity *= dotP * light.LightStrength * spot
 
 		if intersection.Triangle.Material.LightStrength > 0 {
-			intensity = intersection.Triangle.Material.LightStrength * GlobalConfig.Exposure
+			intensity = intersection.Triangle.Material.LightStrength * scene.renderer.Config.Exposure
 		}
 
 		return Vector{
@@ -148,8 +183,8 @@ func calculateLight(scene *Scene, intersection *Intersection, light *Light, dept
 	}
 
 	// Let things pass if this is a regular glass
-	if isFlatGlass(intersection, &shortestIntersection) {
-		col := shortestIntersection.getColor()
+	if isFlatGlass(scene, intersection, &shortestIntersection) {
+		col := shortestIntersection.getColor(scene)
 		lColor := Vector{
 			light.Color[0] * col[0],
 			light.Color[1] * col[1],
@@ -157,14 +192,15 @@ func calculateLight(scene *Scene, intersection *Intersection, light *Light, dept
 			1,
 		}
 
-		intensity := (1 / (shortestIntersection.Dist * shortestIntersection.Dist)) * GlobalConfig.Exposure
-		intensity *= dotP * light.LightStrength * shortestIntersection.Triangle.Material.Transmission
+		intensity := (1 / (shortestIntersection.Dist * shortestIntersection.Dist)) * scene.renderer.Config.Exposure
+		intensity *= dotP * light.LightStrength * shortestIntersection.Triangle.Material.Transmission * spot
 		if intensity > DIFF && intensity < light.LightStrength {
 			subLight := Light{
 				Position:      shortestIntersection.Intersection,
 				Color:         lColor,
 				Active:        true,
 				LightStrength: intensity,
+				normal:        shortestIntersection.geometricNormal,
 			}
 			return calculateLight(scene, intersection, &subLight, depth)
 		}
@@ -173,42 +209,33 @@ func calculateLight(scene *Scene, intersection *Intersection, light *Light, dept
 }
 
 func calculateTotalLight(scene *Scene, intersection *Intersection, depth int) (result Vector) {
-	if (!intersection.Hit) || (depth >= GlobalConfig.MaxReflectionDepth) {
+	if (!intersection.Hit) || (depth >= scene.renderer.Config.MaxReflectionDepth) {
 		return
 	}
 
 	if intersection.Triangle.Material.Light {
-		c := scaleVector(intersection.Triangle.Material.Color, intersection.Triangle.Material.LightStrength)
-		return c
-	}
-
-	lightChan := make(chan Vector, len(scene.Lights))
-
-	for i := range scene.Lights {
-		go func(scene *Scene, intersection *Intersection, light *Light, depth int, lightChan chan Vector) {
-			if light.Directional {
-				lightChan <- calculateDirectionalLight(scene, intersection, light, depth)
-			} else {
-				lightChan <- calculateLight(scene, intersection, light, depth)
-			}
-		}(scene, intersection, &scene.Lights[i], depth, lightChan)
+		return intersection.Triangle.Material.emission()
 	}
 
 	result = Vector{}
-	for i := 0; i < len(scene.Lights); i++ {
-		light := <-lightChan
+	for i := range scene.Lights {
+		var light Vector
+		if scene.Lights[i].Directional {
+			light = calculateDirectionalLight(scene, intersection, &scene.Lights[i], depth)
+		} else {
+			light = calculateLight(scene, intersection, &scene.Lights[i], depth)
+		}
 		if light[3] > 0 {
 			result = addVector(result, light)
 		}
 	}
 
-	if GlobalConfig.PhotonSpacing > 0 && GlobalConfig.RenderCaustics {
-		if intersection.Triangle.Photons != nil && len(intersection.Triangle.Photons) > 0 {
-			for i := range intersection.Triangle.Photons {
-				if vectorDistance(intersection.Triangle.Photons[i].Location, intersection.Intersection) < GlobalConfig.PhotonSpacing {
-					c := scaleVector(intersection.Triangle.Photons[i].Color, GlobalConfig.Exposure)
-					result = addVector(result, c)
-				}
+	if scene.renderer.Config.PhotonSpacing > 0 && scene.renderer.Config.RenderCaustics {
+		photons := scene.photons.on(intersection.id())
+		for i := range photons {
+			if vectorDistance(photons[i].Location, intersection.Intersection) < scene.renderer.Config.PhotonSpacing {
+				c := scaleVector(photons[i].Color, scene.renderer.Config.Exposure)
+				result = addVector(result, c)
 			}
 		}
 	}
@@ -0,0 +1,40 @@
+package raytracer
+
+import (
+	"testing"
+)
+
+// TestCalculateLightEmitter lights an emissive surface without a strength
+// with lights of different strengths, the shared material is left as it is.
+func TestCalculateLightEmitter(t *testing.T) {
+	s := NewScene(SceneOptions{})
+	s.renderer = NewRenderer()
+	s.renderer.Config = DEFAULT
+	s.renderer.Config.Exposure = 1
+	material := &Material{Color: Vector{1, 1, 1, 1}, Light: true}
+	hit := Intersection{
+		Hit:                true,
+		Triangle:           &Triangle{Material: material},
+		Intersection:       Vector{0, 0, 0, 1},
+		IntersectionNormal: Vector{0, 0, 1, 0},
+	}
+	tests := []struct {
+		name     string
+		strength float64
+	}{
+		{"strong", 4},
+		{"weak", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			light := Light{Position: Vector{0, 0, 2, 1}, Color: Vector{1, 0.5, 0, 1}, Active: true, LightStrength: test.strength}
+			want := Vector{test.strength, 0.5 * test.strength, 0, 1}
+			if got := calculateLight(s, &hit, &light, 0); got != want {
+				t.Errorf("light %v, want %v", got, want)
+			}
+			if material.LightStrength != 0 {
+				t.Errorf("material strength changed to %v", material.LightStrength)
+			}
+		})
+	}
+}
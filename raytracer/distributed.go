@@ -0,0 +1,421 @@
+package raytracer
+
+/*
+Distributed rendering, a coordinator splits the image into tiles and hands
+them out to worker processes, which send back raw float tiles.
+Local workers are child processes talking gob over stdin and stdout, remote
+workers connect over TCP. Every worker loads and prepares the scene itself,
+so the scene and its textures must be on the worker machine too. Jobs carry
+the hash of the coordinator scene and config, tiles the hash of the worker
+ones, tiles of a worker with another scene are rejected.
+*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/cheggaaa/pb"
+)
+
+// Tiles handed out to workers, bigger than render tiles to keep the chatter low.
+const distributedTileSize = 128
+
+// maxTileMessage bytes a worker may send for a tile, RGBA float32s of the
+// biggest tile with room for the gob framing and read ahead.
+const maxTileMessage = distributedTileSize*distributedTileSize*4*4 + 1<<16
+
+// Local workers get this long to exit after their stdin is closed.
+const workerExitTimeout = 5 * time.Second
+
+// ErrNoWorkers is returned when all workers are gone before the image is done.
+var ErrNoWorkers = errors.New("no workers left to render")
+
+// tileJob asks a worker to render the tile of a Width x Height image from a camera.
+type tileJob struct {
+	Width  int
+	Height int
+	Camera int
+	Bounds image.Rectangle
+	Scene  [sha256.Size]byte
+}
+
+// tileResult is a tile rendered by a worker with the hash of its scene.
+type tileResult struct {
+	Scene [sha256.Size]byte
+	Tile  *tileData
+}
+
+// Coordinator hands out tiles to workers and assembles the image they return.
+// Workers is the number of local worker processes started with Command,
+// which must run a worker reading jobs from stdin. With Listen set, remote
+// workers can also connect over TCP at any time during the render.
+type Coordinator struct {
+	Workers int
+	Command []string
+	Listen  string
+}
+
+type workerConn struct {
+	name     string
+	enc      *gob.Encoder
+	dec      *gob.Decoder
+	in       *limitedReader
+	closer   func() error
+	closeOne sync.Once
+}
+
+// limitedReader fails once more than n bytes are read, n is reset for every tile.
+type limitedReader struct {
+	r io.Reader
+	n int
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errors.New("tile too big")
+	}
+	if len(p) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= n
+	return n, err
+}
+
+func newWorkerConn(name string, r io.Reader, w io.Writer, closer func() error) *workerConn {
+	in := &limitedReader{r: r}
+	return &workerConn{
+		name:   name,
+		enc:    gob.NewEncoder(w),
+		dec:    gob.NewDecoder(in),
+		in:     in,
+		closer: closer,
+	}
+}
+
+func (w *workerConn) close() {
+	w.closeOne.Do(func() {
+		if err := w.closer(); err != nil {
+			log.Printf("Closing %s: %s", w.name, err.Error())
+		}
+	})
+}
+
+// render sends the job to the worker and waits for the tile.
+func (w *workerConn) render(job tileJob) (*tileData, error) {
+	if err := w.enc.Encode(&job); err != nil {
+		return nil, err
+	}
+	w.in.n = maxTileMessage
+	tile := tileResult{}
+	if err := w.dec.Decode(&tile); err != nil {
+		return nil, err
+	}
+	if tile.Scene != job.Scene {
+		return nil, errors.New("worker loaded another scene or config")
+	}
+	if tile.Tile == nil {
+		return nil, errors.New("worker sent no tile")
+	}
+	result := tile.Tile
+	if result.Bounds != job.Bounds || result.Width != job.Width || result.Height != job.Height {
+		return nil, fmt.Errorf("got tile %v, asked for %v", result.Bounds, job.Bounds)
+	}
+	if err := result.validate(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func startWorker(command []string, index int) (*workerConn, error) {
+	if len(command) == 0 {
+		return nil, errors.New("no worker command")
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return newWorkerConn(fmt.Sprintf("local worker %d", index), stdout, stdin, func() error {
+		// Closed stdin tells the worker to exit, kill it if it is busy with a tile.
+		_ = stdin.Close()
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+		select {
+		case err := <-exited:
+			return err
+		case <-time.After(workerExitTimeout):
+			_ = cmd.Process.Kill()
+			return <-exited
+		}
+	}), nil
+}
+
+// distributedRender is the state of a coordinator render shared with the worker handlers.
+type distributedRender struct {
+	jobs    chan tileJob
+	results chan *tileData
+	joined  chan string
+	gone    chan string
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	conns   []*workerConn
+}
+
+// serve hands out jobs to the worker until the render stops or the worker fails.
+// Jobs of a failed worker go back to the queue for the others.
+// Workers connecting during the render announce themselves to the collector.
+func (d *distributedRender) serve(conn *workerConn, announce bool) {
+	defer d.wg.Done()
+	defer conn.close()
+	d.mu.Lock()
+	d.conns = append(d.conns, conn)
+	d.mu.Unlock()
+	if announce {
+		select {
+		case d.joined <- conn.name:
+		case <-d.stop:
+			return
+		}
+	}
+
+	for {
+		var job tileJob
+		select {
+		case job = <-d.jobs:
+		case <-d.stop:
+			return
+		}
+		result, err := conn.render(job)
+		if err != nil {
+			d.jobs <- job
+			log.Printf("Dropping %s: %s", conn.name, err.Error())
+			conn.close()
+			select {
+			case d.gone <- conn.name:
+			case <-d.stop:
+			}
+			return
+		}
+		select {
+		case d.results <- result:
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+func (d *distributedRender) accept(listener net.Listener) {
+	defer d.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		c := conn
+		d.wg.Add(1)
+		go d.serve(newWorkerConn(c.RemoteAddr().String(), c, c, c.Close), true)
+	}
+}
+
+// Render the active camera of the scene on the workers and save it to the
+// scene output file, or only the region as a tile file if the output has the
+// .rlt extension. The coordinator doesn't prepare the scene itself.
+// Cancelling ctx saves the tiles received so far and returns the context error.
+func (c *Coordinator) Render(ctx context.Context, r *Renderer, scene *Scene, left, right, top, bottom int, size *string) error {
+	if len(scene.Cameras) == 0 {
+		return ErrNoCamera
+	}
+	width, height, err := getWidthHeight(&r.Config, *size)
+	if err != nil {
+		return err
+	}
+	scene.Width = width
+	scene.Height = height
+	region := renderRegion(width, height, left, right, top, bottom)
+	tiles := makeTiles(region, distributedTileSize, 100)
+
+	d := &distributedRender{
+		jobs:    make(chan tileJob, len(tiles)),
+		results: make(chan *tileData),
+		joined:  make(chan string),
+		gone:    make(chan string),
+		stop:    make(chan struct{}),
+	}
+	hash := scene.sourceHash(r.Config)
+	for i := range tiles {
+		d.jobs <- tileJob{Width: width, Height: height, Camera: scene.ActiveCamera, Bounds: tiles[i].bounds, Scene: hash}
+	}
+
+	var listener net.Listener
+	if c.Listen != "" {
+		listener, err = net.Listen("tcp", c.Listen)
+		if err != nil {
+			return err
+		}
+		log.Printf("Waiting for workers on %s", listener.Addr().String())
+		d.wg.Add(1)
+		go d.accept(listener)
+	}
+	started := 0
+	for i := 0; i < c.Workers; i++ {
+		conn, err := startWorker(c.Command, i)
+		if err != nil {
+			log.Printf("Error starting worker: %s", err.Error())
+			continue
+		}
+		started++
+		d.wg.Add(1)
+		go d.serve(conn, false)
+	}
+
+	output := &tileData{Width: width, Height: height, Bounds: region, Pixels: make([]float32, region.Dx()*region.Dy()*4)}
+	err = d.collect(ctx, output, len(tiles), started, c.Listen != "")
+
+	close(d.stop)
+	if listener != nil {
+		_ = listener.Close()
+	}
+	d.mu.Lock()
+	for _, conn := range d.conns {
+		conn.close()
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+
+	var saveErr error
+	if isTileFile(scene.OutputFilename) {
+		saveErr = saveTile(scene.OutputFilename, output)
+	} else {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		output.draw(img)
+		saveErr = saveImage(scene.OutputFilename, img)
+	}
+	if saveErr != nil {
+		return saveErr
+	}
+	return err
+}
+
+// collect pastes the tiles into output until all tiles are in, the render is
+// cancelled, or no workers are left and none can connect.
+func (d *distributedRender) collect(ctx context.Context, output *tileData, total, workers int, listening bool) error {
+	if workers == 0 && !listening {
+		return ErrNoWorkers
+	}
+	bar := pb.StartNew(total)
+	defer bar.Finish()
+	for received := 0; received < total; {
+		select {
+		case t := <-d.results:
+			output.paste(t)
+			received++
+			bar.Increment()
+		case name := <-d.joined:
+			workers++
+			log.Printf("Worker %s joined", name)
+		case name := <-d.gone:
+			workers--
+			log.Printf("Worker %s is gone", name)
+			if workers == 0 && !listening {
+				return ErrNoWorkers
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// ServeWorker renders the tiles a coordinator sends over conn and writes them
+// back to w, until the coordinator closes the connection.
+// The scene is prepared with the size of the first job.
+func (r *Renderer) ServeWorker(ctx context.Context, scene *Scene, conn io.Reader, w io.Writer) error {
+	dec := gob.NewDecoder(conn)
+	enc := gob.NewEncoder(w)
+	// Preparing changes the scene, hash it as it is loaded like the coordinator.
+	hash := scene.sourceHash(r.Config)
+	prepared := false
+	for {
+		job := tileJob{}
+		if err := dec.Decode(&job); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if job.Scene != hash {
+			return errors.New("coordinator renders another scene or config")
+		}
+		if job.Camera < 0 || job.Camera >= len(scene.Cameras) {
+			return fmt.Errorf("%w: %d", ErrCameraNotFound, job.Camera)
+		}
+		if !prepared {
+			r.prepare(scene, job.Width, job.Height)
+		} else if job.Width != scene.Width || job.Height != scene.Height {
+			return fmt.Errorf("job for a %dx%d image, worker prepared %dx%d", job.Width, job.Height, scene.Width, scene.Height)
+		}
+		if !job.Bounds.In(image.Rect(0, 0, job.Width, job.Height)) {
+			return fmt.Errorf("tile %v outside of the image", job.Bounds)
+		}
+		if !prepared || job.Camera != scene.ActiveCamera {
+			scene.ActiveCamera = job.Camera
+			scene.prepareMatrices()
+			scene.allocatePixels()
+			prepared = true
+		}
+
+		tiles := makeTiles(job.Bounds, r.Config.TileSize, 100)
+		if err := scene.scanPixels(ctx, tiles); err != nil {
+			return err
+		}
+		err := renderTiles(ctx, r.renderThreads(), tiles, func(x, y int) {
+			renderPixel(scene, x, y)
+			adaptiveSample(scene, x, y)
+		})
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(&tileResult{Scene: hash, Tile: tileFromPixels(scene, job.Bounds)}); err != nil {
+			return err
+		}
+	}
+}
+
+// sourceHash of the scene as it is loaded and the config that changes the
+// image, the coordinator doesn't prepare the scene.
+func (s *Scene) sourceHash(config Config) [sha256.Size]byte {
+	config = imageConfig(config)
+	h := sha256.New()
+	e := json.NewEncoder(h)
+	_ = e.Encode(&config)
+	_ = e.Encode(s.Objects)
+	_ = e.Encode(s.Meshes)
+	_ = e.Encode(s.Primitives)
+	_ = e.Encode(s.Lights)
+	_ = e.Encode(s.Cameras)
+	result := [sha256.Size]byte{}
+	copy(result[:], h.Sum(nil))
+	return result
+}
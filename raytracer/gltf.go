@@ -0,0 +1,849 @@
+package raytracer
+
+/*
+glTF 2.0 importer for .gltf files with external or embedded buffers and
+binary .glb files.
+Nodes become objects keeping the hierarchy and their matrices, every root node
+is turned from the Y up glTF axes to the Z up scene axes. Triangle primitives
+of a node mesh share one object, with one material per glTF material.
+Cameras and KHR_lights_punctual lights are placed at their world transforms.
+Images inside the file are decoded while loading, external images are loaded
+as textures relative to the glTF file like in any other scene.
+*/
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ErrUnsupportedGLTF is returned for glTF content raylar can't render.
+var ErrUnsupportedGLTF = errors.New("unsupported glTF")
+
+const (
+	glbMagic     = 0x46546C67 // glTF
+	glbChunkJSON = 0x4E4F534A // JSON
+	glbChunkBIN  = 0x004E4942 // BIN
+)
+
+// Watts of a Blender light per candela of the glTF point light, the Blender
+// glTF exporter divides by this.
+const gltfWattsPerCandela = 4 * math.Pi / 683
+
+// yUpMatrix turns Y up axes into Z up, see yUpToZUp.
+var yUpMatrix = Matrix{
+	Vector{1, 0, 0, 0},
+	Vector{0, 0, 1, 0},
+	Vector{0, -1, 0, 0},
+	Vector{0, 0, 0, 1},
+}
+
+type gltfFile struct {
+	Scene       *int             `json:"scene"`
+	Scenes      []gltfScene      `json:"scenes"`
+	Nodes       []gltfNode       `json:"nodes"`
+	Meshes      []gltfMesh       `json:"meshes"`
+	Materials   []gltfMaterial   `json:"materials"`
+	Textures    []gltfTexture    `json:"textures"`
+	Images      []gltfImage      `json:"images"`
+	Accessors   []gltfAccessor   `json:"accessors"`
+	BufferViews []gltfBufferView `json:"bufferViews"`
+	Buffers     []gltfBuffer     `json:"buffers"`
+	Cameras     []gltfCamera     `json:"cameras"`
+	Extensions  struct {
+		Lights struct {
+			Lights []gltfLight `json:"lights"`
+		} `json:"KHR_lights_punctual"`
+	} `json:"extensions"`
+}
+
+type gltfScene struct {
+	Nodes []int `json:"nodes"`
+}
+
+type gltfNode struct {
+	Name        string    `json:"name"`
+	Children    []int     `json:"children"`
+	Mesh        *int      `json:"mesh"`
+	Camera      *int      `json:"camera"`
+	Matrix      []float64 `json:"matrix"`
+	Translation []float64 `json:"translation"`
+	Rotation    []float64 `json:"rotation"`
+	Scale       []float64 `json:"scale"`
+	Extensions  struct {
+		Light *struct {
+			Light int `json:"light"`
+		} `json:"KHR_lights_punctual"`
+	} `json:"extensions"`
+}
+
+type gltfMesh struct {
+	Name       string          `json:"name"`
+	Primitives []gltfPrimitive `json:"primitives"`
+}
+
+type gltfPrimitive struct {
+	Attributes map[string]int `json:"attributes"`
+	Indices    *int           `json:"indices"`
+	Material   *int           `json:"material"`
+	Mode       *int           `json:"mode"`
+}
+
+type gltfTextureInfo struct {
+	Index int `json:"index"`
+}
+
+type gltfMaterial struct {
+	Name string `json:"name"`
+	PBR  struct {
+		BaseColorFactor  []float64        `json:"baseColorFactor"`
+		BaseColorTexture *gltfTextureInfo `json:"baseColorTexture"`
+		MetallicFactor   *float64         `json:"metallicFactor"`
+		RoughnessFactor  *float64         `json:"roughnessFactor"`
+	} `json:"pbrMetallicRoughness"`
+	NormalTexture  *gltfTextureInfo `json:"normalTexture"`
+	EmissiveFactor []float64        `json:"emissiveFactor"`
+	Extensions     struct {
+		EmissiveStrength *struct {
+			EmissiveStrength float64 `json:"emissiveStrength"`
+		} `json:"KHR_materials_emissive_strength"`
+		Transmission *struct {
+			TransmissionFactor float64 `json:"transmissionFactor"`
+		} `json:"KHR_materials_transmission"`
+		IOR *struct {
+			IOR *float64 `json:"ior"`
+		} `json:"KHR_materials_ior"`
+	} `json:"extensions"`
+}
+
+type gltfTexture struct {
+	Source *int `json:"source"`
+}
+
+type gltfImage struct {
+	URI        string `json:"uri"`
+	BufferView *int   `json:"bufferView"`
+}
+
+type gltfAccessor struct {
+	BufferView    *int   `json:"bufferView"`
+	ByteOffset    int    `json:"byteOffset"`
+	ComponentType int    `json:"componentType"`
+	Normalized    bool   `json:"normalized"`
+	Count         int    `json:"count"`
+	Type          string `json:"type"`
+	Sparse        *struct {
+		Count int `json:"count"`
+	} `json:"sparse"`
+}
+
+type gltfBufferView struct {
+	Buffer     int `json:"buffer"`
+	ByteOffset int `json:"byteOffset"`
+	ByteLength int `json:"byteLength"`
+	ByteStride int `json:"byteStride"`
+}
+
+type gltfBuffer struct {
+	URI        string `json:"uri"`
+	ByteLength int    `json:"byteLength"`
+}
+
+type gltfCamera struct {
+	Type        string `json:"type"`
+	Perspective struct {
+		YFov  float64 `json:"yfov"`
+		ZNear float64 `json:"znear"`
+		ZFar  float64 `json:"zfar"`
+	} `json:"perspective"`
+	Orthographic struct {
+		XMag  float64 `json:"xmag"`
+		YMag  float64 `json:"ymag"`
+		ZNear float64 `json:"znear"`
+		ZFar  float64 `json:"zfar"`
+	} `json:"orthographic"`
+}
+
+type gltfLight struct {
+	Type      string    `json:"type"`
+	Color     []float64 `json:"color"`
+	Intensity *float64  `json:"intensity"`
+	Spot      *struct {
+		InnerConeAngle float64  `json:"innerConeAngle"`
+		OuterConeAngle *float64 `json:"outerConeAngle"`
+	} `json:"spot"`
+}
+
+type gltfReader struct {
+	gltfFile
+	files    fs.FS
+	dir      string
+	buffers  [][]byte
+	images   map[int][][]Vector
+	bumpMaps map[int][][]Vector
+	scene    *Scene
+}
+
+// LoadGLTF scene from a .gltf or .glb file with its objects, materials,
+// cameras and lights. Buffers and textures are relative to the file in files.
+func LoadGLTF(files fs.FS, name string) (*Scene, error) {
+	s := &Scene{files: files}
+	if err := s.loadGLTF(files, name); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func isGLTF(filename string) bool {
+	ext := strings.ToLower(path.Ext(filename))
+	return ext == ".gltf" || ext == ".glb"
+}
+
+// loadGLTFMesh only keeps the objects, for mesh references.
+func loadGLTFMesh(files fs.FS, name string) (map[string]*Object, error) {
+	s := &Scene{}
+	if err := s.loadGLTF(files, name); err != nil {
+		return nil, err
+	}
+	return s.Objects, nil
+}
+
+func (s *Scene) loadGLTF(files fs.FS, name string) error {
+	f, err := files.Open(name)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	r := &gltfReader{
+		files:    files,
+		dir:      path.Dir(name),
+		images:   make(map[int][][]Vector),
+		bumpMaps: make(map[int][][]Vector),
+		scene:    s,
+	}
+	var bin []byte
+	if len(data) >= 4 && binary.LittleEndian.Uint32(data) == glbMagic {
+		data, bin, err = readGLB(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if err := json.Unmarshal(data, &r.gltfFile); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if err := r.loadBuffers(bin); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if s.Objects == nil {
+		s.Objects = make(map[string]*Object)
+	}
+	for _, node := range r.rootNodes() {
+		obj, err := r.node(node, yUpMatrix, s.Objects)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		obj.Matrix = multiplyMatrix(obj.Matrix, yUpMatrix)
+	}
+	log.Printf("Loaded glTF %s with %d cameras and %d lights", name, len(s.Cameras), len(s.Lights))
+	return nil
+}
+
+// readGLB splits a binary glTF file into its JSON and binary chunks.
+func readGLB(data []byte) (jsonChunk, bin []byte, err error) {
+	if len(data) < 12 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	if version := binary.LittleEndian.Uint32(data[4:]); version != 2 {
+		return nil, nil, fmt.Errorf("%w: glb version %d", ErrUnsupportedGLTF, version)
+	}
+	for offset := 12; offset+8 <= len(data); {
+		length := int(binary.LittleEndian.Uint32(data[offset:]))
+		chunkType := binary.LittleEndian.Uint32(data[offset+4:])
+		start := offset + 8
+		if length < 0 || start+length > len(data) {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		switch chunkType {
+		case glbChunkJSON:
+			jsonChunk = data[start : start+length]
+		case glbChunkBIN:
+			bin = data[start : start+length]
+		}
+		offset = start + length
+	}
+	if jsonChunk == nil {
+		return nil, nil, errors.New("glb without JSON chunk")
+	}
+	return jsonChunk, bin, nil
+}
+
+func (r *gltfReader) loadBuffers(bin []byte) error {
+	r.buffers = make([][]byte, len(r.Buffers))
+	for i, buffer := range r.Buffers {
+		if buffer.URI == "" {
+			if i != 0 || bin == nil {
+				return fmt.Errorf("buffer %d without data", i)
+			}
+			r.buffers[i] = bin
+			continue
+		}
+		data, err := r.readURI(buffer.URI)
+		if err != nil {
+			return err
+		}
+		if len(data) < buffer.ByteLength {
+			return fmt.Errorf("buffer %d has %d bytes, expected %d", i, len(data), buffer.ByteLength)
+		}
+		r.buffers[i] = data
+	}
+	return nil
+}
+
+// readURI reads a data URI or a file relative to the glTF file.
+func (r *gltfReader) readURI(uri string) ([]byte, error) {
+	if strings.HasPrefix(uri, "data:") {
+		comma := strings.IndexByte(uri, ',')
+		if comma < 0 {
+			return nil, errors.New("malformed data uri")
+		}
+		if strings.HasSuffix(uri[:comma], ";base64") {
+			return base64.StdEncoding.DecodeString(uri[comma+1:])
+		}
+		data, err := url.PathUnescape(uri[comma+1:])
+		return []byte(data), err
+	}
+	f, err := r.files.Open(r.filePath(uri))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// filePath of a relative uri in the glTF file.
+func (r *gltfReader) filePath(uri string) string {
+	if unescaped, err := url.PathUnescape(uri); err == nil {
+		uri = unescaped
+	}
+	return path.Join(r.dir, uri)
+}
+
+// rootNodes of the default scene, or the nodes no other node has as child.
+func (r *gltfReader) rootNodes() []int {
+	if len(r.Scenes) > 0 {
+		scene := 0
+		if r.Scene != nil && *r.Scene >= 0 && *r.Scene < len(r.Scenes) {
+			scene = *r.Scene
+		}
+		return r.Scenes[scene].Nodes
+	}
+	child := make([]bool, len(r.Nodes))
+	for _, node := range r.Nodes {
+		for _, c := range node.Children {
+			if c >= 0 && c < len(child) {
+				child[c] = true
+			}
+		}
+	}
+	var roots []int
+	for i := range r.Nodes {
+		if !child[i] {
+			roots = append(roots, i)
+		}
+	}
+	return roots
+}
+
+// node becomes an object in objects with its children, cameras and lights of
+// the node are added to the scene. parent is the world matrix of the parent node.
+func (r *gltfReader) node(index int, parent Matrix, objects map[string]*Object) (*Object, error) {
+	if index < 0 || index >= len(r.Nodes) {
+		return nil, fmt.Errorf("node %d out of range", index)
+	}
+	node := &r.Nodes[index]
+	obj := NewObject()
+	obj.Matrix = node.matrix()
+	world := multiplyMatrix(obj.Matrix, parent)
+
+	name := node.Name
+	if name == "" {
+		name = fmt.Sprintf("node%d", index)
+	}
+	if _, ok := objects[name]; ok {
+		name = fmt.Sprintf("%s.%d", name, index)
+	}
+	objects[name] = obj
+
+	if node.Mesh != nil {
+		if err := r.mesh(*node.Mesh, obj); err != nil {
+			return nil, err
+		}
+	}
+	if node.Camera != nil {
+		if err := r.camera(*node.Camera, node.Name, world); err != nil {
+			return nil, err
+		}
+	}
+	if node.Extensions.Light != nil {
+		if err := r.light(node.Extensions.Light.Light, world); err != nil {
+			return nil, err
+		}
+	}
+	if len(node.Children) > 0 {
+		obj.Children = make(map[string]*Object)
+	}
+	for _, child := range node.Children {
+		if _, err := r.node(child, world, obj.Children); err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
+// matrix of the node, in the row vector order of the scene matrices.
+func (n *gltfNode) matrix() Matrix {
+	if len(n.Matrix) == 16 {
+		// Column major matrix of column vectors is our row vector matrix row by row.
+		var m Matrix
+		for i := 0; i < 16; i++ {
+			m[i/4][i%4] = n.Matrix[i]
+		}
+		return m
+	}
+	m := identityHmgMatrix
+	if len(n.Scale) == 3 {
+		m[0][0], m[1][1], m[2][2] = n.Scale[0], n.Scale[1], n.Scale[2]
+	}
+	if len(n.Rotation) == 4 {
+		x, y, z, w := n.Rotation[0], n.Rotation[1], n.Rotation[2], n.Rotation[3]
+		rotation := Matrix{
+			Vector{1 - 2*(y*y+z*z), 2 * (x*y + z*w), 2 * (x*z - y*w), 0},
+			Vector{2 * (x*y - z*w), 1 - 2*(x*x+z*z), 2 * (y*z + x*w), 0},
+			Vector{2 * (x*z + y*w), 2 * (y*z - x*w), 1 - 2*(x*x+y*y), 0},
+			Vector{0, 0, 0, 1},
+		}
+		m = multiplyMatrix(m, rotation)
+	}
+	if len(n.Translation) == 3 {
+		m[3][0], m[3][1], m[3][2] = n.Translation[0], n.Translation[1], n.Translation[2]
+	}
+	return m
+}
+
+// mesh primitives of a glTF mesh added to the object.
+func (r *gltfReader) mesh(index int, obj *Object) error {
+	if index < 0 || index >= len(r.Meshes) {
+		return fmt.Errorf("mesh %d out of range", index)
+	}
+	for i, primitive := range r.Meshes[index].Primitives {
+		if err := r.primitive(&primitive, obj); err != nil {
+			return fmt.Errorf("mesh %d primitive %d: %w", index, i, err)
+		}
+	}
+	return nil
+}
+
+func (r *gltfReader) primitive(p *gltfPrimitive, obj *Object) error {
+	if p.Mode != nil && *p.Mode != 4 {
+		log.Printf("Skipping glTF primitive with mode %d, only triangles are rendered", *p.Mode)
+		return nil
+	}
+	positionAccessor, ok := p.Attributes["POSITION"]
+	if !ok {
+		return errors.New("primitive without positions")
+	}
+	positions, err := r.accessor(positionAccessor, 3)
+	if err != nil {
+		return err
+	}
+	count := len(positions) / 3
+	var normals, texCoords []float64
+	if a, ok := p.Attributes["NORMAL"]; ok {
+		if normals, err = r.accessor(a, 3); err != nil {
+			return err
+		}
+	}
+	if a, ok := p.Attributes["TEXCOORD_0"]; ok {
+		if texCoords, err = r.accessor(a, 2); err != nil {
+			return err
+		}
+	}
+	var indices []float64
+	if p.Indices != nil {
+		if indices, err = r.accessor(*p.Indices, 1); err != nil {
+			return err
+		}
+	} else {
+		indices = make([]float64, count)
+		for i := range indices {
+			indices[i] = float64(i)
+		}
+	}
+	if len(normals) != 0 && len(normals) != count*3 || len(texCoords) != 0 && len(texCoords) != count*2 {
+		return errors.New("attributes with different counts")
+	}
+
+	materialName, err := r.material(p.Material, obj)
+	if err != nil {
+		return err
+	}
+	mat := obj.Materials[materialName]
+	vertex := func(i int, normal Vector) {
+		position := Vector{positions[i*3], positions[i*3+1], positions[i*3+2], 1}
+		if normals != nil {
+			normal = Vector{normals[i*3], normals[i*3+1], normals[i*3+2], 0}
+		}
+		texCoord := Vector{}
+		if texCoords != nil {
+			// glTF images start at the top, our texture coordinates at the bottom.
+			texCoord = Vector{texCoords[i*2], 1 - texCoords[i*2+1], 0, 0}
+		}
+		obj.AddVertex(position, normal, texCoord)
+	}
+
+	base := int64(len(obj.Vertices))
+	if normals != nil {
+		for i := 0; i < count; i++ {
+			vertex(i, Vector{})
+		}
+	}
+	for i := 0; i+2 < len(indices); i += 3 {
+		a, b, c := int(indices[i]), int(indices[i+1]), int(indices[i+2])
+		if a >= count || b >= count || c >= count {
+			return fmt.Errorf("index out of %d vertices", count)
+		}
+		if normals != nil {
+			mat.Indices = append(mat.Indices, indice{base + int64(a), base + int64(b), base + int64(c), 1})
+			continue
+		}
+		// Flat shaded without normals, each face gets its own vertices.
+		p1 := Vector{positions[a*3], positions[a*3+1], positions[a*3+2], 0}
+		p2 := Vector{positions[b*3], positions[b*3+1], positions[b*3+2], 0}
+		p3 := Vector{positions[c*3], positions[c*3+1], positions[c*3+2], 0}
+		normal := normalizeVector(crossProduct(subVector(p2, p1), subVector(p3, p1)))
+		normal[3] = 0
+		first := int64(len(obj.Vertices))
+		vertex(a, normal)
+		vertex(b, normal)
+		vertex(c, normal)
+		mat.Indices = append(mat.Indices, indice{first, first + 1, first + 2, 0})
+	}
+	obj.Materials[materialName] = mat
+	return nil
+}
+
+// accessor values as floats, components is the expected number per element.
+func (r *gltfReader) accessor(index, components int) ([]float64, error) {
+	if index < 0 || index >= len(r.Accessors) {
+		return nil, fmt.Errorf("accessor %d out of range", index)
+	}
+	a := &r.Accessors[index]
+	if a.Sparse != nil {
+		return nil, fmt.Errorf("%w: sparse accessor %d", ErrUnsupportedGLTF, index)
+	}
+	typeComponents := map[string]int{"SCALAR": 1, "VEC2": 2, "VEC3": 3, "VEC4": 4}[a.Type]
+	if typeComponents != components {
+		return nil, fmt.Errorf("accessor %d is %s, expected %d components", index, a.Type, components)
+	}
+	size := map[int]int{5120: 1, 5121: 1, 5122: 2, 5123: 2, 5125: 4, 5126: 4}[a.ComponentType]
+	if size == 0 {
+		return nil, fmt.Errorf("accessor %d has component type %d", index, a.ComponentType)
+	}
+	result := make([]float64, a.Count*components)
+	if a.BufferView == nil {
+		// Accessors without a buffer view are all zeros.
+		return result, nil
+	}
+	if *a.BufferView < 0 || *a.BufferView >= len(r.BufferViews) {
+		return nil, fmt.Errorf("buffer view %d out of range", *a.BufferView)
+	}
+	view := &r.BufferViews[*a.BufferView]
+	if view.Buffer < 0 || view.Buffer >= len(r.buffers) {
+		return nil, fmt.Errorf("buffer %d out of range", view.Buffer)
+	}
+	stride := view.ByteStride
+	if stride == 0 {
+		stride = size * components
+	}
+	data := r.buffers[view.Buffer]
+	if view.ByteOffset+view.ByteLength > len(data) {
+		return nil, fmt.Errorf("buffer view %d outside of buffer %d", *a.BufferView, view.Buffer)
+	}
+	data = data[view.ByteOffset : view.ByteOffset+view.ByteLength]
+	if a.Count > 0 && a.ByteOffset+(a.Count-1)*stride+size*components > len(data) {
+		return nil, fmt.Errorf("accessor %d outside of buffer view %d", index, *a.BufferView)
+	}
+	for i := 0; i < a.Count; i++ {
+		for j := 0; j < components; j++ {
+			b := data[a.ByteOffset+i*stride+j*size:]
+			result[i*components+j] = gltfComponent(b, a.ComponentType, a.Normalized)
+		}
+	}
+	return result, nil
+}
+
+func gltfComponent(b []byte, componentType int, normalized bool) float64 {
+	switch componentType {
+	case 5120:
+		v := float64(int8(b[0]))
+		if normalized {
+			return math.Max(v/127, -1)
+		}
+		return v
+	case 5121:
+		v := float64(b[0])
+		if normalized {
+			return v / 255
+		}
+		return v
+	case 5122:
+		v := float64(int16(binary.LittleEndian.Uint16(b)))
+		if normalized {
+			return math.Max(v/32767, -1)
+		}
+		return v
+	case 5123:
+		v := float64(binary.LittleEndian.Uint16(b))
+		if normalized {
+			return v / 65535
+		}
+		return v
+	case 5125:
+		return float64(binary.LittleEndian.Uint32(b))
+	default:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	}
+}
+
+// material of a primitive added to the object, returns its name in the object.
+// Smooth metallic surfaces reflect, glossiness is metallic * (1 - roughness)
+// with the glTF defaults of 1 for both, so unset factors don't make mirrors.
+func (r *gltfReader) material(index *int, obj *Object) (string, error) {
+	if index == nil {
+		if _, ok := obj.Materials[objDefaultMaterial]; !ok {
+			obj.Materials[objDefaultMaterial] = Material{Color: Vector{1, 1, 1, 1}}
+		}
+		return objDefaultMaterial, nil
+	}
+	if *index < 0 || *index >= len(r.Materials) {
+		return "", fmt.Errorf("material %d out of range", *index)
+	}
+	m := &r.Materials[*index]
+	name := m.Name
+	if name == "" {
+		name = fmt.Sprintf("material%d", *index)
+	}
+	if _, ok := obj.Materials[name]; ok {
+		return name, nil
+	}
+
+	mat := Material{
+		Color:             Vector{1, 1, 1, 1},
+		Roughness:         1,
+		IndexOfRefraction: 1.5,
+	}
+	if len(m.PBR.BaseColorFactor) == 4 {
+		copy(mat.Color[:], m.PBR.BaseColorFactor)
+	}
+	metallic := 1.0
+	if m.PBR.MetallicFactor != nil {
+		metallic = *m.PBR.MetallicFactor
+	}
+	if m.PBR.RoughnessFactor != nil {
+		mat.Roughness = *m.PBR.RoughnessFactor
+	}
+	mat.Glossiness = metallic * (1 - mat.Roughness)
+	if m.Extensions.Transmission != nil {
+		mat.Transmission = m.Extensions.Transmission.TransmissionFactor
+	}
+	if m.Extensions.IOR != nil && m.Extensions.IOR.IOR != nil {
+		mat.IndexOfRefraction = *m.Extensions.IOR.IOR
+	}
+	if len(m.EmissiveFactor) == 3 {
+		strength := math.Max(m.EmissiveFactor[0], math.Max(m.EmissiveFactor[1], m.EmissiveFactor[2]))
+		if strength > 0 {
+			mat.Light = true
+			mat.EmissionColor = Vector{m.EmissiveFactor[0] / strength, m.EmissiveFactor[1] / strength, m.EmissiveFactor[2] / strength, 1}
+			if m.Extensions.EmissiveStrength != nil {
+				strength *= m.Extensions.EmissiveStrength.EmissiveStrength
+			}
+			mat.LightStrength = strength
+		}
+	}
+	if m.PBR.BaseColorTexture != nil {
+		var err error
+		mat.Texture, mat.image, err = r.texture(m.PBR.BaseColorTexture.Index, false)
+		if err != nil {
+			return "", err
+		}
+	}
+	if m.NormalTexture != nil {
+		var err error
+		mat.BumpMap, mat.bumpMap, err = r.texture(m.NormalTexture.Index, true)
+		if err != nil {
+			return "", err
+		}
+	}
+	obj.Materials[name] = mat
+	return name, nil
+}
+
+// texture file of an external image, or the decoded image of an embedded one.
+func (r *gltfReader) texture(index int, bump bool) (string, [][]Vector, error) {
+	if index < 0 || index >= len(r.Textures) || r.Textures[index].Source == nil {
+		return "", nil, fmt.Errorf("texture %d without image", index)
+	}
+	source := *r.Textures[index].Source
+	if source < 0 || source >= len(r.Images) {
+		return "", nil, fmt.Errorf("image %d out of range", source)
+	}
+	img := &r.Images[source]
+	if img.URI != "" && !strings.HasPrefix(img.URI, "data:") {
+		return r.filePath(img.URI), nil, nil
+	}
+
+	cache := r.images
+	if bump {
+		cache = r.bumpMaps
+	}
+	if decoded, ok := cache[source]; ok {
+		return "", decoded, nil
+	}
+	var data []byte
+	var err error
+	if img.URI != "" {
+		data, err = r.readURI(img.URI)
+	} else if img.BufferView != nil {
+		data, err = r.bufferView(*img.BufferView)
+	} else {
+		err = fmt.Errorf("image %d without data", source)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, fmt.Errorf("image %d: %w", source, err)
+	}
+	decoded := imageToVectors(src)
+	if bump {
+		decoded = bumpNormals(decoded)
+	}
+	cache[source] = decoded
+	return "", decoded, nil
+}
+
+func (r *gltfReader) bufferView(index int) ([]byte, error) {
+	if index < 0 || index >= len(r.BufferViews) {
+		return nil, fmt.Errorf("buffer view %d out of range", index)
+	}
+	view := &r.BufferViews[index]
+	if view.Buffer < 0 || view.Buffer >= len(r.buffers) || view.ByteOffset+view.ByteLength > len(r.buffers[view.Buffer]) {
+		return nil, fmt.Errorf("buffer view %d outside of its buffer", index)
+	}
+	return r.buffers[view.Buffer][view.ByteOffset : view.ByteOffset+view.ByteLength], nil
+}
+
+// camera at the world transform of its node, glTF cameras look down -Z with Y up.
+func (r *gltfReader) camera(index int, name string, world Matrix) error {
+	if index < 0 || index >= len(r.Cameras) {
+		return fmt.Errorf("camera %d out of range", index)
+	}
+	c := &r.Cameras[index]
+	position := vectorTransform(Vector{0, 0, 0, 1}, world)
+	forward := normalizeVector(vectorTransform(Vector{0, 0, -1, 0}, world))
+	up := normalizeVector(vectorTransform(Vector{0, 1, 0, 0}, world))
+	target := combine(position, forward, 1, 10)
+	target[3] = 1
+	up[3] = 0
+	camera := Camera{
+		Name:     name,
+		Position: position,
+		Target:   target,
+		Up:       up,
+	}
+	switch c.Type {
+	case "orthographic":
+		// Zoom is the extent of the longer side, like the image of the camera.
+		camera.Zoom = 2 * math.Max(c.Orthographic.XMag, c.Orthographic.YMag)
+		if c.Orthographic.YMag > 0 {
+			camera.AspectRatio = c.Orthographic.XMag / c.Orthographic.YMag
+		}
+		camera.Near = c.Orthographic.ZNear
+		camera.Far = c.Orthographic.ZFar
+	default:
+		camera.Perspective = true
+		camera.Fov = c.Perspective.YFov * 180 / math.Pi
+		camera.Near = c.Perspective.ZNear
+		camera.Far = c.Perspective.ZFar
+		if camera.Far == 0 {
+			// Infinite projection, far enough for any scene.
+			camera.Far = 1e6
+		}
+	}
+	r.scene.Cameras = append(r.scene.Cameras, camera)
+	return nil
+}
+
+// light at the world transform of its node, directional and spot lights shine down -Z.
+// Intensities are turned into Blender watts, scaled like the Blender exporter does.
+func (r *gltfReader) light(index int, world Matrix) error {
+	lights := r.Extensions.Lights.Lights
+	if index < 0 || index >= len(lights) {
+		return fmt.Errorf("light %d out of range", index)
+	}
+	l := &lights[index]
+	intensity := 1.0
+	if l.Intensity != nil {
+		intensity = *l.Intensity
+	}
+	light := Light{
+		Position: vectorTransform(Vector{0, 0, 0, 1}, world),
+		Color:    Vector{1, 1, 1, 1},
+		Active:   true,
+	}
+	if len(l.Color) == 3 {
+		light.Color = Vector{l.Color[0], l.Color[1], l.Color[2], 1}
+	}
+	switch l.Type {
+	case "directional":
+		light.Directional = true
+		light.Direction = normalizeVector(vectorTransform(Vector{0, 0, -1, 0}, world))
+		light.Direction[3] = 0
+		light.LightStrength = intensity / 10
+	case "spot":
+		// glTF cone angles are half angles in radians, 0 and Pi/4 by default.
+		light.Spot = true
+		light.Direction = normalizeVector(vectorTransform(Vector{0, 0, -1, 0}, world))
+		light.Direction[3] = 0
+		light.OuterAngle = 90
+		if l.Spot != nil {
+			light.InnerAngle = l.Spot.InnerConeAngle * 360 / math.Pi
+			if l.Spot.OuterConeAngle != nil {
+				light.OuterAngle = *l.Spot.OuterConeAngle * 360 / math.Pi
+			}
+		}
+		light.LightStrength = intensity * gltfWattsPerCandela / 10
+	default:
+		light.LightStrength = intensity * gltfWattsPerCandela / 10
+	}
+	r.scene.Lights = append(r.scene.Lights, light)
+	return nil
+}
@@ -0,0 +1,214 @@
+package raytracer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// gltfTriangleBuffer with the positions, normals and indices of one triangle,
+// the last index is out of range.
+func gltfTriangleBuffer() []byte {
+	var buf bytes.Buffer
+	for _, v := range []float32{0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 1, 0, 0, 1} {
+		_ = binary.Write(&buf, binary.LittleEndian, v)
+	}
+	_ = binary.Write(&buf, binary.LittleEndian, []uint16{0, 1, 2, 3})
+	return buf.Bytes()
+}
+
+// gltfDocument with the triangle mesh in node "tri" with the primitive, a
+// camera and a light. buffer is the buffers entry.
+func gltfDocument(buffer, primitive string) string {
+	return fmt.Sprintf(`{
+	"asset": {"version": "2.0"},
+	"scenes": [{"nodes": [0, 1, 2]}],
+	"nodes": [
+		{"name": "tri", "mesh": 0, "translation": [0, 0, 5]},
+		{"name": "view", "camera": 0},
+		{"name": "sun", "extensions": {"KHR_lights_punctual": {"light": 0}}}
+	],
+	"meshes": [{"primitives": [%s]}],
+	"accessors": [
+		{"bufferView": 0, "componentType": 5126, "count": 3, "type": "VEC3"},
+		{"bufferView": 1, "componentType": 5126, "count": 3, "type": "VEC3"},
+		{"bufferView": 2, "componentType": 5123, "count": 3, "type": "SCALAR"},
+		{"bufferView": 2, "componentType": 5123, "count": 2, "type": "VEC2"},
+		{"bufferView": 2, "byteOffset": 2, "componentType": 5123, "count": 3, "type": "SCALAR"}
+	],
+	"bufferViews": [
+		{"buffer": 0, "byteOffset": 0, "byteLength": 36},
+		{"buffer": 0, "byteOffset": 36, "byteLength": 36},
+		{"buffer": 0, "byteOffset": 72, "byteLength": 8}
+	],
+	"buffers": [%s]%s
+}`, primitive, buffer, gltfSceneExtras)
+}
+
+func gltfDataBuffer() string {
+	data := gltfTriangleBuffer()
+	return fmt.Sprintf(`{"byteLength": %d, "uri": "data:application/octet-stream;base64,%s"}`,
+		len(data), base64.StdEncoding.EncodeToString(data))
+}
+
+// glb file of the JSON and binary chunks.
+func glb(version uint32, document string, bin []byte) []byte {
+	for len(document)%4 != 0 {
+		document += " "
+	}
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, []uint32{glbMagic, version, uint32(12 + 8 + len(document) + 8 + len(bin))})
+	_ = binary.Write(&buf, binary.LittleEndian, []uint32{uint32(len(document)), glbChunkJSON})
+	buf.WriteString(document)
+	_ = binary.Write(&buf, binary.LittleEndian, []uint32{uint32(len(bin)), glbChunkBIN})
+	buf.Write(bin)
+	return buf.Bytes()
+}
+
+const gltfPrimitiveFlat = `{"attributes": {"POSITION": 0}, "material": 0}`
+
+const gltfSceneExtras = `,
+	"materials": [
+		{"name": "plain"},
+		{"name": "metal", "pbrMetallicRoughness": {"baseColorFactor": [1, 0.5, 0.5, 1], "metallicFactor": 1, "roughnessFactor": 0.2}},
+		{"name": "plastic", "pbrMetallicRoughness": {"metallicFactor": 0, "roughnessFactor": 0}},
+		{"name": "lamp", "pbrMetallicRoughness": {"baseColorFactor": [0.2, 0.2, 0.2, 1]}, "emissiveFactor": [2, 1, 0],
+			"extensions": {"KHR_materials_emissive_strength": {"emissiveStrength": 3}}},
+		{"name": "glass", "extensions": {"KHR_materials_transmission": {"transmissionFactor": 0.9}, "KHR_materials_ior": {"ior": 1.33}}}
+	],
+	"cameras": [{"type": "orthographic", "orthographic": {"xmag": 1, "ymag": 2, "znear": 0.1, "zfar": 50}}],
+	"extensions": {"KHR_lights_punctual": {"lights": [{"type": "directional", "intensity": 20, "color": [1, 0.5, 0]}]}}`
+
+func TestLoadGLTFMesh(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		data      []byte
+		primitive string
+		size      meshSize
+		smooth    bool
+	}{
+		{"flat", "m.gltf", nil, gltfPrimitiveFlat, meshSize{3, 1}, false},
+		{"indexed with normals", "m.gltf", nil, `{"attributes": {"POSITION": 0, "NORMAL": 1}, "indices": 2}`, meshSize{3, 1}, true},
+		{"glb", "m.glb", glb(2, gltfDocument(`{"byteLength": 80}`, gltfPrimitiveFlat), gltfTriangleBuffer()), "", meshSize{3, 1}, false},
+		{"lines are skipped", "m.gltf", nil, `{"attributes": {"POSITION": 0}, "mode": 1}`, meshSize{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := test.data
+			if data == nil {
+				data = []byte(gltfDocument(gltfDataBuffer(), test.primitive))
+			}
+			objects, err := LoadMesh(fstest.MapFS{test.file: {Data: data}}, test.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tri := objects["tri"]
+			if tri == nil {
+				t.Fatalf("objects %v without the triangle", meshSizes(objects))
+			}
+			if got := meshSizes(objects)["tri"]; got != test.size {
+				t.Fatalf("size %v, want %v", got, test.size)
+			}
+			// Nodes are Y up, the matrix turns them to Z up.
+			if got := vectorTransform(Vector{0, 0, 0, 1}, tri.Matrix); got != (Vector{0, -5, 0, 1}) {
+				t.Errorf("origin at %v, want {0 -5 0 1}", got)
+			}
+			if test.size.triangles == 0 {
+				return
+			}
+			for _, mat := range tri.Materials {
+				if smooth := mat.Indices[0][3] == 1; smooth != test.smooth {
+					t.Errorf("smooth %v, want %v", smooth, test.smooth)
+				}
+			}
+			if got := tri.Normals[0]; vectorDistance(got, Vector{0, 0, 1, 0}) > 1e-9 {
+				t.Errorf("normal %v, want {0 0 1 0}", got)
+			}
+		})
+	}
+}
+
+func TestLoadGLTFScene(t *testing.T) {
+	tests := []struct {
+		material int
+		name     string
+		check    func(m Material) bool
+	}{
+		{0, "plain", func(m Material) bool {
+			return m.Glossiness == 0 && m.Roughness == 1 && m.Color == Vector{1, 1, 1, 1} && !m.Light
+		}},
+		{1, "metal", func(m Material) bool {
+			return math.Abs(m.Glossiness-0.8) < 1e-9 && m.Roughness == 0.2 && m.Color == Vector{1, 0.5, 0.5, 1}
+		}},
+		{2, "plastic", func(m Material) bool {
+			return m.Glossiness == 0 && m.Roughness == 0
+		}},
+		{3, "lamp", func(m Material) bool {
+			return m.Light && m.LightStrength == 6 && m.EmissionColor == Vector{1, 0.5, 0, 1} && m.Color == Vector{0.2, 0.2, 0.2, 1}
+		}},
+		{4, "glass", func(m Material) bool {
+			return m.Transmission == 0.9 && m.IndexOfRefraction == 1.33
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			primitive := fmt.Sprintf(`{"attributes": {"POSITION": 0}, "material": %d}`, test.material)
+			files := fstest.MapFS{"m.gltf": {Data: []byte(gltfDocument(gltfDataBuffer(), primitive))}}
+			s, err := LoadGLTF(files, "m.gltf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m := s.Objects["tri"].Materials[test.name]; !test.check(m) {
+				t.Errorf("material %+v", m)
+			}
+
+			if len(s.Cameras) != 1 {
+				t.Fatalf("%d cameras", len(s.Cameras))
+			}
+			c := s.Cameras[0]
+			if c.Perspective || c.Zoom != 4 || c.AspectRatio != 0.5 || c.Near != 0.1 || c.Far != 50 {
+				t.Errorf("camera %+v", c)
+			}
+			if len(s.Lights) != 1 {
+				t.Fatalf("%d lights", len(s.Lights))
+			}
+			l := s.Lights[0]
+			if !l.Directional || l.LightStrength != 2 || l.Color != (Vector{1, 0.5, 0, 1}) || vectorDistance(l.Direction, Vector{0, 1, 0, 0}) > 1e-9 {
+				t.Errorf("light %+v", l)
+			}
+		})
+	}
+}
+
+func TestLoadGLTFErrors(t *testing.T) {
+	buffer := gltfDataBuffer()
+	tests := []struct {
+		name string
+		file string
+		data []byte
+	}{
+		{"glb version", "m.glb", glb(1, gltfDocument(`{"byteLength": 80}`, gltfPrimitiveFlat), gltfTriangleBuffer())},
+		{"truncated glb", "m.glb", glb(2, gltfDocument(`{"byteLength": 80}`, gltfPrimitiveFlat), gltfTriangleBuffer())[:40]},
+		{"buffer without data", "m.gltf", []byte(gltfDocument(`{"byteLength": 80}`, gltfPrimitiveFlat))},
+		{"short buffer", "m.gltf", []byte(gltfDocument(strings.Replace(buffer, `"byteLength": 80`, `"byteLength": 90`, 1), gltfPrimitiveFlat))},
+		{"missing buffer file", "m.gltf", []byte(gltfDocument(`{"byteLength": 80, "uri": "m.bin"}`, gltfPrimitiveFlat))},
+		{"without positions", "m.gltf", []byte(gltfDocument(buffer, `{"attributes": {"NORMAL": 1}}`))},
+		{"accessor type", "m.gltf", []byte(gltfDocument(buffer, `{"attributes": {"POSITION": 2}}`))},
+		{"index out of range", "m.gltf", []byte(gltfDocument(buffer, `{"attributes": {"POSITION": 0}, "indices": 4}`))},
+		{"material out of range", "m.gltf", []byte(gltfDocument(buffer, `{"attributes": {"POSITION": 0}, "material": 9}`))},
+		{"counts differ", "m.gltf", []byte(gltfDocument(buffer, `{"attributes": {"POSITION": 0, "TEXCOORD_0": 3}}`))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := LoadMesh(fstest.MapFS{test.file: {Data: test.data}}, test.file); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"image"
 	"image/color"
 	"math"
-
-	"github.com/cheggaaa/pb"
 )
 
 func renderPixel(scene *Scene, x, y int) {
@@ -20,21 +18,20 @@ func renderPixel(scene *Scene, x, y int) {
 	bestHit = scene.Pixels[x][y].WorldLocation
 
 	pixel.Depth = bestHit.Dist
-	pixel.Color = bestHit.render(scene, 0)
+	pixel.Color = shade(scene, &bestHit)
+	pixel.Samples = 1
 
 	if bestHit.Triangle != nil {
-		if GlobalConfig.RenderReflections && bestHit.Triangle.Material.Glossiness > 0 {
+		if scene.renderer.Config.RenderReflections && bestHit.Triangle.Material.Glossiness > 0 {
 			bounceDir := reflectVector(bestHit.RayDir, bestHit.IntersectionNormal)
-			bounceStart := bestHit.Intersection
-			reflection := raycastSceneIntersect(scene, bounceStart, bounceDir)
+			reflection := raycastSceneBounce(scene, &bestHit, bounceDir)
 			if !reflection.Hit {
 				pixel.Depth += reflection.Dist
 			}
 		}
-		if GlobalConfig.RenderRefractions && bestHit.Triangle.Material.Transmission > 0 {
+		if scene.renderer.Config.RenderRefractions && bestHit.Triangle.Material.Transmission > 0 {
 			bounceDir := refractVector(bestHit.RayDir, bestHit.IntersectionNormal, bestHit.Triangle.Material.IndexOfRefraction)
-			bounceStart := bestHit.Intersection
-			refraction := raycastSceneIntersect(scene, bounceStart, bounceDir)
+			refraction := raycastSceneBounce(scene, &bestHit, bounceDir)
 			if !refraction.Hit {
 				pixel.Depth += refraction.Dist
 			}
@@ -44,103 +41,39 @@ func renderPixel(scene *Scene, x, y int) {
 	scene.Pixels[x][y] = pixel
 }
 
-// Render scene down to the image.
-func renderImage(scene *Scene, image *image.RGBA) {
-	maxDepth := scene.Pixels[0][0].Depth
-
+// renderSampleMap shows how many samples each pixel got, brighter is more.
+func renderSampleMap(scene *Scene, image *image.RGBA) {
+	maxSamples := 1
 	for i := 0; i < scene.Width; i++ {
 		for j := 0; j < scene.Height; j++ {
-			if maxDepth < scene.Pixels[i][j].Depth {
-				maxDepth = scene.Pixels[i][j].Depth
+			if scene.Pixels[i][j].Samples > maxSamples {
+				maxSamples = scene.Pixels[i][j].Samples
 			}
 		}
 	}
 	for i := 0; i < scene.Width; i++ {
 		for j := 0; j < scene.Height; j++ {
-			scene.Pixels[i][j].Depth /= maxDepth
-			if math.IsNaN(scene.Pixels[i][j].Depth) {
-				scene.Pixels[i][j].Depth = 0
-			}
+			level := float64(scene.Pixels[i][j].Samples) / float64(maxSamples)
+			image.Set(i, j, toRGBA(Vector{level, level, level, 1}))
 		}
 	}
+}
 
-	// Print pixels onto image
-	bar := pb.StartNew(scene.Width * scene.Height)
+// Render scene down to the image.
+func renderImage(scene *Scene, image *image.RGBA) {
 	for i := 0; i < scene.Width; i++ {
 		for j := 0; j < scene.Height; j++ {
-			bar.Increment()
-			pcolor := scene.Pixels[i][j].Color
-			pcolor = getPixelColor(scene, i, j, pcolor)
-			pcolor = limitVector(pcolor, 1.0)
-			colorRGBA := color.RGBA{
-				R: uint8(math.Floor(pcolor[0] * 255)),
-				G: uint8(math.Floor(pcolor[1] * 255)),
-				B: uint8(math.Floor(pcolor[2] * 255)),
-				A: uint8(math.Floor(pcolor[3] * 255)),
-			}
-			image.Set(i, j, colorRGBA)
+			image.Set(i, j, toRGBA(scene.Pixels[i][j].Color))
 		}
 	}
-	bar.Finish()
 }
 
-func getPixelColor(scene *Scene, x, y int, pixelColor Vector) Vector {
-	aaRadius := 1
-	if x < aaRadius || x+aaRadius >= scene.Width || y < aaRadius || y+aaRadius >= scene.Height {
-		return pixelColor
-	}
-	if GlobalConfig.Percentage < 100 {
-		return pixelColor
+func toRGBA(pcolor Vector) color.RGBA {
+	pcolor = limitVector(pcolor, 1.0)
+	return color.RGBA{
+		R: uint8(math.Floor(pcolor[0] * 255)),
+		G: uint8(math.Floor(pcolor[1] * 255)),
+		B: uint8(math.Floor(pcolor[2] * 255)),
+		A: uint8(math.Floor(pcolor[3] * 255)),
 	}
-
-	transparent := false
-	v := make([]PixelStorage, 0)
-	for i := -aaRadius; i <= aaRadius; i++ {
-		for j := -aaRadius; j <= aaRadius; j++ {
-			p := scene.Pixels[x+i][y+j]
-			if p.Depth == -1 {
-				transparent = true
-				continue
-			}
-			v = append(v, p)
-		}
-	}
-
-	if len(v) < 3 || pixelColor[3] < 0 {
-		return pixelColor
-	}
-
-	minDepth := v[0].Depth
-	maxDepth := v[0].Depth
-	minColor := vectorSum(v[0].Color)
-	maxColor := vectorSum(v[0].Color)
-
-	for i := range v {
-		if v[i].Depth < minDepth {
-			minDepth = v[i].Depth
-		}
-		if v[i].Depth > maxDepth {
-			maxDepth = v[i].Depth
-		}
-		vsum := vectorSum(v[i].Color)
-		if vsum < minColor {
-			minColor = vsum
-		}
-		if vsum > maxColor {
-			maxColor = vsum
-		}
-	}
-
-	check := (maxDepth-minDepth > GlobalConfig.EdgeDetechThreshold) ||
-		(maxColor-minColor > GlobalConfig.EdgeDetechThreshold)
-
-	if transparent {
-		check = true
-	}
-
-	if !check {
-		return pixelColor
-	}
-
-	return getPixel(scene, x, y)
 }
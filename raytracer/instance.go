@@ -0,0 +1,235 @@
+package raytracer
+
+import (
+	"log"
+	"time"
+)
+
+// instance of a shared mesh, placed in the scene with its own matrix.
+// Rays are moved into the mesh space to be cast on the mesh tree.
+type instance struct {
+	mesh    *Object
+	matrix  Matrix
+	inverse Matrix
+	normals Matrix
+	// Added to the mesh triangle ids, so ids stay unique in the scene.
+	idBase int64
+}
+
+// splitInstances out of the flattened objects, they are not merged into the
+// master object and not part of its tree cache.
+func (s *Scene) splitInstances() {
+	s.instanceObjects = make(map[string]*Object)
+	for name, obj := range s.Objects {
+		if obj.Instance == "" {
+			continue
+		}
+		s.instanceObjects[name] = obj
+		delete(s.Objects, name)
+	}
+}
+
+// prepareShapes builds the top level tree over the instances and the
+// primitives, which are outside the master object. Their ids follow the
+// master object triangle ids.
+func (s *Scene) prepareShapes() {
+	idBase := int64(len(s.MasterObject.Triangles))
+	boxes, idBase := s.prepareInstances(idBase)
+	boxes = append(boxes, s.preparePrimitives(idBase)...)
+	centroids := make([]Vector, len(boxes))
+	for i := range boxes {
+		centroids[i] = scaleVector(addVector(boxes[i][0], boxes[i][1]), 0.5)
+	}
+	s.shapeTree = nil
+	if len(boxes) > 0 {
+		s.shapeTree, _ = newBVH(boxes, centroids, s.renderer.renderThreads())
+	}
+}
+
+// prepareInstances builds the trees of the used shared meshes, returns the
+// bounds of the instances and the next free triangle id.
+func (s *Scene) prepareInstances(idBase int64) ([]BoundingBox, int64) {
+	s.instances = nil
+	if len(s.instanceObjects) == 0 {
+		return nil, idBase
+	}
+	start := time.Now()
+	meshes := make(map[string]*Object)
+	boxes := make([]BoundingBox, 0, len(s.instanceObjects))
+	for _, name := range sortedObjectNames(s.instanceObjects) {
+		obj := s.instanceObjects[name]
+		mesh, ok := meshes[obj.Instance]
+		if !ok {
+			parts, found := s.meshParts[obj.Instance]
+			if !found {
+				log.Printf("Instance %s of unknown mesh %s is skipped", name, obj.Instance)
+				continue
+			}
+			log.Printf("Prepare mesh %s", obj.Instance)
+			mesh = s.mergeMesh(parts)
+			meshes[obj.Instance] = mesh
+		}
+		if len(mesh.Triangles) == 0 {
+			continue
+		}
+		in := instance{
+			mesh:    mesh,
+			matrix:  obj.Matrix,
+			inverse: invertMatrix(obj.Matrix),
+			normals: normalMatrix(obj.Matrix),
+			idBase:  idBase,
+		}
+		idBase += int64(len(mesh.Triangles))
+		s.instances = append(s.instances, in)
+		boxes = append(boxes, in.boundingBox())
+	}
+	s.instanceObjects = nil
+	s.meshParts = nil
+	log.Printf("Prepared %d instances of %d meshes in %f seconds", len(s.instances), len(meshes), time.Since(start).Seconds())
+	return boxes, idBase
+}
+
+// mergeMesh parts into one object in the mesh space, with its own tree.
+func (s *Scene) mergeMesh(parts map[string]*Object) *Object {
+	mesh := Object{
+		Matrix:    identityHmgMatrix,
+		Materials: make(map[string]Material),
+	}
+	for _, name := range sortedObjectNames(parts) {
+		part := parts[name]
+		part.toAbsolute()
+		part.UnifyTriangles()
+		for k, m := range part.Materials {
+			mesh.Materials[k] = m
+		}
+		mesh.Triangles = append(mesh.Triangles, part.Triangles...)
+		part.Triangles = nil
+	}
+	for i := range mesh.Triangles {
+		mesh.Triangles[i].id = int64(i + 1)
+	}
+	if len(mesh.Triangles) > 0 {
+		s.buildTree(&mesh)
+	}
+	return &mesh
+}
+
+// boundingBox of the instance in the scene, around the corners of the mesh bounds.
+func (in *instance) boundingBox() BoundingBox {
+	local := in.mesh.Triangles[0].getBoundingBox()
+	for i := 1; i < len(in.mesh.Triangles); i++ {
+		local.extend(in.mesh.Triangles[i].getBoundingBox())
+	}
+	box := BoundingBox{}
+	for i := 0; i < 8; i++ {
+		corner := Vector{local[i&1][0], local[(i>>1)&1][1], local[(i>>2)&1][2], 1}
+		corner = vectorTransform(corner, in.matrix)
+		if i == 0 {
+			box = BoundingBox{corner, corner}
+		} else {
+			box.extendVector(corner)
+		}
+	}
+	return box
+}
+
+// raycast the instance, keeping the hit in the intersection if it's the closest so far.
+func (in *instance) raycast(rayStart, rayDir *Vector, intersection *Intersection) {
+	start := *rayStart
+	start[3] = 1
+	dir := *rayDir
+	dir[3] = 0
+	// The direction is not normalized, so hits are at the same ray parameter in both spaces.
+	start = vectorTransform(start, in.inverse)
+	dir = vectorTransform(dir, in.inverse)
+	local := raycastObjectIntersect(in.mesh, &start, &dir)
+	intersection.Hits += local.Hits
+	if !local.Hit {
+		return
+	}
+	point := vectorTransform(local.Intersection, in.matrix)
+	point[3] = 1
+	dist := pvectorDistance(&point, rayStart)
+	if dist <= 0 || (intersection.Dist != -1 && dist >= intersection.Dist) {
+		return
+	}
+	intersection.Hit = true
+	intersection.Intersection = point
+	intersection.IntersectionNormal = in.normal(local.IntersectionNormal)
+	intersection.geometricNormal = in.normal(local.geometricNormal)
+	// Shading works on the mesh triangle, nothing is moved to the scene per hit.
+	intersection.Triangle = local.Triangle
+	intersection.instance = in
+	intersection.local = local.Intersection
+	intersection.primitive = nil
+	intersection.RayStart = *rayStart
+	intersection.RayDir = *rayDir
+	intersection.Dist = dist
+}
+
+func (in *instance) normal(n Vector) Vector {
+	n = vectorTransform(n, in.normals)
+	n[3] = 0
+	return normalizeVector(n)
+}
+
+// triangle of the mesh moved to the scene, for sampling lights and caustics.
+func (in *instance) triangle(t *Triangle) *Triangle {
+	world := *t
+	world.id = in.idBase + t.id
+	world.P1 = vectorTransform(t.P1, in.matrix)
+	world.P2 = vectorTransform(t.P2, in.matrix)
+	world.P3 = vectorTransform(t.P3, in.matrix)
+	world.setNormals(in.normal(t.vertexNormal(0)), in.normal(t.vertexNormal(1)), in.normal(t.vertexNormal(2)), t.smooth())
+	return &world
+}
+
+// raycastShapes keeps the closest instance or primitive hit in the intersection.
+// Shape tree indices are the instances, then the bounded primitives.
+func (s *Scene) raycastShapes(rayStart, rayDir *Vector, intersection *Intersection) {
+	if s.shapeTree != nil {
+		s.shapeTree.traverse(rayStart, rayDir, intersection, func(indices []uint32) {
+			for _, i := range indices {
+				if int(i) < len(s.instances) {
+					s.instances[i].raycast(rayStart, rayDir, intersection)
+				} else {
+					s.bounded[int(i)-len(s.instances)].raycast(rayStart, rayDir, intersection)
+				}
+			}
+		})
+	}
+	for _, p := range s.unbounded {
+		p.raycast(rayStart, rayDir, intersection)
+	}
+}
+
+// lightTriangles of the master object, the instances and the primitives.
+// Instance triangles are moved to the scene, primitives are tessellated.
+func (s *Scene) lightTriangles() []*Triangle {
+	triangles := make([]*Triangle, 0)
+	for i := range s.MasterObject.Triangles {
+		if s.MasterObject.Triangles[i].Material.Light {
+			triangles = append(triangles, &s.MasterObject.Triangles[i])
+		}
+	}
+	for i := range s.instances {
+		mesh := s.instances[i].mesh
+		for j := range mesh.Triangles {
+			if mesh.Triangles[j].Material.Light {
+				triangles = append(triangles, s.instances[i].triangle(&mesh.Triangles[j]))
+			}
+		}
+	}
+	for _, primitives := range [][]*Primitive{s.bounded, s.unbounded} {
+		for _, p := range primitives {
+			if !p.Material.Light {
+				continue
+			}
+			lights := p.lightTriangles()
+			for i := range lights {
+				triangles = append(triangles, &lights[i])
+			}
+		}
+	}
+	return triangles
+}
@@ -0,0 +1,74 @@
+package raytracer
+
+import (
+	"testing"
+)
+
+// instanceScene with the height field moved by the matrix, as an instance of
+// a shared mesh or as a scene object.
+func instanceScene(instanced bool, matrix Matrix) *Scene {
+	r := NewRenderer()
+	r.Config = DEFAULT
+	r.Config.KDTreeCache = false
+	s := NewScene(SceneOptions{})
+	obj := heightField(4)
+	if instanced {
+		s.Meshes = map[string]*Object{"field": obj}
+		obj = NewObject()
+		obj.Instance = "field"
+	}
+	obj.Matrix = matrix
+	_ = s.AddObject("field", obj)
+	r.prepare(s, 4, 4)
+	return s
+}
+
+func TestInstanceHits(t *testing.T) {
+	matrix := identityHmgMatrix
+	matrix[3] = Vector{2, 1, 0, 1}
+	instanced := instanceScene(true, matrix)
+	object := instanceScene(false, matrix)
+	down := Vector{0, 0, -1, 0}
+	tests := []struct {
+		name  string
+		start Vector
+	}{
+		{"corner", Vector{2.1, 1.1, 1, 1}},
+		{"middle", Vector{2.5, 1.5, 1, 1}},
+		{"edge", Vector{2.95, 1.3, 1, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := raycastSceneIntersect(instanced, test.start, down)
+			want := raycastSceneIntersect(object, test.start, down)
+			if !got.Hit || !want.Hit {
+				t.Fatalf("hit %v, want %v", got.Hit, want.Hit)
+			}
+			if vectorDistance(got.Intersection, want.Intersection) > 1e-9 {
+				t.Errorf("intersection %v, want %v", got.Intersection, want.Intersection)
+			}
+			if vectorDistance(got.IntersectionNormal, want.IntersectionNormal) > 1e-6 {
+				t.Errorf("normal %v, want %v", got.IntersectionNormal, want.IntersectionNormal)
+			}
+			if vectorDistance(got.getTexCoords(), want.getTexCoords()) > 1e-6 {
+				t.Errorf("texture coordinates %v, want %v", got.getTexCoords(), want.getTexCoords())
+			}
+			if got.id() < int64(len(instanced.MasterObject.Triangles)) {
+				t.Errorf("instance hit id %d overlaps the master object", got.id())
+			}
+		})
+	}
+
+	// Instance hits are shaded on the mesh triangles, no more is allocated
+	// than for the same hit on the object.
+	start := tests[1].start
+	allocs := testing.AllocsPerRun(100, func() {
+		raycastSceneIntersect(instanced, start, down)
+	})
+	objectAllocs := testing.AllocsPerRun(100, func() {
+		raycastSceneIntersect(object, start, down)
+	})
+	if allocs > objectAllocs {
+		t.Errorf("%v allocations per instance hit, %v per object hit", allocs, objectAllocs)
+	}
+}
@@ -7,20 +7,23 @@ import (
 // Triangle definition
 // raycasting is already expensive and trying to calculate the triangle
 // in each raycast makes it harder. So we are simplifying triangle definition.
+// Vertex attributes are stored in float32 and only when they are there,
+// see the vertex methods to read them.
 type Triangle struct {
-	id       int64
-	P1       Vector
-	P2       Vector
-	P3       Vector
-	N1       Vector
-	N2       Vector
-	N3       Vector
-	T1       Vector
-	T2       Vector
-	T3       Vector
-	Material Material
-	Photons  []Photon
-	Smooth   bool
+	id int64
+	P1 Vector
+	P2 Vector
+	P3 Vector
+	// Shared by the triangles of the same material.
+	Material *Material
+	// Normal of the flat triangles, for the side they face.
+	flatNormal [3]float32
+	// Vertex normals xyz of smooth triangles, nil for flat ones.
+	normals *[9]float32
+	// Vertex texture coordinates uv, nil unless the object has them.
+	texCoords *[6]float32
+	// Vertex colors rgba, nil unless the object has them.
+	colors *[12]float32
 }
 
 // Intersection defines the ratcast triangle intersection result.
@@ -33,6 +36,46 @@ type Intersection struct {
 	RayDir             Vector
 	Dist               float64
 	Hits               int
+	// Normal of the surface facing the ray, before smoothing and bump maps.
+	geometricNormal Vector
+	// Instance of instance hits, Triangle is then the mesh triangle and local
+	// the hit point in mesh space.
+	instance *instance
+	local    Vector
+	// Primitive of primitive hits, Triangle is then its shading triangle and
+	// uv and outward the texture coordinates and outward normal of the hit.
+	primitive *Primitive
+	uv        Vector
+	outward   Vector
+}
+
+// id of the hit surface, unique in the scene.
+func (i *Intersection) id() int64 {
+	if i.instance != nil {
+		return i.instance.idBase + i.Triangle.id
+	}
+	return i.Triangle.id
+}
+
+// barycentric coordinates of the hit point in the triangle.
+func (i *Intersection) barycentric() (u, v, w float64) {
+	point := i.Intersection
+	if i.instance != nil {
+		point = i.local
+	}
+	u, v, w, _ = barycentricCoordinates(i.Triangle.P1, i.Triangle.P2, i.Triangle.P3, point)
+	return u, v, w
+}
+
+// vertexNormal of the hit triangle in the scene.
+func (i *Intersection) vertexNormal(k int) Vector {
+	if i.primitive != nil {
+		return i.outward
+	}
+	if i.instance != nil {
+		return i.instance.normal(i.Triangle.vertexNormal(k))
+	}
+	return i.Triangle.vertexNormal(k)
 }
 
 func (t *Triangle) equals(dest Triangle) bool {
@@ -47,37 +90,101 @@ func (t *Triangle) midPoint() Vector {
 	return mid
 }
 
+func (t *Triangle) area() float64 {
+	return vectorLength(crossProduct(subVector(t.P2, t.P1), subVector(t.P3, t.P1))) / 2.0
+}
+
+func (t *Triangle) normal() Vector {
+	return normalizeVector(crossProduct(subVector(t.P2, t.P1), subVector(t.P3, t.P1)))
+}
+
+// getBoundingBox of the triangle, padded so tree traversal doesn't lose the
+// rays through its edges.
 func (t *Triangle) getBoundingBox() BoundingBox {
 	result := BoundingBox{}
 	result[0] = t.P1
 	result[1] = t.P1
 	result.extendVector(t.P2)
 	result.extendVector(t.P3)
+	result.pad()
 	return result
 }
 
+// setNormals of the vertices, flat triangles only keep the first one.
+func (t *Triangle) setNormals(n1, n2, n3 Vector, smooth bool) {
+	if !smooth {
+		t.normals = nil
+		toFloat32(t.flatNormal[:], n1)
+		return
+	}
+	t.normals = &[9]float32{}
+	toFloat32(t.normals[0:3], n1)
+	toFloat32(t.normals[3:6], n2)
+	toFloat32(t.normals[6:9], n3)
+}
+
+func (t *Triangle) setTexCoords(t1, t2, t3 Vector) {
+	t.texCoords = &[6]float32{}
+	toFloat32(t.texCoords[0:2], t1)
+	toFloat32(t.texCoords[2:4], t2)
+	toFloat32(t.texCoords[4:6], t3)
+}
+
+func (t *Triangle) setColors(c1, c2, c3 Vector) {
+	t.colors = &[12]float32{}
+	toFloat32(t.colors[0:4], c1)
+	toFloat32(t.colors[4:8], c2)
+	toFloat32(t.colors[8:12], c3)
+}
+
+// smooth triangles interpolate their vertex normals.
+func (t *Triangle) smooth() bool {
+	return t.normals != nil
+}
+
+// vertexNormal of the k-th vertex, the same normal for all vertices of flat triangles.
+func (t *Triangle) vertexNormal(k int) Vector {
+	if t.normals == nil {
+		return fromFloat32(t.flatNormal[:])
+	}
+	return fromFloat32(t.normals[3*k : 3*k+3])
+}
+
+// vertexTexCoord of the k-th vertex, zero without texture coordinates.
+func (t *Triangle) vertexTexCoord(k int) Vector {
+	if t.texCoords == nil {
+		return Vector{}
+	}
+	return fromFloat32(t.texCoords[2*k : 2*k+2])
+}
+
+func (t *Triangle) vertexColor(k int) Vector {
+	return fromFloat32(t.colors[4*k : 4*k+4])
+}
+
 func (i *Intersection) getTexCoords() Vector {
-	u, v, w, _ := barycentricCoordinates(i.Triangle.P1, i.Triangle.P2, i.Triangle.P3, i.Intersection)
+	if i.primitive != nil {
+		return i.uv
+	}
+	if i.Triangle.texCoords == nil {
+		return Vector{}
+	}
+	u, v, w := i.barycentric()
+	t := i.Triangle.texCoords
 	tex := Vector{
-		u*i.Triangle.T1[0] + v*i.Triangle.T2[0] + w*i.Triangle.T3[0],
-		u*i.Triangle.T1[1] + v*i.Triangle.T2[1] + w*i.Triangle.T3[1],
+		u*float64(t[0]) + v*float64(t[2]) + w*float64(t[4]),
+		u*float64(t[1]) + v*float64(t[3]) + w*float64(t[5]),
 	}
 	return tex
 }
 
 func (i *Intersection) hasBumpMap() bool {
-	material := i.Triangle.Material
-	if material.Texture != "" {
-		if _, ok := BumpMapNormals[material.Texture]; ok {
-			return true
-		}
-	}
-	return false
+	return i.Triangle.Material.bumpMap != nil
 }
 
 func (i *Intersection) getBumpNormal() Vector {
-	material := i.Triangle.Material
-	if material.Texture != "" {
+	bumpMap := i.Triangle.Material.bumpMap
+	if bumpMap != nil {
 		// ok, we have the image. Let's calculate the pixel color;
 		s := i.getTexCoords()
 		// get image size
@@ -102,10 +209,10 @@ func (i *Intersection) getBumpNormal() Vector {
 		s[0] -= float64(int64(s[0]))
 		s[1] -= float64(int64(s[1]))
 
-		pixelX := int(float64(len(BumpMapNormals[material.Texture])) * s[0])
-		pixelY := int(float64(len(BumpMapNormals[material.Texture][0])) * s[1])
+		pixelX := int(float64(len(bumpMap)) * s[0])
+		pixelY := int(float64(len(bumpMap[0])) * s[1])
 
-		bump := BumpMapNormals[material.Texture][pixelX][pixelY]
+		bump := bumpMap[pixelX][pixelY]
 		t := crossProduct(i.IntersectionNormal, Vector{0, -1, 0, 0})
 		if vectorLength(t) < DIFF {
 			t = crossProduct(i.IntersectionNormal, Vector{0, 0, 1, 0})
@@ -125,12 +232,12 @@ func (i *Intersection) getNormal() {
 		return
 	}
 
-	if i.Triangle.Smooth {
-		u, v, w, _ := barycentricCoordinates(i.Triangle.P1, i.Triangle.P2, i.Triangle.P3, i.Intersection)
+	if i.Triangle.smooth() {
+		u, v, w := i.barycentric()
 
-		N1 := i.Triangle.N1
-		N2 := i.Triangle.N2
-		N3 := i.Triangle.N3
+		N1 := i.vertexNormal(0)
+		N2 := i.vertexNormal(1)
+		N3 := i.vertexNormal(2)
 		if !sameSideTest(N1, i.IntersectionNormal, 0) {
 			N1 = scaleVector(N1, -1)
 			N2 = scaleVector(N2, -1)
@@ -144,26 +251,20 @@ func (i *Intersection) getNormal() {
 
 		i.IntersectionNormal = normal
 	}
-	if i.hasBumpMap() && GlobalConfig.RenderBumpMap {
+	// Bump maps are only loaded when render_bump_map is on.
+	if i.hasBumpMap() {
 		i.IntersectionNormal = i.getBumpNormal()
 	}
 }
 
 func (i *Intersection) render(scene *Scene, depth int) Vector {
 	if !i.Hit {
-		if !hasEnvironmentMap {
-			return GlobalConfig.TransparentColor
-		}
-		u := math.Atan2(i.RayDir[0], i.RayDir[1])/(2*math.Pi) + 0.5
-		v := i.RayDir[2]*0.5 + 0.5
-		w := float64(len(EnvironmentMap)) - 1
-		h := float64(len(EnvironmentMap[0])) - 1
-		pixelX := int(w * u)
-		pixelY := int(h - h*v)
-		return EnvironmentMap[pixelX][pixelY]
+		// Empty ray direction is a camera ray that doesn't exist, like the corners of a fisheye.
+		return scene.renderer.environment(i.RayDir)
 	}
-	if depth >= GlobalConfig.MaxReflectionDepth {
-		return i.getColor()
+	config := &scene.renderer.Config
+	if depth >= config.MaxReflectionDepth {
+		return i.getColor(scene)
 	}
 
 	// We use same samples for both color sampling as well as
@@ -174,7 +275,7 @@ func (i *Intersection) render(scene *Scene, depth int) Vector {
 	light := Vector{}
 
 	// Light that reaches intersection point without any obstacles
-	if GlobalConfig.RenderLights {
+	if config.RenderLights {
 		light = i.getDirectLight(scene, depth)
 	}
 
@@ -182,9 +283,9 @@ func (i *Intersection) render(scene *Scene, depth int) Vector {
 	// global illumination sampling as it is way too expensive _for now_
 	// Instead, we are taking a short-cut that modern games also do, an idea by CryTek I suppose?
 	// We are doing an ambient occlusion
-	if GlobalConfig.RenderOcclusion {
-		aRate := ambientLightCalc(scene, i, samples, GlobalConfig.SamplerLimit)
-		aRate *= GlobalConfig.OcclusionRate
+	if config.RenderOcclusion {
+		aRate := ambientLightCalc(scene, i, samples, config.SamplerLimit)
+		aRate *= config.OcclusionRate
 
 		// Add ambient light to direct light.
 		// In a perfect world, we should first calculate the lights then do the occlusion
@@ -198,15 +299,15 @@ func (i *Intersection) render(scene *Scene, depth int) Vector {
 	}
 
 	// Get color
-	color := i.getColor()
+	color := i.getColor(scene)
 
-	if GlobalConfig.RenderAmbientColors {
+	if config.RenderAmbientColors {
 		// Get ambient colors and apply to existing color
-		aColor := ambientColor(scene, i, samples, GlobalConfig.SamplerLimit)
+		aColor := ambientColor(scene, i, samples, config.SamplerLimit)
 		color = Vector{
-			(color[0] * (1.0 - GlobalConfig.AmbientColorSharingRatio)) + (aColor[0] * GlobalConfig.AmbientColorSharingRatio),
-			(color[1] * (1.0 - GlobalConfig.AmbientColorSharingRatio)) + (aColor[1] * GlobalConfig.AmbientColorSharingRatio),
-			(color[2] * (1.0 - GlobalConfig.AmbientColorSharingRatio)) + (aColor[2] * GlobalConfig.AmbientColorSharingRatio),
+			(color[0] * (1.0 - config.AmbientColorSharingRatio)) + (aColor[0] * config.AmbientColorSharingRatio),
+			(color[1] * (1.0 - config.AmbientColorSharingRatio)) + (aColor[1] * config.AmbientColorSharingRatio),
+			(color[2] * (1.0 - config.AmbientColorSharingRatio)) + (aColor[2] * config.AmbientColorSharingRatio),
 			1,
 		}
 		color = limitVector(color, 1.0)
@@ -238,27 +339,20 @@ func (i *Intersection) render(scene *Scene, depth int) Vector {
 		} else {
 			numNormals := int(math.Floor(i.Triangle.Material.Roughness * 10))
 			if numNormals > 0 {
-				dirSamples := createSamples(i.IntersectionNormal, numNormals, 1-i.Triangle.Material.Roughness)
+				dirSamples := scene.renderer.createSamples(i.IntersectionNormal, numNormals, 1-i.Triangle.Material.Roughness)
 				dirs = append(dirs, dirSamples...)
 			}
 		}
 	}
 
-	if i.Triangle.Material.Glossiness > 0 && GlobalConfig.RenderReflections {
+	if i.Triangle.Material.Glossiness > 0 && config.RenderReflections {
 		// Do the reflection!
 		collColor := Vector{}
-		colChan := make(chan Vector, len(dirs))
 		// Sample from reflected directions
 		for m := range dirs {
-			go func(scene *Scene, intersection *Intersection, dir Vector, depth int, colChan chan Vector) {
-				dir = reflectVector(intersection.RayDir, dir)
-				target := raycastSceneIntersect(scene, intersection.Intersection, dir)
-				colChan <- target.render(scene, depth)
-			}(scene, i, dirs[m], depth+1, colChan)
-		}
-		for m := 0; m < len(dirs); m++ {
-			targetColor := <-colChan
-			collColor = addVector(collColor, targetColor)
+			dir := reflectVector(i.RayDir, dirs[m])
+			target := raycastSceneBounce(scene, i, dir)
+			collColor = addVector(collColor, target.render(scene, depth+1))
 		}
 		collColor = scaleVector(collColor, 1.0/float64(len(dirs)))
 
@@ -269,23 +363,13 @@ func (i *Intersection) render(scene *Scene, depth int) Vector {
 			1,
 		}
 	}
-	if i.Triangle.Material.Transmission > 0 && GlobalConfig.RenderRefractions {
+	if i.Triangle.Material.Transmission > 0 && config.RenderRefractions {
 		// Do the refraction!
 		collColor := Vector{}
-		colChan := make(chan Vector, len(dirs))
-		for m := range dirs {
-			go func(scene *Scene, intersection *Intersection, dir Vector, depth int, colChan chan Vector) {
-				dir = refractVector(
-					intersection.RayDir,
-					intersection.IntersectionNormal,
-					intersection.Triangle.Material.IndexOfRefraction)
-				target := raycastSceneIntersect(scene, intersection.Intersection, dir)
-				colChan <- target.render(scene, depth)
-			}(scene, i, dirs[m], depth+1, colChan)
-		}
-		for m := 0; m < len(dirs); m++ {
-			targetColor := <-colChan
-			collColor = addVector(collColor, targetColor)
+		for range dirs {
+			dir := refractVector(i.RayDir, i.IntersectionNormal, i.Triangle.Material.IndexOfRefraction)
+			target := raycastSceneBounce(scene, i, dir)
+			collColor = addVector(collColor, target.render(scene, depth+1))
 		}
 		collColor = scaleVector(collColor, 1.0/float64(len(dirs)))
 		trans := i.Triangle.Material.Transmission * (1 - i.Triangle.Material.Roughness)
@@ -307,19 +391,21 @@ func (i *Intersection) getDirectLight(scene *Scene, depth int) Vector {
 	return calculateTotalLight(scene, i, 0)
 }
 
-func (i *Intersection) getColor() Vector {
-	if !GlobalConfig.RenderColors {
+func (i *Intersection) getColor(scene *Scene) Vector {
+	if !scene.renderer.Config.RenderColors {
 		return Vector{
 			1, 1, 1, 1,
 		}
 	}
+	return i.textureColor()
+}
 
+// textureColor is the material color, or the texture color at the hit point.
+// Vertex colors are multiplied with the material color.
+func (i *Intersection) textureColor() Vector {
 	material := i.Triangle.Material
 	result := material.Color
-	if material.Texture == "" {
-		return result
-	}
-	if _, ok := Images[material.Texture]; ok {
+	if material.image != nil {
 		// ok, we have the image. Let's calculate the pixel color;
 		s := i.getTexCoords()
 		// get image size
@@ -345,9 +431,17 @@ func (i *Intersection) getColor() Vector {
 		s[0] -= float64(int64(s[0]))
 		s[1] -= float64(int64(s[1]))
 
-		pixelX := int(float64(len(Images[material.Texture])) * s[0])
-		pixelY := int(float64(len(Images[material.Texture][0])) * s[1])
-		result = Images[material.Texture][pixelX][pixelY]
+		pixelX := int(float64(len(material.image)) * s[0])
+		pixelY := int(float64(len(material.image[0])) * s[1])
+		result = material.image[pixelX][pixelY]
+	} else if i.Triangle.colors != nil {
+		u, v, w := i.barycentric()
+		c := i.Triangle.colors
+		var color Vector
+		for j := range color {
+			color[j] = u*float64(c[j]) + v*float64(c[4+j]) + w*float64(c[8+j])
+		}
+		result = multiplyVector(result, color)
 	}
 	return result
 }
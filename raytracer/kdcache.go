@@ -0,0 +1,529 @@
+package raytracer
+
+/*
+KD-tree cache, building the tree of big scenes takes minutes while reading it
+back takes seconds. The cache is written next to the scene file as
+<scene>.kdcache and used while the hash of the scene geometry matches, so
+changing the config, lights, cameras or material colors keeps it valid.
+The configured accelerator is part of the hash, a KD-tree cache is not used
+for a BVH render and the other way around.
+A cache file is the "RLKD" magic, the cache version and the geometry hash,
+followed by the flattened triangles and the tree. Triangle positions are
+followed by their vertex attributes, each kind for the triangles that have
+them. KD-tree nodes are in preorder, leaves refer to the triangles by their
+index. BVH nodes and indices are stored as they are. Materials are not stored,
+triangles get them from the scene objects in the order they are merged.
+The file ends with the sha256 of everything before it, a cache cut short or
+damaged on disk is built again.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	kdCacheExtension = ".kdcache"
+	kdCacheVersion   = 5
+	// Position xyzw of the three triangle vertices.
+	kdTriangleFloats = 3 * 4
+
+	kdTriangleSmooth    = 1 << 0
+	kdTriangleColors    = 1 << 1
+	kdTriangleTexCoords = 1 << 2
+
+	kdCacheKDTree = 0
+	kdCacheBVH    = 1
+)
+
+var kdCacheMagic = [4]byte{'R', 'L', 'K', 'D'}
+
+// kdTriangleAttributes in the order they are stored, values is nil for the
+// triangles without the attribute.
+var kdTriangleAttributes = []struct {
+	size   int
+	values func(t *Triangle) []float32
+}{
+	{3, func(t *Triangle) []float32 {
+		if t.normals != nil {
+			return nil
+		}
+		return t.flatNormal[:]
+	}},
+	{9, func(t *Triangle) []float32 {
+		if t.normals == nil {
+			return nil
+		}
+		return t.normals[:]
+	}},
+	{6, func(t *Triangle) []float32 {
+		if t.texCoords == nil {
+			return nil
+		}
+		return t.texCoords[:]
+	}},
+	{12, func(t *Triangle) []float32 {
+		if t.colors == nil {
+			return nil
+		}
+		return t.colors[:]
+	}},
+}
+
+type kdCacheHeader struct {
+	Magic   [4]byte
+	Version uint32
+	Hash    [sha256.Size]byte
+}
+
+// kdCache file of a scene, nil when the scene is not cached.
+type kdCache struct {
+	filename string
+	hash     [sha256.Size]byte
+}
+
+// kdCache of the flattened scene objects, before they are processed.
+func (s *Scene) kdCache() *kdCache {
+	if !s.renderer.Config.KDTreeCache || s.InputFilename == "" {
+		return nil
+	}
+	return &kdCache{
+		filename: s.InputFilename + kdCacheExtension,
+		hash:     s.geometry,
+	}
+}
+
+// geometryHash of the flattened objects, everything the tree is built from.
+func (s *Scene) geometryHash() [sha256.Size]byte {
+	h := sha256.New()
+	w := bufio.NewWriter(h)
+	buf := make([]byte, 8)
+	number := func(v uint64) {
+		binary.LittleEndian.PutUint64(buf, v)
+		_, _ = w.Write(buf)
+	}
+	vectors := func(list []Vector) {
+		number(uint64(len(list)))
+		for i := range list {
+			for j := range list[i] {
+				number(math.Float64bits(list[i][j]))
+			}
+		}
+	}
+	name := func(name string) {
+		number(uint64(len(name)))
+		_, _ = w.WriteString(name)
+	}
+
+	number(kdCacheVersion)
+	name(s.renderer.Config.Accelerator)
+	for _, objName := range sortedObjectNames(s.Objects) {
+		obj := s.Objects[objName]
+		name(objName)
+		vectors(obj.Matrix[:])
+		vectors(obj.Vertices)
+		vectors(obj.Normals)
+		vectors(obj.TexCoords)
+		vectors(obj.Colors)
+		for _, matName := range obj.materialNames() {
+			name(matName)
+			indices := obj.Materials[matName].Indices
+			number(uint64(len(indices)))
+			for _, face := range indices {
+				for _, v := range face {
+					number(uint64(v))
+				}
+			}
+		}
+	}
+	_ = w.Flush()
+
+	result := [sha256.Size]byte{}
+	copy(result[:], h.Sum(nil))
+	return result
+}
+
+// load the master object from the cache, false if it has to be built.
+func (c *kdCache) load(s *Scene) bool {
+	if c == nil {
+		return false
+	}
+	start := time.Now()
+	f, err := os.Open(c.filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	sum := sha256.New()
+	body := io.TeeReader(r, sum)
+	header := kdCacheHeader{}
+	if err := binary.Read(body, binary.LittleEndian, &header); err != nil {
+		log.Printf("KDTree cache %s: %s", c.filename, err.Error())
+		return false
+	}
+	if header.Magic != kdCacheMagic || header.Version != kdCacheVersion || header.Hash != c.hash {
+		log.Printf("KDTree cache %s is out of date", c.filename)
+		return false
+	}
+
+	gigaMesh := s.masterObject()
+	d := &rlbDecoder{r: body}
+	gigaMesh.Triangles = d.triangles()
+	if d.err == nil {
+		d.err = s.cachedMaterials(gigaMesh.Triangles)
+	}
+	var kind uint8
+	d.read(&kind)
+	if kind == kdCacheBVH {
+		gigaMesh.bvh = d.bvh(len(gigaMesh.Triangles))
+	} else if root := d.node(gigaMesh.Triangles); root != nil {
+		gigaMesh.Root = *root
+	} else if d.err == nil {
+		d.err = errors.New("no KDTree root")
+	}
+	if d.err == nil {
+		d.err = checkCacheSum(r, sum.Sum(nil))
+	}
+	if d.err != nil {
+		log.Printf("KDTree cache %s: %s", c.filename, d.err.Error())
+		return false
+	}
+	gigaMesh.calcRadius()
+	log.Printf("Loaded KDTree from %s in %f seconds", c.filename, time.Since(start).Seconds())
+	s.Objects = nil
+	s.MasterObject = &gigaMesh
+	return true
+}
+
+// checkCacheSum reads the trailing checksum of the cache and compares it.
+func checkCacheSum(r io.Reader, sum []byte) error {
+	trailer := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, trailer); err != nil {
+		return fmt.Errorf("checksum: %w", err)
+	}
+	if !bytes.Equal(trailer, sum) {
+		return errors.New("checksum mismatch")
+	}
+	return nil
+}
+
+// cachedMaterials of the triangles, they are in the order of mergeAll.
+func (s *Scene) cachedMaterials(triangles []Triangle) error {
+	i := 0
+	for _, objName := range sortedObjectNames(s.Objects) {
+		obj := s.Objects[objName]
+		for _, matName := range obj.materialNames() {
+			faces := len(obj.Materials[matName].Indices)
+			if i+faces > len(triangles) {
+				return fmt.Errorf("%d triangles for more faces", len(triangles))
+			}
+			// Shared like UnifyTriangles does.
+			mat := obj.Materials[matName]
+			mat.Indices = nil
+			for j := 0; j < faces; j++ {
+				triangles[i].Material = &mat
+				i++
+			}
+		}
+	}
+	if i != len(triangles) {
+		return fmt.Errorf("%d triangles for %d faces", len(triangles), i)
+	}
+	return nil
+}
+
+// save the master object to the cache, the render goes on if it can't be written.
+func (c *kdCache) save(s *Scene) {
+	if c == nil {
+		return
+	}
+	start := time.Now()
+	// Written next to the cache and renamed, a killed render leaves no broken
+	// cache and concurrent renders of the scene don't write the same file.
+	f, err := os.CreateTemp(filepath.Dir(c.filename), filepath.Base(c.filename)+".*.tmp")
+	if err == nil {
+		err = c.write(f, s.MasterObject)
+		if err == nil {
+			err = os.Rename(f.Name(), c.filename)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("KDTree cache %s can't be saved: %s", c.filename, err.Error())
+		return
+	}
+	log.Printf("Saved KDTree to %s in %f seconds", c.filename, time.Since(start).Seconds())
+}
+
+// write the cache to f and close it.
+func (c *kdCache) write(f *os.File, obj *Object) error {
+	sum := sha256.New()
+	e := &rlbEncoder{w: bufio.NewWriter(io.MultiWriter(f, sum))}
+	e.write(&kdCacheHeader{Magic: kdCacheMagic, Version: kdCacheVersion, Hash: c.hash})
+	e.triangles(obj.Triangles)
+	if obj.bvh != nil {
+		e.write(uint8(kdCacheBVH))
+		e.bvh(obj.bvh)
+	} else {
+		e.write(uint8(kdCacheKDTree))
+		e.node(&obj.Root)
+	}
+	if e.err == nil {
+		e.err = e.w.Flush()
+	}
+	if e.err == nil {
+		_, e.err = f.Write(sum.Sum(nil))
+	}
+	if e.err != nil {
+		f.Close()
+		return e.err
+	}
+	return f.Close()
+}
+
+func (e *rlbEncoder) triangles(triangles []Triangle) {
+	e.write(uint32(len(triangles)))
+	values := make([]float64, 0, rlbChunk)
+	flags := make([]uint8, len(triangles))
+	for i := range triangles {
+		t := &triangles[i]
+		values = append(values, t.P1[:]...)
+		values = append(values, t.P2[:]...)
+		values = append(values, t.P3[:]...)
+		if len(values) >= rlbChunk-kdTriangleFloats {
+			e.write(values)
+			values = values[:0]
+		}
+		if t.normals != nil {
+			flags[i] |= kdTriangleSmooth
+		}
+		if t.colors != nil {
+			flags[i] |= kdTriangleColors
+		}
+		if t.texCoords != nil {
+			flags[i] |= kdTriangleTexCoords
+		}
+	}
+	e.write(values)
+	e.write(flags)
+
+	attributes := make([]float32, 0, rlbChunk)
+	for _, attribute := range kdTriangleAttributes {
+		for i := range triangles {
+			attributes = append(attributes, attribute.values(&triangles[i])...)
+			if len(attributes) >= rlbChunk-attribute.size {
+				e.write(attributes)
+				attributes = attributes[:0]
+			}
+		}
+		e.write(attributes)
+		attributes = attributes[:0]
+	}
+}
+
+// node and its children in preorder, a nil node is a single zero byte.
+func (e *rlbEncoder) node(n *Node) {
+	if n == nil {
+		e.write(uint8(0))
+		return
+	}
+	e.write(uint8(1))
+	if n.BoundingBox == nil {
+		e.write(uint8(0))
+	} else {
+		e.write(uint8(1))
+		e.write(n.BoundingBox)
+	}
+	e.write(uint32(n.TriangleCount))
+	e.write(uint32(n.depth))
+	ids := make([]uint32, len(n.Triangles))
+	for i := range n.Triangles {
+		ids[i] = uint32(n.Triangles[i].id - 1)
+	}
+	e.write(uint32(len(ids)))
+	e.write(ids)
+	e.node(n.Left)
+	e.node(n.Right)
+}
+
+func (d *rlbDecoder) triangles() []Triangle {
+	n := d.count()
+	var triangles []Triangle
+	perChunk := rlbChunk / kdTriangleFloats
+	values := make([]float64, perChunk*kdTriangleFloats)
+	for d.err == nil && len(triangles) < n {
+		count := n - len(triangles)
+		if count > perChunk {
+			count = perChunk
+		}
+		chunk := values[:count*kdTriangleFloats]
+		d.read(chunk)
+		for i := 0; i+kdTriangleFloats <= len(chunk); i += kdTriangleFloats {
+			v := chunk[i:]
+			triangles = append(triangles, Triangle{
+				id: int64(len(triangles) + 1),
+				P1: Vector{v[0], v[1], v[2], v[3]},
+				P2: Vector{v[4], v[5], v[6], v[7]},
+				P3: Vector{v[8], v[9], v[10], v[11]},
+			})
+		}
+	}
+	if d.err != nil {
+		return nil
+	}
+
+	flags := make([]uint8, n)
+	d.read(flags)
+	for i := range triangles {
+		if flags[i]&kdTriangleSmooth != 0 {
+			triangles[i].normals = &[9]float32{}
+		}
+		if flags[i]&kdTriangleColors != 0 {
+			triangles[i].colors = &[12]float32{}
+		}
+		if flags[i]&kdTriangleTexCoords != 0 {
+			triangles[i].texCoords = &[6]float32{}
+		}
+	}
+	for _, attribute := range kdTriangleAttributes {
+		d.attributes(triangles, attribute.size, attribute.values)
+	}
+	if d.err != nil {
+		return nil
+	}
+	return triangles
+}
+
+// attributes read into the values of the triangles that have them.
+func (d *rlbDecoder) attributes(triangles []Triangle, size int, values func(t *Triangle) []float32) {
+	perChunk := rlbChunk / size
+	chunk := make([]float32, 0, perChunk*size)
+	next := 0
+	for i := range triangles {
+		if values(&triangles[i]) == nil {
+			continue
+		}
+		if next == len(chunk) {
+			remaining := 0
+			for j := i; j < len(triangles) && remaining < perChunk; j++ {
+				if values(&triangles[j]) != nil {
+					remaining++
+				}
+			}
+			chunk = chunk[:remaining*size]
+			d.read(chunk)
+			if d.err != nil {
+				return
+			}
+			next = 0
+		}
+		copy(values(&triangles[i]), chunk[next:next+size])
+		next += size
+	}
+}
+
+// node copies the triangles of leaves like generateNode does.
+func (d *rlbDecoder) node(triangles []Triangle) *Node {
+	var present uint8
+	d.read(&present)
+	if d.err != nil || present == 0 {
+		return nil
+	}
+	n := &Node{}
+	var hasBox uint8
+	d.read(&hasBox)
+	if hasBox != 0 {
+		n.BoundingBox = &BoundingBox{}
+		d.read(n.BoundingBox)
+	}
+	var count, depth uint32
+	d.read(&count)
+	d.read(&depth)
+	n.TriangleCount = int(count)
+	n.depth = int(depth)
+	leaves := d.count()
+	if d.err == nil && leaves > len(triangles) {
+		d.err = fmt.Errorf("node with %d of %d triangles", leaves, len(triangles))
+	}
+	if d.err != nil {
+		return nil
+	}
+	ids := make([]uint32, leaves)
+	d.read(ids)
+	if d.err != nil {
+		return nil
+	}
+	if leaves > 0 {
+		n.Triangles = make([]Triangle, leaves)
+	}
+	for i, id := range ids {
+		if int(id) >= len(triangles) {
+			d.err = fmt.Errorf("triangle %d out of %d", id, len(triangles))
+			return nil
+		}
+		n.Triangles[i] = triangles[id]
+	}
+	n.Left = d.node(triangles)
+	n.Right = d.node(triangles)
+	return n
+}
+
+func (e *rlbEncoder) bvh(h *bvh) {
+	e.write(uint32(len(h.nodes)))
+	for i := 0; i < len(h.nodes); i += rlbChunk {
+		e.write(h.nodes[i : i+chunkSize(len(h.nodes)-i)])
+	}
+	e.write(uint32(len(h.indices)))
+	e.write(h.indices)
+}
+
+// bvh read back and checked against the number of triangles.
+func (d *rlbDecoder) bvh(triangles int) *bvh {
+	h := &bvh{}
+	n := d.count()
+	for d.err == nil && len(h.nodes) < n {
+		chunk := make([]bvhNode, chunkSize(n-len(h.nodes)))
+		d.read(chunk)
+		h.nodes = append(h.nodes, chunk...)
+	}
+	indices := d.count()
+	if d.err == nil && indices != triangles {
+		d.err = fmt.Errorf("BVH with %d of %d triangles", indices, triangles)
+	}
+	if d.err != nil {
+		return nil
+	}
+	h.indices = make([]uint32, indices)
+	d.read(h.indices)
+	if d.err != nil {
+		return nil
+	}
+	for i := range h.indices {
+		if int(h.indices[i]) >= triangles {
+			d.err = fmt.Errorf("triangle %d out of %d", h.indices[i], triangles)
+			return nil
+		}
+	}
+	for i := range h.nodes {
+		node := &h.nodes[i]
+		if (node.Count > 0 && int(node.Offset)+int(node.Count) > len(h.indices)) ||
+			(node.Count == 0 && (int(node.Offset) >= len(h.nodes) || int(node.Offset) <= i+1)) {
+			d.err = fmt.Errorf("BVH node %d out of range", i)
+			return nil
+		}
+	}
+	return h
+}
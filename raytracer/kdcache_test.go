@@ -0,0 +1,117 @@
+package raytracer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// cachedScene with a smooth height field and a flat face, its objects are
+// prepared with the cache of filename. Returns whether the cache was used.
+func cachedScene(accelerator, filename string, side int) (*Scene, bool) {
+	r := NewRenderer()
+	r.Config = DEFAULT
+	r.Config.Accelerator = accelerator
+	r.Config.KDTreeCache = true
+	s := NewScene(SceneOptions{})
+	s.InputFilename = filename
+	obj := heightField(side)
+	a := obj.AddVertex(Vector{0, 0, 1, 1}, Vector{0, 0, 1, 0}, Vector{})
+	b := obj.AddVertex(Vector{1, 0, 1, 1}, Vector{0, 0, 1, 0}, Vector{})
+	c := obj.AddVertex(Vector{0, 1, 1, 1}, Vector{0, 0, 1, 0}, Vector{})
+	obj.Colors = append(obj.Colors, Vector{1, 1, 1, 1}, Vector{1, 1, 1, 1}, Vector{1, 1, 1, 1})
+	_ = obj.AddFace("ground", a, b, c, false)
+	_ = s.AddObject("field", obj)
+	s.renderer = r
+	return s, s.prepareObjects()
+}
+
+// sameHits of rays cast down on the master objects of both scenes.
+func sameHits(t *testing.T, got, want *Scene) {
+	t.Helper()
+	down := Vector{0, 0, -1, 0}
+	for x := 0.05; x < 1; x += 0.1 {
+		for y := 0.05; y < 1; y += 0.1 {
+			start := Vector{x, y, 2, 1}
+			g := raycastObjectIntersect(got.MasterObject, &start, &down)
+			w := raycastObjectIntersect(want.MasterObject, &start, &down)
+			if g.Hit != w.Hit || g.Dist != w.Dist || g.id() != w.id() ||
+				g.IntersectionNormal != w.IntersectionNormal || g.getTexCoords() != w.getTexCoords() ||
+				g.Triangle.Material.Color != w.Triangle.Material.Color {
+				t.Fatalf("ray at %v, %v hits %+v, want %+v", x, y, g, w)
+			}
+		}
+	}
+}
+
+func TestKDCache(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, filename string)
+		side   int
+		cached bool
+	}{
+		{"up to date", func(*testing.T, string) {}, 6, true},
+		{"other geometry", func(*testing.T, string) {}, 5, false},
+		{"checksum mismatch", func(t *testing.T, filename string) {
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[len(data)/2] ^= 0xff
+			if err := os.WriteFile(filename, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, 6, false},
+		{"truncated", func(t *testing.T, filename string) {
+			info, err := os.Stat(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(filename, info.Size()-10); err != nil {
+				t.Fatal(err)
+			}
+		}, 6, false},
+		{"truncated header", func(t *testing.T, filename string) {
+			if err := os.Truncate(filename, 10); err != nil {
+				t.Fatal(err)
+			}
+		}, 6, false},
+	}
+	for _, accelerator := range []string{AcceleratorKDTree, AcceleratorBVH} {
+		for _, test := range tests {
+			t.Run(accelerator+" "+test.name, func(t *testing.T) {
+				dir := t.TempDir()
+				filename := filepath.Join(dir, "scene.json")
+				if _, cached := cachedScene(accelerator, filename, 6); cached {
+					t.Fatal("cache used before it was saved")
+				}
+				test.damage(t, filename+kdCacheExtension)
+
+				s, cached := cachedScene(accelerator, filename, test.side)
+				if cached != test.cached {
+					t.Fatalf("cache used %v, want %v", cached, test.cached)
+				}
+				built, _ := cachedScene(accelerator, filepath.Join(dir, "other.json"), test.side)
+				sameHits(t, s, built)
+
+				// Caches that can't be used are saved again.
+				if _, cached := cachedScene(accelerator, filename, test.side); !cached {
+					t.Error("cache not used after it was saved again")
+				}
+				files, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+				if len(files) > 0 {
+					t.Errorf("temporary files %v are left", files)
+				}
+			})
+		}
+	}
+
+	t.Run("other accelerator", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "scene.json")
+		cachedScene(AcceleratorKDTree, filename, 6)
+		if _, cached := cachedScene(AcceleratorBVH, filename, 6); cached {
+			t.Error("KD-tree cache used for a BVH")
+		}
+	})
+}
@@ -37,6 +37,15 @@ func (b *BoundingBox) extendVector(v Vector) {
 	b[1][2] = math.Max(b[1][2], v[2])
 }
 
+// pad the box sides by their floating point error, box tests round the
+// rays that go along a side to either side of it.
+func (b *BoundingBox) pad() {
+	for i := 0; i < 3; i++ {
+		b[0][i] -= rayOffset * math.Max(math.Abs(b[0][i]), 1)
+		b[1][i] += rayOffset * math.Max(math.Abs(b[1][i]), 1)
+	}
+}
+
 func (b *BoundingBox) longestAxis() int {
 	result := 0
 	fdiff := 0.0
@@ -93,10 +102,16 @@ func (n *Node) midPoint() Vector {
 	return scaleVector(mid, 1.0/float64(len(n.Triangles)))
 }
 
-func generateNode(tris *[]Triangle, depth int) (result Node) {
-	totalNodes++
-	if depth > maxDepth {
-		maxDepth = depth
+// kdStats counts the nodes of a KD-tree while it is built.
+type kdStats struct {
+	nodes    int
+	maxDepth int
+}
+
+func generateNode(tris *[]Triangle, depth int, stats *kdStats) (result Node) {
+	stats.nodes++
+	if depth > stats.maxDepth {
+		stats.maxDepth = depth
 	}
 	result.Triangles = *tris
 	result.TriangleCount = len(result.Triangles)
@@ -156,8 +171,8 @@ func generateNode(tris *[]Triangle, depth int) (result Node) {
 	}
 
 	if ratio && depth < 50 {
-		leftNode := generateNode(&leftTris, depth+1)
-		rightNode := generateNode(&rightTris, depth+1)
+		leftNode := generateNode(&leftTris, depth+1, stats)
+		rightNode := generateNode(&rightTris, depth+1, stats)
 		result.Left = &leftNode
 		result.Right = &rightNode
 		result.Triangles = nil
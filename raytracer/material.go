@@ -2,24 +2,19 @@ package raytracer
 
 import (
 	"image"
+	"io/fs"
 	"log"
-	"os"
-	"path/filepath"
+	"path"
 	"strings"
 )
 
-// Images map to hold image data in memory for repeating images.
-var Images map[string][][]Vector
-
-// BumpMapNormals cache to hold bump map information in memory.
-var BumpMapNormals map[string][][]Vector
-
 type indice [4]int64
 
 // Material definition.
 type Material struct {
 	Color             Vector   `json:"color"`
 	Texture           string   `json:"texture"`
+	BumpMap           string   `json:"bump_map"`
 	Transmission      float64  `json:"transmission"`
 	IndexOfRefraction float64  `json:"index_of_refraction"`
 	Indices           []indice `json:"indices"`
@@ -27,92 +22,107 @@ type Material struct {
 	Roughness         float64  `json:"roughness"`
 	Light             bool     `json:"light"`
 	LightStrength     float64  `json:"light_strength"`
+	// EmissionColor of a light material, Color if it is not set.
+	EmissionColor Vector `json:"emission_color"`
+
+	// Texture and bump map images, shared with the renderer cache.
+	image   [][]Vector
+	bumpMap [][]Vector
 }
 
-func loadImage(scenePath, texture string) (imageHasAlpha bool) {
-	textureName := texture
-	_, err := os.Stat(texture)
-	if os.IsNotExist(err) {
-		texture = filepath.Join(scenePath, texture)
+// emission of a light material.
+func (m *Material) emission() Vector {
+	return scaleVector(m.lightColor(), m.LightStrength)
+}
+
+// lightColor of a light material.
+func (m *Material) lightColor() Vector {
+	if m.EmissionColor == (Vector{}) {
+		return m.Color
 	}
-	imageFile, err := os.Open(texture)
+	return m.EmissionColor
+}
+
+// loadImage texture, nil if it can't be loaded.
+func loadImage(files fs.FS, texture string) [][]Vector {
+	imageFile, err := files.Open(texture)
 	if err != nil {
 		log.Printf("Material texture [%s] can't be opened\n", texture)
-		imageFile.Close() // defer has over-head
-		return
+		return nil
 	}
+	defer imageFile.Close()
 	src, _, err := image.Decode(imageFile)
 	if err != nil {
 		log.Printf("Error reading image file [%s]: [%s]\n", texture, err.Error())
-		imageFile.Close()
-		return
+		return nil
 	}
 
+	result := imageToVectors(src)
+	imageHasAlpha := false
+	for i := range result {
+		for j := range result[i] {
+			if result[i][j][3] < 1 {
+				imageHasAlpha = true
+			}
+		}
+	}
+	log.Printf("Image %s loaded: Alpha %t", texture, imageHasAlpha)
+	return result
+}
+
+// imageToVectors converts the image to colors in 0-1 range, indexed by x and y.
+func imageToVectors(src image.Image) [][]Vector {
 	imgBounds := src.Bounds().Max
-	Images[textureName] = make([][]Vector, imgBounds.X)
+	result := make([][]Vector, imgBounds.X)
 	for i := 0; i < imgBounds.X; i++ {
-		Images[textureName][i] = make([]Vector, imgBounds.Y)
+		result[i] = make([]Vector, imgBounds.Y)
 		for j := 0; j < imgBounds.Y; j++ {
 			r, g, b, a := src.At(i, j).RGBA()
 			r, g, b, a = r>>8, g>>8, b>>8, a>>8
 
-			result := Vector{
+			result[i][j] = Vector{
 				float64(r) / 255,
 				float64(g) / 255,
 				float64(b) / 255,
 				float64(a) / 255,
 			}
-			if result[3] < 1 {
-				imageHasAlpha = true
-			}
-
-			Images[textureName][i][j] = result
 		}
 	}
-	imageFile.Close()
-
-	log.Printf("Image %s loaded: Alpha %t", texture, imageHasAlpha)
-	return imageHasAlpha
+	return result
 }
 
-func loadBumpMap(scenePath, texture string) {
-	ext := filepath.Ext(texture)
-	base := strings.TrimSuffix(texture, ext)
-	texturePath := filepath.Dir(texture)
-	bumpTexture := filepath.Join(texturePath, base+"_bump"+ext)
-	_, err := os.Stat(bumpTexture)
-	if os.IsNotExist(err) {
-		bumpTexture = filepath.Join(scenePath, bumpTexture)
+// bumpMapFile of the material, <texture>_bump.<ext> next to the texture unless it is set.
+func (m *Material) bumpMapFile() string {
+	if m.BumpMap != "" || m.Texture == "" {
+		return m.BumpMap
 	}
-	imageFile, err := os.Open(bumpTexture)
+	ext := path.Ext(m.Texture)
+	return strings.TrimSuffix(m.Texture, ext) + "_bump" + ext
+}
+
+// loadBumpMap image as normals, nil if there is none.
+func loadBumpMap(files fs.FS, bumpTexture string) [][]Vector {
+	imageFile, err := files.Open(bumpTexture)
 	if err != nil {
-		imageFile.Close() // defer has over-head
-		return
+		return nil
 	}
+	defer imageFile.Close()
 	src, _, err := image.Decode(imageFile)
 	if err != nil {
-		log.Printf("Error reading image file [%s]: [%s]\n", texture, err.Error())
-		imageFile.Close()
-		return
+		log.Printf("Error reading image file [%s]: [%s]\n", bumpTexture, err.Error())
+		return nil
 	}
 	log.Printf("Image Bump Map %s loaded", bumpTexture)
-	imgBounds := src.Bounds().Max
-	BumpMapNormals[texture] = make([][]Vector, imgBounds.X)
-	for i := 0; i < imgBounds.X; i++ {
-		BumpMapNormals[texture][i] = make([]Vector, imgBounds.Y)
-		for j := 0; j < imgBounds.Y; j++ {
-			r, g, b, _ := src.At(i, j).RGBA()
-			r, g, b = r>>8, g>>8, b>>8
-
-			bump := normalizeVector(Vector{
-				(float64(r) / 255),
-				(float64(g) / 255),
-				(float64(b) / 255),
-				1,
-			})
+	return bumpNormals(imageToVectors(src))
+}
 
-			BumpMapNormals[texture][i][j] = normalizeVector(subVector(scaleVector(bump, 2), Vector{1, 1, 1, 0}))
+// bumpNormals of a normal map image, colors are turned to -1..1 normals.
+func bumpNormals(result [][]Vector) [][]Vector {
+	for i := range result {
+		for j := range result[i] {
+			bump := normalizeVector(Vector{result[i][j][0], result[i][j][1], result[i][j][2], 1})
+			result[i][j] = normalizeVector(subVector(scaleVector(bump, 2), Vector{1, 1, 1, 0}))
 		}
 	}
-	imageFile.Close()
+	return result
 }
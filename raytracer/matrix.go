@@ -14,14 +14,8 @@ var identityHmgMatrix = Matrix{
 	Vector{0, 0, 0, 1},
 }
 
-// perspectiveProjection - Create perspective.
-func perspectiveProjection(fovy, aspect, near, far float64) Matrix {
-	ymax := near * math.Tan(fovy*math.Pi/360.0)
-	xmax := ymax * aspect
-	left := -xmax
-	right := xmax
-	bottom := -ymax
-	top := ymax
+// frustumProjection - Create perspective for the given near plane rectangle.
+func frustumProjection(left, right, bottom, top, near, far float64) Matrix {
 	temp := 2.0 * near
 	temp2 := right - left
 	temp3 := top - bottom
@@ -34,6 +28,19 @@ func perspectiveProjection(fovy, aspect, near, far float64) Matrix {
 	}
 }
 
+// orthographicProjection - Create parallel projection for the given view volume.
+func orthographicProjection(left, right, bottom, top, near, far float64) Matrix {
+	width := right - left
+	height := top - bottom
+	depth := far - near
+	return Matrix{
+		Vector{2.0 / width, 0, 0, 0},
+		Vector{0, 2.0 / height, 0, 0},
+		Vector{0, 0, -2.0 / depth, 0},
+		Vector{-(right + left) / width, -(top + bottom) / height, -(far + near) / depth, 1},
+	}
+}
+
 // viewMatrix calculation.
 func viewMatrix(eye, target, up Vector) Matrix {
 	forward := normalizeVector(subVector(target, eye))
@@ -153,3 +160,20 @@ func multiplyMatrix(m1, m2 Matrix) Matrix {
 	result[3][3] = m1[3][0]*m2[0][3] + m1[3][1]*m2[1][3] + m1[3][2]*m2[2][3] + m1[3][3]*m2[3][3]
 	return result
 }
+
+// transposeMatrix calculation.
+func transposeMatrix(m Matrix) Matrix {
+	var result Matrix
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			result[i][j] = m[j][i]
+		}
+	}
+	return result
+}
+
+// normalMatrix transforms the normals of the vertices transformed by m,
+// the inverse transpose keeps them perpendicular under non uniform scaling.
+func normalMatrix(m Matrix) Matrix {
+	return transposeMatrix(invertMatrix(m))
+}
@@ -0,0 +1,87 @@
+package raytracer
+
+import (
+	"math"
+	"runtime"
+	"testing"
+)
+
+// benchTriangles of the generated scene, about the size of a detailed model.
+const benchTriangles = 1000000
+
+// BenchmarkTriangleMemory prepares a generated scene with each accelerator and
+// reports the heap the prepared scene keeps, triangles and the tree.
+//
+//	go test -run - -bench TriangleMemory -benchtime 1x ./raytracer
+func BenchmarkTriangleMemory(b *testing.B) {
+	triangles := benchTriangles
+	if testing.Short() {
+		triangles /= 10
+	}
+	side := int(math.Ceil(math.Sqrt(float64(triangles) / 2)))
+	for _, accelerator := range []string{AcceleratorKDTree, AcceleratorBVH} {
+		b.Run(accelerator, func(b *testing.B) {
+			r := NewRenderer()
+			r.Config.Accelerator = accelerator
+			// The sample cache belongs to the renderer, not to the scene.
+			r.createCache()
+			var heap uint64
+			count := 0
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				runtime.GC()
+				before := heapAlloc()
+				s := NewScene(SceneOptions{})
+				_ = s.AddObject("grid", heightField(side))
+				b.StartTimer()
+				r.prepare(s, 1, 1)
+				b.StopTimer()
+				runtime.GC()
+				if after := heapAlloc(); after > before {
+					heap = after - before
+				}
+				count = len(s.MasterObject.Triangles)
+				runtime.KeepAlive(s)
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(heap)/(1<<20), "MiB")
+			if count > 0 {
+				b.ReportMetric(float64(heap)/float64(count), "B/triangle")
+			}
+		})
+	}
+}
+
+// heightField of side x side quads in a unit square, smooth, textured and
+// with vertex colors, so all triangle attributes are there.
+func heightField(side int) *Object {
+	obj := NewObject()
+	obj.Materials["ground"] = Material{Color: Vector{0.5, 0.5, 0.5, 1}}
+	step := 1.0 / float64(side)
+	for y := 0; y <= side; y++ {
+		for x := 0; x <= side; x++ {
+			u, v := float64(x)*step, float64(y)*step
+			z := 0.05 * math.Sin(u*20) * math.Cos(v*20)
+			normal := normalizeVector(Vector{-math.Cos(u*20) * math.Cos(v*20), math.Sin(u*20) * math.Sin(v*20), 1, 0})
+			obj.AddVertex(Vector{u, v, z, 1}, normal, Vector{u, v, 0, 0})
+			obj.Colors = append(obj.Colors, Vector{u, v, 1, 1})
+		}
+	}
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			a := int64(y*(side+1) + x)
+			b := a + 1
+			c := a + int64(side+1)
+			d := c + 1
+			_ = obj.AddFace("ground", a, b, d, true)
+			_ = obj.AddFace("ground", a, d, c, true)
+		}
+	}
+	return obj
+}
+
+func heapAlloc() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
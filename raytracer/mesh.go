@@ -0,0 +1,79 @@
+package raytracer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"strings"
+)
+
+// ErrUnknownMeshFormat is returned when a mesh file extension has no loader.
+var ErrUnknownMeshFormat = errors.New("unknown mesh format")
+
+// meshLoaders by lowercase file extension, each returns the objects in the file by name.
+var meshLoaders = map[string]func(files fs.FS, name string) (map[string]*Object, error){
+	".obj":  loadOBJ,
+	".gltf": loadGLTFMesh,
+	".glb":  loadGLTFMesh,
+	".ply":  loadPLY,
+	".stl":  loadSTL,
+}
+
+// LoadMesh objects from a mesh file in one of the supported formats, by file
+// extension. Textures of the mesh materials are relative to files too.
+// Returned objects are ready to be added to a scene, they are converted to the
+// Z up axes of the scene when the format is Y up.
+func LoadMesh(files fs.FS, name string) (map[string]*Object, error) {
+	loader, ok := meshLoaders[strings.ToLower(path.Ext(name))]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMeshFormat, name)
+	}
+	log.Printf("Loading mesh %s", name)
+	objects, err := loader(files, name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return objects, nil
+}
+
+// loadMeshes of the scene objects and shared meshes referencing mesh files,
+// the mesh objects become children of the referencing object, so they follow
+// its matrix.
+func (s *Scene) loadMeshes() error {
+	if err := loadObjectMeshes(s.fileSystem(), s.Objects); err != nil {
+		return err
+	}
+	return loadObjectMeshes(s.fileSystem(), s.Meshes)
+}
+
+func loadObjectMeshes(files fs.FS, objects map[string]*Object) error {
+	for _, obj := range objects {
+		if err := loadObjectMeshes(files, obj.Children); err != nil {
+			return err
+		}
+		if obj.Mesh == "" {
+			continue
+		}
+		meshes, err := LoadMesh(files, obj.Mesh)
+		if err != nil {
+			return err
+		}
+		if obj.Children == nil {
+			obj.Children = make(map[string]*Object)
+		}
+		for name, mesh := range meshes {
+			obj.Children[name] = mesh
+		}
+		if obj.Matrix == (Matrix{}) {
+			obj.Matrix = identityHmgMatrix
+		}
+	}
+	return nil
+}
+
+// yUpToZUp converts a vector from Y up axes, forward being -Z, to the scene axes.
+func yUpToZUp(v Vector) Vector {
+	return Vector{v[0], -v[2], v[1], v[3]}
+}
@@ -0,0 +1,384 @@
+package raytracer
+
+/*
+Wavefront OBJ importer. Every "o" (or "g" when there are no objects) becomes
+an object, "usemtl" picks the material of the following faces from the
+"mtllib" material libraries. Polygons are split into triangle fans.
+OBJ files are Y up, vertices and normals are converted to the Z up scene axes.
+Faces without normals get the flat face normal.
+Materials only reflect with the ray traced illumination models (illum 3 to 7),
+as much as their brightest Ks channel. Ns is the roughness of the reflection,
+Ke is the light color and strength, Kd stays the surface color.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const objDefaultMaterial = "default"
+
+// objVertex is a face corner, indices to positions, texture coordinates and
+// normals; -1 if the face has none.
+type objVertex [3]int
+
+type objReader struct {
+	files     fs.FS
+	dir       string
+	positions []Vector
+	texCoords []Vector
+	normals   []Vector
+	library   map[string]Material
+	objects   map[string]*Object
+	// Object vertex of each face corner seen, per object.
+	indices  map[*Object]map[objVertex]int64
+	current  *Object
+	name     string
+	material string
+	smooth   bool
+	// Groups name the objects only when the file has no objects.
+	named bool
+}
+
+func loadOBJ(files fs.FS, name string) (map[string]*Object, error) {
+	f, err := files.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &objReader{
+		files:    files,
+		dir:      path.Dir(name),
+		library:  make(map[string]Material),
+		objects:  make(map[string]*Object),
+		indices:  make(map[*Object]map[objVertex]int64),
+		name:     strings.TrimSuffix(path.Base(name), path.Ext(name)),
+		material: objDefaultMaterial,
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if err := r.parseLine(scanner.Text()); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return r.objects, nil
+}
+
+func (r *objReader) parseLine(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return nil
+	}
+	args := fields[1:]
+	switch fields[0] {
+	case "v":
+		v, err := parseFloats(args, 3)
+		if err != nil {
+			return err
+		}
+		r.positions = append(r.positions, yUpToZUp(Vector{v[0], v[1], v[2], 1}))
+	case "vt":
+		v, err := parseFloats(args, 2)
+		if err != nil {
+			return err
+		}
+		r.texCoords = append(r.texCoords, Vector{v[0], v[1], 0, 0})
+	case "vn":
+		v, err := parseFloats(args, 3)
+		if err != nil {
+			return err
+		}
+		r.normals = append(r.normals, normalizeVector(yUpToZUp(Vector{v[0], v[1], v[2], 0})))
+	case "f":
+		return r.parseFace(args)
+	case "o":
+		r.name = strings.Join(args, " ")
+		r.current = nil
+		r.named = true
+	case "g":
+		if !r.named {
+			r.name = strings.Join(args, " ")
+			r.current = nil
+		}
+	case "usemtl":
+		r.material = strings.Join(args, " ")
+	case "s":
+		r.smooth = len(args) > 0 && args[0] != "off" && args[0] != "0"
+	case "mtllib":
+		for _, lib := range args {
+			if err := r.loadMTL(path.Join(r.dir, lib)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// object the faces are added to, created with the first face.
+func (r *objReader) object() *Object {
+	if r.current != nil {
+		return r.current
+	}
+	if obj, ok := r.objects[r.name]; ok {
+		r.current = obj
+		return obj
+	}
+	obj := NewObject()
+	r.objects[r.name] = obj
+	r.indices[obj] = make(map[objVertex]int64)
+	r.current = obj
+	return obj
+}
+
+func (r *objReader) parseFace(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("face with %d vertices", len(args))
+	}
+	corners := make([]objVertex, len(args))
+	hasNormals := true
+	for i, arg := range args {
+		c, err := r.parseCorner(arg)
+		if err != nil {
+			return err
+		}
+		corners[i] = c
+		hasNormals = hasNormals && c[2] >= 0
+	}
+
+	obj := r.object()
+	if _, ok := obj.Materials[r.material]; !ok {
+		mat, ok := r.library[r.material]
+		if !ok {
+			mat = Material{Color: Vector{1, 1, 1, 1}}
+		}
+		obj.Materials[r.material] = mat
+	}
+	var faceNormal Vector
+	if !hasNormals {
+		p1, p2, p3 := r.positions[corners[0][0]], r.positions[corners[1][0]], r.positions[corners[2][0]]
+		faceNormal = normalizeVector(crossProduct(subVector(p2, p1), subVector(p3, p1)))
+		faceNormal[3] = 0
+	}
+	for i := 1; i+1 < len(corners); i++ {
+		a := r.vertex(obj, corners[0], hasNormals, faceNormal)
+		b := r.vertex(obj, corners[i], hasNormals, faceNormal)
+		c := r.vertex(obj, corners[i+1], hasNormals, faceNormal)
+		if err := obj.AddFace(r.material, a, b, c, r.smooth && hasNormals); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vertex of the object for the face corner, shared between the faces using
+// the same corner unless the normal comes from the face.
+func (r *objReader) vertex(obj *Object, c objVertex, hasNormals bool, faceNormal Vector) int64 {
+	if hasNormals {
+		if index, ok := r.indices[obj][c]; ok {
+			return index
+		}
+	}
+	texCoord := Vector{}
+	if c[1] >= 0 {
+		texCoord = r.texCoords[c[1]]
+	}
+	normal := faceNormal
+	if hasNormals {
+		normal = r.normals[c[2]]
+	}
+	index := obj.AddVertex(r.positions[c[0]], normal, texCoord)
+	if hasNormals {
+		r.indices[obj][c] = index
+	}
+	return index
+}
+
+// parseCorner of a face in v, v/vt, v//vn or v/vt/vn form.
+func (r *objReader) parseCorner(arg string) (objVertex, error) {
+	c := objVertex{-1, -1, -1}
+	counts := [3]int{len(r.positions), len(r.texCoords), len(r.normals)}
+	for i, part := range strings.SplitN(arg, "/", 3) {
+		if part == "" {
+			if i == 0 {
+				return c, fmt.Errorf("face vertex %q without position", arg)
+			}
+			continue
+		}
+		index, err := strconv.Atoi(part)
+		if err != nil {
+			return c, err
+		}
+		// Negative indices count back from the last one read.
+		if index < 0 {
+			index += counts[i]
+		} else {
+			index--
+		}
+		if index < 0 || index >= counts[i] {
+			return c, fmt.Errorf("face vertex %q out of range", arg)
+		}
+		c[i] = index
+	}
+	return c, nil
+}
+
+// loadMTL material library, textures are relative to the library.
+func (r *objReader) loadMTL(name string) error {
+	f, err := r.files.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dir := path.Dir(name)
+	var mat *mtlMaterial
+	var matName string
+	save := func() {
+		if mat != nil {
+			r.library[matName] = mat.material()
+		}
+	}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		args := fields[1:]
+		if fields[0] == "newmtl" {
+			save()
+			matName = strings.Join(args, " ")
+			mat = &mtlMaterial{Material: Material{Color: Vector{1, 1, 1, 1}}}
+			continue
+		}
+		if mat == nil {
+			continue
+		}
+		if err := r.parseMaterial(mat, dir, fields[0], args); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+	}
+	save()
+	return scanner.Err()
+}
+
+// mtlMaterial while its statements are read, the specular color and the
+// illumination model decide together if it reflects.
+type mtlMaterial struct {
+	Material
+	specular float64
+	illum    int
+}
+
+// material with the reflection of the illumination models that ray trace it.
+func (m *mtlMaterial) material() Material {
+	if m.illum >= 3 && m.illum <= 7 {
+		m.Glossiness = m.specular
+	}
+	return m.Material
+}
+
+// parseMaterial statement of a library in dir.
+func (r *objReader) parseMaterial(mat *mtlMaterial, dir, key string, args []string) error {
+	switch key {
+	case "Kd":
+		v, err := parseFloats(args, 3)
+		if err != nil {
+			return err
+		}
+		mat.Color = Vector{v[0], v[1], v[2], 1}
+	case "map_Kd":
+		mat.Texture = mapFile(dir, args)
+	case "bump", "map_Bump", "map_bump":
+		mat.BumpMap = mapFile(dir, args)
+	case "Ni":
+		v, err := parseFloats(args, 1)
+		if err != nil {
+			return err
+		}
+		mat.IndexOfRefraction = v[0]
+	case "d":
+		v, err := parseFloats(args, 1)
+		if err != nil {
+			return err
+		}
+		mat.Transmission = 1 - v[0]
+	case "Tr":
+		v, err := parseFloats(args, 1)
+		if err != nil {
+			return err
+		}
+		mat.Transmission = v[0]
+	case "Ns":
+		// Specular exponent up to 1000, mapped back to roughness the way
+		// Blender writes it.
+		v, err := parseFloats(args, 1)
+		if err != nil {
+			return err
+		}
+		mat.Roughness = 1 - math.Sqrt(math.Min(math.Max(v[0]/1000, 0), 1))
+	case "Ks":
+		v, err := parseFloats(args, 3)
+		if err != nil {
+			return err
+		}
+		mat.specular = math.Max(v[0], math.Max(v[1], v[2]))
+	case "illum":
+		v, err := parseFloats(args, 1)
+		if err != nil {
+			return err
+		}
+		mat.illum = int(v[0])
+	case "Ke":
+		// Emission is color times strength, strength is the brightest channel.
+		v, err := parseFloats(args, 3)
+		if err != nil {
+			return err
+		}
+		strength := math.Max(v[0], math.Max(v[1], v[2]))
+		if strength > 0 {
+			mat.Light = true
+			mat.LightStrength = strength
+			mat.EmissionColor = Vector{v[0] / strength, v[1] / strength, v[2] / strength, 1}
+		}
+	}
+	return nil
+}
+
+// mapFile is the file of a texture map statement, the last argument after
+// the options, relative to the directory of the material library.
+func mapFile(dir string, args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	file := strings.ReplaceAll(args[len(args)-1], "\\", "/")
+	if path.IsAbs(file) {
+		return file
+	}
+	return path.Join(dir, file)
+}
+
+func parseFloats(args []string, count int) ([]float64, error) {
+	if len(args) < count {
+		return nil, fmt.Errorf("expected %d values, got %d", count, len(args))
+	}
+	result := make([]float64, count)
+	for i := 0; i < count; i++ {
+		v, err := strconv.ParseFloat(args[i], 64)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = v
+	}
+	return result, nil
+}
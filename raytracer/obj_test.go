@@ -0,0 +1,193 @@
+package raytracer
+
+import (
+	"math"
+	"testing"
+	"testing/fstest"
+)
+
+// meshSize of a loaded object, vertices and triangles of all materials.
+type meshSize struct {
+	vertices  int
+	triangles int
+}
+
+func meshSizes(objects map[string]*Object) map[string]meshSize {
+	sizes := make(map[string]meshSize)
+	for name, obj := range objects {
+		size := meshSize{vertices: len(obj.Vertices)}
+		for _, mat := range obj.Materials {
+			size.triangles += len(mat.Indices)
+		}
+		sizes[name] = size
+	}
+	return sizes
+}
+
+func sameSizes(a, b map[string]meshSize) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, size := range a {
+		if b[name] != size {
+			return false
+		}
+	}
+	return true
+}
+
+const objQuad = `v 0 0 0
+v 1 0 0
+v 1 1 0
+v 0 1 0
+`
+
+func TestLoadOBJ(t *testing.T) {
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+		sizes map[string]meshSize
+		check func(t *testing.T, objects map[string]*Object)
+	}{
+		{
+			name:  "groups name the objects",
+			files: fstest.MapFS{"m.obj": {Data: []byte(objQuad + "g a\nf 1 2 3\ng b\nf 1 3 4\n")}},
+			sizes: map[string]meshSize{"a": {3, 1}, "b": {3, 1}},
+		},
+		{
+			name:  "objects over groups",
+			files: fstest.MapFS{"m.obj": {Data: []byte(objQuad + "o box\ng a\nf 1 2 3\ng b\nf 1 3 4\n")}},
+			sizes: map[string]meshSize{"box": {6, 2}},
+		},
+		{
+			name:  "unnamed is the file name",
+			files: fstest.MapFS{"dir/m.obj": {Data: []byte(objQuad + "f 1 2 3 4\n")}},
+			sizes: map[string]meshSize{"m": {6, 2}},
+			check: func(t *testing.T, objects map[string]*Object) {
+				// Y up to Z up, faces without normals get the face normal.
+				if got := objects["m"].Vertices[2]; got != (Vector{1, 0, 1, 1}) {
+					t.Errorf("vertex %v, want {1 0 1 1}", got)
+				}
+				if got := objects["m"].Normals[0]; got != (Vector{0, -1, 0, 0}) {
+					t.Errorf("face normal %v, want {0 -1 0 0}", got)
+				}
+			},
+		},
+		{
+			name: "corners with normals are shared",
+			files: fstest.MapFS{"m.obj": {Data: []byte(objQuad + `vt 0 0
+vt 1 1
+vn 0 0 1
+s 1
+f 1/1/1 2/1/1 3/2/1 -1/2/-1
+`)}},
+			sizes: map[string]meshSize{"m": {4, 2}},
+			check: func(t *testing.T, objects map[string]*Object) {
+				mat := objects["m"].Materials[objDefaultMaterial]
+				if mat.Indices[0][3] != 1 {
+					t.Error("smooth face is flat")
+				}
+				if got := objects["m"].TexCoords[2]; got != (Vector{1, 1, 0, 0}) {
+					t.Errorf("texture coordinates %v, want {1 1 0 0}", got)
+				}
+			},
+		},
+		{
+			name: "materials",
+			files: fstest.MapFS{
+				"m.obj": {Data: []byte("mtllib lib/m.mtl\n" + objQuad + `usemtl mirror
+f 1 2 3
+usemtl plastic
+f 1 3 4
+usemtl lamp
+f 1 2 4
+usemtl glass
+f 2 3 4
+`)},
+				"lib/m.mtl": {Data: []byte(`newmtl mirror
+Kd 0.5 0.5 0.5
+Ks 0.8 0.2 0.2
+Ns 1000
+illum 3
+newmtl plastic
+Ks 1 1 1
+Ns 250
+illum 2
+map_Kd -s 2 2 1 tex\wood.png
+newmtl lamp
+Kd 0.2 0.2 0.2
+Ke 4 2 0
+newmtl glass
+d 0.25
+Ni 1.5
+`)},
+			},
+			sizes: map[string]meshSize{"m": {12, 4}},
+			check: func(t *testing.T, objects map[string]*Object) {
+				mats := objects["m"].Materials
+				if m := mats["mirror"]; m.Glossiness != 0.8 || m.Roughness != 0 || m.Color != (Vector{0.5, 0.5, 0.5, 1}) {
+					t.Errorf("mirror %+v", m)
+				}
+				if m := mats["plastic"]; m.Glossiness != 0 || math.Abs(m.Roughness-0.5) > 1e-9 || m.Texture != "lib/tex/wood.png" {
+					t.Errorf("plastic %+v", m)
+				}
+				if m := mats["lamp"]; !m.Light || m.LightStrength != 4 || m.EmissionColor != (Vector{1, 0.5, 0, 1}) || m.Color != (Vector{0.2, 0.2, 0.2, 1}) {
+					t.Errorf("lamp %+v", m)
+				}
+				if m := mats["glass"]; m.Transmission != 0.75 || m.IndexOfRefraction != 1.5 {
+					t.Errorf("glass %+v", m)
+				}
+			},
+		},
+		{
+			name:  "unknown material",
+			files: fstest.MapFS{"m.obj": {Data: []byte(objQuad + "usemtl missing\nf 1 2 3\n")}},
+			sizes: map[string]meshSize{"m": {3, 1}},
+			check: func(t *testing.T, objects map[string]*Object) {
+				if got := objects["m"].Materials["missing"].Color; got != (Vector{1, 1, 1, 1}) {
+					t.Errorf("color %v, want white", got)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := "m.obj"
+			if _, ok := test.files[name]; !ok {
+				name = "dir/m.obj"
+			}
+			objects, err := LoadMesh(test.files, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := meshSizes(objects); !sameSizes(got, test.sizes) {
+				t.Fatalf("sizes %v, want %v", got, test.sizes)
+			}
+			if test.check != nil {
+				test.check(t, objects)
+			}
+		})
+	}
+}
+
+func TestLoadOBJErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"face out of range", objQuad + "f 1 2 5\n"},
+		{"face without position", objQuad + "f 1 /1 3\n"},
+		{"two vertex face", objQuad + "f 1 2\n"},
+		{"bad number", "v 0 x 0\n"},
+		{"short vertex", "v 0 0\n"},
+		{"missing library", "mtllib none.mtl\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files := fstest.MapFS{"m.obj": {Data: []byte(test.data)}}
+			if _, err := LoadMesh(files, "m.obj"); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
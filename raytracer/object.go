@@ -1,48 +1,57 @@
 package raytracer
 
-import "log"
-
-var totalNodes = 0
-var maxDepth = 0
-var idCounter int64 = 0
+import (
+	"log"
+	"sort"
+	"time"
+)
 
 // Object definition.
+// Mesh is a mesh file to load the object geometry from, see LoadMesh.
+// Colors are optional RGBA vertex colors, multiplied with the material color.
+// Instance is the name of a shared mesh in the scene Meshes, the object is
+// then only an instance of it placed with Matrix, its own geometry is not used.
 type Object struct {
+	Mesh      string              `json:"mesh"`
+	Instance  string              `json:"instance"`
 	Vertices  []Vector            `json:"vertices"`
 	Normals   []Vector            `json:"normals"`
 	TexCoords []Vector            `json:"texcoords"`
+	Colors    []Vector            `json:"colors"`
 	Matrix    Matrix              `json:"matrix"`
 	Materials map[string]Material `json:"materials"`
 	Children  map[string]*Object  `json:"children"`
 	Triangles []Triangle
 	Root      Node
-	radius    float64
+	// BVH over the triangles, nil when the KDTree Root is used.
+	bvh    *bvh
+	radius float64
 }
 
 // UnifyTriangles of the object for faster processing.
 func (o *Object) UnifyTriangles() {
-	for matName := range o.Materials {
+	for _, matName := range o.materialNames() {
+		// Triangles refer to one copy of the material, without its faces.
+		material := o.Materials[matName]
+		material.Indices = nil
 		for indice := range o.Materials[matName].Indices {
 			triangle := Triangle{}
-			triangle.id = idCounter + 1
-			idCounter++
 			face := o.Materials[matName].Indices[indice]
 			triangle.P1 = o.Vertices[face[0]]
 			triangle.P2 = o.Vertices[face[1]]
 			triangle.P3 = o.Vertices[face[2]]
 
 			if len(o.TexCoords) > 0 {
-				triangle.T1 = o.TexCoords[face[0]]
-				triangle.T2 = o.TexCoords[face[1]]
-				triangle.T3 = o.TexCoords[face[2]]
+				triangle.setTexCoords(o.TexCoords[face[0]], o.TexCoords[face[1]], o.TexCoords[face[2]])
 			}
 
-			triangle.N1 = o.Normals[face[0]]
-			triangle.N2 = o.Normals[face[1]]
-			triangle.N3 = o.Normals[face[2]]
+			triangle.setNormals(o.Normals[face[0]], o.Normals[face[1]], o.Normals[face[2]], face[3] == 1)
+
+			if len(o.Colors) > 0 {
+				triangle.setColors(o.Colors[face[0]], o.Colors[face[1]], o.Colors[face[2]])
+			}
 
-			triangle.Smooth = face[3] == 1
-			triangle.Material = o.Materials[matName]
+			triangle.Material = &material
 			o.Triangles = append(o.Triangles, triangle)
 		}
 	}
@@ -50,11 +59,39 @@ func (o *Object) UnifyTriangles() {
 	o.Vertices = nil
 	o.Normals = nil
 	o.TexCoords = nil
+	o.Colors = nil
+}
+
+// toAbsolute transforms the vertices and normals with the object matrix.
+func (o *Object) toAbsolute() {
+	absoluteVertices := localToAbsoluteList(o.Vertices, o.Matrix)
+	for i := 0; i < len(absoluteVertices); i++ {
+		o.Vertices[i] = absoluteVertices[i]
+	}
+	normals := normalMatrix(o.Matrix)
+	for i := range o.Normals {
+		n := vectorTransform(o.Normals[i], normals)
+		n[3] = 0
+		o.Normals[i] = normalizeVector(n)
+	}
+}
+
+// materialNames in sorted order, triangles are unified in this order.
+func (o *Object) materialNames() []string {
+	names := make([]string, 0, len(o.Materials))
+	for name := range o.Materials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // KDTree Building.
 func (o *Object) KDTree() {
-	o.Root = generateNode(&o.Triangles, 0)
+	start := time.Now()
+	stats := kdStats{}
+	o.Root = generateNode(&o.Triangles, 0, &stats)
+	log.Printf("Built %d nodes with %d max depth in %f seconds", stats.nodes, stats.maxDepth, time.Since(start).Seconds())
 }
 
 func (o *Object) fixW() {
@@ -0,0 +1,204 @@
+package raytracer
+
+/*
+Monte Carlo path tracing integrator.
+Unlike the preview renderer, light bounces around the scene instead of being
+faked with ambient occlusion and ambient colors. It is slow but unbiased.
+*/
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Integrators to choose from in config.
+const (
+	IntegratorPreview = "preview"
+	IntegratorPath    = "path"
+)
+
+// Paths shorter than this are never terminated by russian roulette.
+const rouletteDepth = 3
+
+// shade the camera ray hit with the configured integrator.
+func shade(scene *Scene, hit *Intersection) Vector {
+	if scene.renderer.Config.Integrator == IntegratorPath {
+		return pathTrace(scene, hit, scene.renderer.Config.PathSamples)
+	}
+	return hit.render(scene, 0)
+}
+
+// pathTrace averages the given number of paths starting at the camera ray hit.
+func pathTrace(scene *Scene, hit *Intersection, samples int) Vector {
+	if !hit.Hit {
+		return hit.render(scene, 0)
+	}
+	if samples < 1 {
+		samples = 1
+	}
+	total := Vector{}
+	for i := 0; i < samples; i++ {
+		total = addVector(total, tracePath(scene, *hit))
+	}
+	result := scaleVector(total, scene.renderer.Config.Exposure/float64(samples))
+	result[3] = 1
+	return result
+}
+
+// tracePath follows a single path and returns the radiance it carries back.
+func tracePath(scene *Scene, hit Intersection) (radiance Vector) {
+	throughput := Vector{1, 1, 1, 0}
+	// Emission is only counted when light wasn't sampled directly at the previous bounce.
+	countEmission := true
+
+	for depth := 0; ; depth++ {
+		if !hit.Hit {
+			if scene.renderer.environmentMap != nil {
+				radiance = addVector(radiance, multiplyVector(throughput, hit.render(scene, 0)))
+			}
+			return
+		}
+		material := hit.Triangle.Material
+		if material.Light {
+			if countEmission {
+				radiance = addVector(radiance, multiplyVector(throughput, material.emission()))
+			}
+			return
+		}
+		if depth >= scene.renderer.Config.PathMaxDepth {
+			return
+		}
+
+		normal := hit.IntersectionNormal
+		if dot(normal, hit.RayDir) > 0 {
+			normal = scaleVector(normal, -1)
+		}
+		color := hit.getColor(scene)
+
+		var dir Vector
+		choice := rand.Float64()
+		switch {
+		case choice < material.Glossiness:
+			dir = glossyDirection(reflectVector(hit.RayDir, normal), normal, material.Roughness)
+			countEmission = true
+		case choice < material.Glossiness+(1-material.Glossiness)*material.Transmission:
+			dir = transmitDirection(&hit, normal)
+			countEmission = true
+		default:
+			// Diffuse: BRDF is color / Pi, cosine weighted sampling cancels both Pi and cosine.
+			direct := directLight(scene, &hit, normal)
+			radiance = addVector(radiance, multiplyVector(throughput, scaleVector(multiplyVector(color, direct), 1.0/math.Pi)))
+			dir = cosineSampleHemisphere(normal)
+			countEmission = false
+		}
+		throughput = multiplyVector(throughput, color)
+
+		if depth >= rouletteDepth {
+			survive := math.Min(math.Max(throughput[0], math.Max(throughput[1], throughput[2])), 0.95)
+			if rand.Float64() > survive {
+				return
+			}
+			throughput = scaleVector(throughput, 1.0/survive)
+		}
+		hit = raycastSceneBounce(scene, &hit, dir)
+	}
+}
+
+// glossyDirection blends the mirror direction towards a cosine lobe by roughness.
+func glossyDirection(reflected, normal Vector, roughness float64) Vector {
+	if roughness <= 0 {
+		return reflected
+	}
+	dir := normalizeVector(combine(reflected, cosineSampleHemisphere(reflected), 1-roughness, roughness))
+	if dot(dir, normal) <= 0 {
+		return reflected
+	}
+	return dir
+}
+
+// transmitDirection refracts into or out of the surface, vertex normals tell
+// us which side we are on as intersection normals always face the ray.
+func transmitDirection(hit *Intersection, normal Vector) Vector {
+	ior := hit.Triangle.Material.IndexOfRefraction
+	if dot(hit.RayDir, hit.vertexNormal(0)) > 0 && ior > DIFF {
+		ior = 1.0 / ior
+	}
+	dir := refractVector(hit.RayDir, normal, ior)
+	if vectorLength(dir) < DIFF {
+		// Total internal reflection.
+		return reflectVector(hit.RayDir, normal)
+	}
+	return normalizeVector(dir)
+}
+
+// directLight is the next event estimation, light arriving at the hit point
+// from the scene lights and one sampled emissive triangle.
+func directLight(scene *Scene, hit *Intersection, normal Vector) (result Vector) {
+	for i := range scene.Lights {
+		light := &scene.Lights[i]
+		if light.emitter {
+			continue
+		}
+		var toLight Vector
+		dist := math.Inf(1)
+		strength := light.LightStrength
+		if light.Directional {
+			toLight = normalizeVector(scaleVector(light.Direction, -1))
+		} else {
+			dist = vectorDistance(hit.Intersection, light.Position)
+			toLight = normalizeVector(subVector(light.Position, hit.Intersection))
+			strength *= light.spotFactor(scaleVector(toLight, -1)) / (dist * dist)
+		}
+		cos := dot(normal, toLight)
+		if cos <= 0 || strength <= 0 || !unoccluded(scene, hit, toLight, dist) {
+			continue
+		}
+		result = addVector(result, scaleVector(light.Color, strength*cos))
+	}
+
+	if len(scene.emitters) == 0 {
+		return result
+	}
+	emitter, area := scene.sampleEmitter()
+	point := sampleTriangle(*emitter, 1)[0]
+	dist := vectorDistance(hit.Intersection, point)
+	toLight := normalizeVector(subVector(point, hit.Intersection))
+	cos := dot(normal, toLight)
+	cosLight := math.Abs(dot(emitter.normal(), toLight))
+	if cos <= 0 || cosLight <= 0 || !unoccluded(scene, hit, toLight, dist) {
+		return result
+	}
+	// Area pdf is 1 / total area of emitters.
+	geometry := cos * cosLight * area / (dist * dist)
+	return addVector(result, scaleVector(emitter.Material.emission(), geometry))
+}
+
+// unoccluded tells if nothing blocks the ray before dist.
+func unoccluded(scene *Scene, from *Intersection, dir Vector, dist float64) bool {
+	shadow := raycastSceneBounce(scene, from, dir)
+	return !shadow.Hit || shadow.Dist >= dist*(1-1e-4)
+}
+
+// collectEmitters keeps light emitting triangles for area sampling.
+func (s *Scene) collectEmitters() {
+	s.emitters = s.emitters[:0]
+	s.emitterAreas = s.emitterAreas[:0]
+	total := 0.0
+	for _, triangle := range s.lightTriangles() {
+		total += triangle.area()
+		s.emitters = append(s.emitters, triangle)
+		s.emitterAreas = append(s.emitterAreas, total)
+	}
+}
+
+// sampleEmitter picks an emitter proportional to its area, also returns the total area.
+func (s *Scene) sampleEmitter() (*Triangle, float64) {
+	total := s.emitterAreas[len(s.emitterAreas)-1]
+	target := rand.Float64() * total
+	index := sort.SearchFloat64s(s.emitterAreas, target)
+	if index >= len(s.emitters) {
+		index = len(s.emitters) - 1
+	}
+	return s.emitters[index], total
+}
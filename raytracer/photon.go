@@ -1,6 +1,9 @@
 package raytracer
 
-import "math"
+import (
+	"math"
+	"sync"
+)
 
 // Photon information to follow.
 type Photon struct {
@@ -10,12 +13,36 @@ type Photon struct {
 	Intensity float64
 }
 
+// photonMap of the caustic photons, by the id of the triangle they landed on.
+type photonMap struct {
+	lock    sync.Mutex
+	photons map[int64][]Photon
+}
+
+func newPhotonMap() *photonMap {
+	return &photonMap{photons: make(map[int64][]Photon)}
+}
+
+func (m *photonMap) add(id int64, photon Photon) {
+	m.lock.Lock()
+	m.photons[id] = append(m.photons[id], photon)
+	m.lock.Unlock()
+}
+
+// on the triangle, read without locking once the map is built.
+func (m *photonMap) on(id int64) []Photon {
+	if m == nil {
+		return nil
+	}
+	return m.photons[id]
+}
+
 // trace a photon's path.
 func tracePhoton(scene *Scene, photon *Photon, depth int) {
 	if photon.Intensity < DIFF {
 		return
 	}
-	if depth > GlobalConfig.MaxReflectionDepth {
+	if depth > scene.renderer.Config.MaxReflectionDepth {
 		return
 	}
 	hit := raycastSceneIntersect(scene, photon.Location, photon.Direction)
@@ -38,10 +65,7 @@ func tracePhoton(scene *Scene, photon *Photon, depth int) {
 	}
 
 	if hit.Triangle.Material.Glossiness == 0 && hit.Triangle.Material.Transmission == 0 {
-		if hit.Triangle.Photons == nil {
-			hit.Triangle.Photons = make([]Photon, 0)
-		}
-		hit.Triangle.Photons = append(hit.Triangle.Photons, Photon{
+		scene.photons.add(hit.id(), Photon{
 			Location:  hit.Intersection,
 			Color:     trace,
 			Direction: photon.Direction,
@@ -51,7 +75,7 @@ func tracePhoton(scene *Scene, photon *Photon, depth int) {
 	if hit.Triangle.Material.Glossiness > 0 {
 		reflect := reflectVector(photon.Direction, hit.IntersectionNormal)
 		reflectedPhoton := Photon{
-			Location:  hit.Intersection,
+			Location:  offsetRayOrigin(hit.Intersection, hit.geometricNormal, reflect),
 			Direction: reflect,
 			Color:     photon.Color,
 			Intensity: photon.Intensity * hit.Triangle.Material.Glossiness,
@@ -61,7 +85,7 @@ func tracePhoton(scene *Scene, photon *Photon, depth int) {
 	if hit.Triangle.Material.Transmission > 0 {
 		refract := refractVector(photon.Direction, hit.IntersectionNormal, hit.Triangle.Material.IndexOfRefraction)
 		refractedPhoton := Photon{
-			Location:  hit.Intersection,
+			Location:  offsetRayOrigin(hit.Intersection, hit.geometricNormal, refract),
 			Direction: refract,
 			Color:     photon.Color,
 			Intensity: photon.Intensity * hit.Triangle.Material.Transmission,
@@ -9,23 +9,20 @@ import (
 
 func buildPhotonMap(scene *Scene) {
 	log.Printf("Analysing scene for caustic surfaces")
-	causticSampleLocations := make([]Vector, 0)
-
-	for tri := range scene.MasterObject.Triangles {
-		if scene.MasterObject.Triangles[tri].Material.Glossiness > 0 || scene.MasterObject.Triangles[tri].Material.Transmission > 0 {
-			locations := sampleTriangle(scene.MasterObject.Triangles[tri], GlobalConfig.CausticsSamplerLimit)
-			causticSampleLocations = append(causticSampleLocations, locations...)
-		}
-	}
+	scene.photons = newPhotonMap()
+	causticSampleLocations := scene.causticSampleLocations()
 
 	log.Printf("Found %d sample photons", len(causticSampleLocations))
+	// Every light shoots at all the samples, in batches traced in parallel.
+	workCount := runtime.NumCPU() * 8
+	batchSize := int(math.Ceil(float64(len(causticSampleLocations)) / float64(workCount)))
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	var wg sync.WaitGroup
 	for i := range scene.Lights {
-		var wg sync.WaitGroup
-		workCount := runtime.NumCPU() * 8
-		batchSize := int(math.Floor(float64(len(causticSampleLocations)) / float64(workCount)))
-		for k := 0; k < workCount-1; k++ {
-			from := batchSize * k
-			to := batchSize * (k + 1)
+		for from := 0; from < len(causticSampleLocations); from += batchSize {
+			to := from + batchSize
 			if to > len(causticSampleLocations) {
 				to = len(causticSampleLocations)
 			}
@@ -34,18 +31,56 @@ func buildPhotonMap(scene *Scene) {
 			go func(scene *Scene, samples []Vector, light *Light, wg *sync.WaitGroup) {
 				for sampleIndex := range samples {
 					dir := normalizeVector(subVector(samples[sampleIndex], light.Position))
+					spot := light.spotFactor(dir)
+					if spot <= 0 {
+						continue
+					}
 					photon := Photon{
-						Location:  light.Position,
+						Location:  light.rayOrigin(dir),
 						Color:     light.Color,
 						Direction: dir,
-						Intensity: light.LightStrength,
+						Intensity: light.LightStrength * spot,
 					}
 					tracePhoton(scene, &photon, 0)
 				}
 				wg.Done()
 			}(scene, sample, &scene.Lights[i], &wg)
-			wg.Wait()
 		}
 	}
+	wg.Wait()
 	log.Printf("Done building photon map")
 }
+
+// causticSampleLocations the photons are shot at, on the reflective and
+// transparent triangles, instances and primitives.
+func (s *Scene) causticSampleLocations() []Vector {
+	limit := s.renderer.Config.CausticsSamplerLimit
+	caustic := func(m *Material) bool {
+		return m.Glossiness > 0 || m.Transmission > 0
+	}
+	locations := make([]Vector, 0)
+	for i := range s.MasterObject.Triangles {
+		if caustic(s.MasterObject.Triangles[i].Material) {
+			locations = append(locations, sampleTriangle(s.MasterObject.Triangles[i], limit)...)
+		}
+	}
+	for i := range s.instances {
+		mesh := s.instances[i].mesh
+		for j := range mesh.Triangles {
+			if caustic(mesh.Triangles[j].Material) {
+				locations = append(locations, sampleTriangle(*s.instances[i].triangle(&mesh.Triangles[j]), limit)...)
+			}
+		}
+	}
+	// Infinite planes have no area to sample.
+	for _, p := range s.bounded {
+		if !caustic(&p.Material) {
+			continue
+		}
+		for _, points := range p.surface() {
+			triangle := Triangle{P1: points[0], P2: points[1], P3: points[2]}
+			locations = append(locations, sampleTriangle(triangle, limit)...)
+		}
+	}
+	return locations
+}
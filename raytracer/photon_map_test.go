@@ -0,0 +1,57 @@
+package raytracer
+
+import (
+	"testing"
+)
+
+// TestPhotonMapSamples shoots photons through clear glass onto the floor, so
+// every sample of every light leaves one photon.
+func TestPhotonMapSamples(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples int
+		lights  int
+	}{
+		{"fewer samples than batches", 1, 1},
+		{"uneven batches", 7, 2},
+		{"many samples", 100, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewRenderer()
+			r.Config = DEFAULT
+			r.Config.KDTreeCache = false
+			r.Config.RenderCaustics = true
+			r.Config.CausticsSamplerLimit = test.samples
+			s := NewScene(SceneOptions{})
+			_ = s.AddPrimitive(Primitive{
+				Name:     "glass",
+				Type:     PrimitiveDisc,
+				Position: Vector{0, 0, 1, 1},
+				Normal:   Vector{0, 0, 1, 0},
+				Radius:   0.5,
+				Material: Material{Color: Vector{1, 1, 1, 1}, Transmission: 1, IndexOfRefraction: 1},
+			})
+			_ = s.AddPrimitive(Primitive{
+				Name:     "floor",
+				Type:     PrimitivePlane,
+				Position: Vector{0, 0, 0, 1},
+				Normal:   Vector{0, 0, 1, 0},
+				Material: Material{Color: Vector{1, 1, 1, 1}},
+			})
+			for i := 0; i < test.lights; i++ {
+				_ = s.AddLight(Light{Position: Vector{0.1 * float64(i), 0, 3, 1}, Color: Vector{1, 1, 1, 1}, Active: true, LightStrength: 10})
+			}
+			r.prepare(s, 4, 4)
+
+			want := len(s.causticSampleLocations()) * test.lights
+			got := 0
+			for _, photons := range s.photons.photons {
+				got += len(photons)
+			}
+			if got != want {
+				t.Errorf("%d photons, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package raytracer
+
+/*
+Stanford PLY importer for ASCII and binary files. The vertex element gives
+positions, and optionally normals, colors and texture coordinates; faces are
+split into triangle fans. Other elements are skipped.
+Axes are kept as they are in the file, scans have no common up axis, rotate
+them with the matrix of the referencing object.
+Meshes without normals get smooth normals averaged from their faces.
+*/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type plyProperty struct {
+	name      string
+	kind      string
+	countKind string // list length type, empty for scalar properties
+}
+
+type plyElement struct {
+	name       string
+	count      int
+	properties []plyProperty
+}
+
+// plySizes of the binary property types in bytes.
+var plySizes = map[string]int{
+	"char": 1, "int8": 1, "uchar": 1, "uint8": 1,
+	"short": 2, "int16": 2, "ushort": 2, "uint16": 2,
+	"int": 4, "int32": 4, "uint": 4, "uint32": 4, "float": 4, "float32": 4,
+	"double": 8, "float64": 8,
+}
+
+// plyReader reads the values of the elements in ASCII or binary format.
+type plyReader struct {
+	r      *bufio.Reader
+	order  binary.ByteOrder // nil for ASCII
+	fields []string
+	buf    [8]byte
+}
+
+func loadPLY(files fs.FS, name string) (map[string]*Object, error) {
+	f, err := files.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &plyReader{r: bufio.NewReader(f)}
+	elements, err := r.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	obj := NewObject()
+	mat := Material{Color: Vector{1, 1, 1, 1}}
+	hasNormals := false
+	for _, e := range elements {
+		switch e.name {
+		case "vertex":
+			hasNormals, err = r.readVertices(e, obj)
+		case "face":
+			err = r.readFaces(e, obj, &mat, len(obj.Vertices))
+		default:
+			err = r.skip(e)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s element: %w", e.name, err)
+		}
+	}
+	if !hasNormals {
+		smoothNormals(obj, mat.Indices)
+	}
+	obj.Materials[objDefaultMaterial] = mat
+	objName := strings.TrimSuffix(path.Base(name), path.Ext(name))
+	return map[string]*Object{objName: obj}, nil
+}
+
+func (r *plyReader) readHeader() ([]plyElement, error) {
+	var elements []plyElement
+	for line := 0; ; line++ {
+		text, err := r.r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("header: %w", err)
+		}
+		fields := strings.Fields(text)
+		if line == 0 {
+			if len(fields) != 1 || fields[0] != "ply" {
+				return nil, errors.New("not a ply file")
+			}
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "format":
+			if len(fields) < 2 {
+				return nil, errors.New("format without type")
+			}
+			switch fields[1] {
+			case "ascii":
+			case "binary_little_endian":
+				r.order = binary.LittleEndian
+			case "binary_big_endian":
+				r.order = binary.BigEndian
+			default:
+				return nil, fmt.Errorf("unknown format %s", fields[1])
+			}
+		case "element":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("malformed element %q", strings.TrimSpace(text))
+			}
+			count, err := strconv.Atoi(fields[2])
+			if err != nil || count < 0 {
+				return nil, fmt.Errorf("element %s count %q", fields[1], fields[2])
+			}
+			elements = append(elements, plyElement{name: fields[1], count: count})
+		case "property":
+			if len(elements) == 0 {
+				return nil, errors.New("property before element")
+			}
+			e := &elements[len(elements)-1]
+			switch {
+			case len(fields) == 5 && fields[1] == "list":
+				e.properties = append(e.properties, plyProperty{name: fields[4], kind: fields[3], countKind: fields[2]})
+			case len(fields) == 3:
+				e.properties = append(e.properties, plyProperty{name: fields[2], kind: fields[1]})
+			default:
+				return nil, fmt.Errorf("malformed property %q", strings.TrimSpace(text))
+			}
+		case "end_header":
+			return elements, nil
+		}
+	}
+}
+
+// value of the given type, ASCII values are read from the current line.
+func (r *plyReader) value(kind string) (float64, error) {
+	if r.order == nil {
+		for len(r.fields) == 0 {
+			line, err := r.r.ReadString('\n')
+			if err != nil && (err != io.EOF || line == "") {
+				return 0, err
+			}
+			r.fields = strings.Fields(line)
+		}
+		v, err := strconv.ParseFloat(r.fields[0], 64)
+		r.fields = r.fields[1:]
+		return v, err
+	}
+
+	size := plySizes[kind]
+	if size == 0 {
+		return 0, fmt.Errorf("unknown property type %s", kind)
+	}
+	b := r.buf[:size]
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return 0, err
+	}
+	switch kind {
+	case "char", "int8":
+		return float64(int8(b[0])), nil
+	case "uchar", "uint8":
+		return float64(b[0]), nil
+	case "short", "int16":
+		return float64(int16(r.order.Uint16(b))), nil
+	case "ushort", "uint16":
+		return float64(r.order.Uint16(b)), nil
+	case "int", "int32":
+		return float64(int32(r.order.Uint32(b))), nil
+	case "uint", "uint32":
+		return float64(r.order.Uint32(b)), nil
+	case "float", "float32":
+		return float64(math.Float32frombits(r.order.Uint32(b))), nil
+	default:
+		return math.Float64frombits(r.order.Uint64(b)), nil
+	}
+}
+
+// property values, one for scalars and all items of lists.
+func (r *plyReader) property(p *plyProperty, values []float64) ([]float64, error) {
+	values = values[:0]
+	if p.countKind == "" {
+		v, err := r.value(p.kind)
+		return append(values, v), err
+	}
+	count, err := r.value(p.countKind)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(count); i++ {
+		v, err := r.value(p.kind)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// endElement drops what is left of an ASCII line, elements are one per line.
+func (r *plyReader) endElement() {
+	r.fields = nil
+}
+
+func (r *plyReader) skip(e plyElement) error {
+	var values []float64
+	var err error
+	for i := 0; i < e.count; i++ {
+		for j := range e.properties {
+			if values, err = r.property(&e.properties[j], values); err != nil {
+				return err
+			}
+		}
+		r.endElement()
+	}
+	return nil
+}
+
+// readVertices into the object, returns whether the vertices have normals.
+func (r *plyReader) readVertices(e plyElement, obj *Object) (bool, error) {
+	has := make(map[string]bool)
+	for _, p := range e.properties {
+		has[p.name] = true
+	}
+	hasNormals := has["nx"] && has["ny"] && has["nz"]
+	hasColors := has["red"] && has["green"] && has["blue"]
+
+	var values []float64
+	var err error
+	for i := 0; i < e.count; i++ {
+		position := Vector{0, 0, 0, 1}
+		var normal, texCoord Vector
+		color := Vector{1, 1, 1, 1}
+		for j := range e.properties {
+			p := &e.properties[j]
+			if values, err = r.property(p, values); err != nil {
+				return false, err
+			}
+			if len(values) == 0 {
+				continue
+			}
+			v := values[0]
+			switch p.name {
+			case "x":
+				position[0] = v
+			case "y":
+				position[1] = v
+			case "z":
+				position[2] = v
+			case "nx":
+				normal[0] = v
+			case "ny":
+				normal[1] = v
+			case "nz":
+				normal[2] = v
+			case "s", "u", "texture_u":
+				texCoord[0] = v
+			case "t", "v", "texture_v":
+				texCoord[1] = v
+			case "red":
+				color[0] = plyColor(v, p.kind)
+			case "green":
+				color[1] = plyColor(v, p.kind)
+			case "blue":
+				color[2] = plyColor(v, p.kind)
+			case "alpha":
+				color[3] = plyColor(v, p.kind)
+			}
+		}
+		r.endElement()
+		obj.AddVertex(position, normal, texCoord)
+		if hasColors {
+			obj.Colors = append(obj.Colors, color)
+		}
+	}
+	return hasNormals, nil
+}
+
+// plyColor in 0-1 range, integer colors are 0-255.
+func plyColor(v float64, kind string) float64 {
+	if kind == "float" || kind == "float32" || kind == "double" || kind == "float64" {
+		return v
+	}
+	return v / 255
+}
+
+func (r *plyReader) readFaces(e plyElement, obj *Object, mat *Material, vertices int) error {
+	var values []float64
+	var err error
+	for i := 0; i < e.count; i++ {
+		for j := range e.properties {
+			p := &e.properties[j]
+			if values, err = r.property(p, values); err != nil {
+				return err
+			}
+			if p.name != "vertex_indices" && p.name != "vertex_index" {
+				continue
+			}
+			for k := range values {
+				if values[k] < 0 || int(values[k]) >= vertices {
+					return fmt.Errorf("face %d vertex %d out of %d vertices", i, int(values[k]), vertices)
+				}
+			}
+			for k := 1; k+1 < len(values); k++ {
+				mat.Indices = append(mat.Indices, indice{int64(values[0]), int64(values[k]), int64(values[k+1]), 1})
+			}
+		}
+		r.endElement()
+	}
+	return nil
+}
+
+// smoothNormals of the vertices, the area weighted average of the face normals.
+func smoothNormals(obj *Object, faces []indice) {
+	normals := make([]Vector, len(obj.Vertices))
+	for _, face := range faces {
+		p1, p2, p3 := obj.Vertices[face[0]], obj.Vertices[face[1]], obj.Vertices[face[2]]
+		n := crossProduct(subVector(p2, p1), subVector(p3, p1))
+		for _, v := range face[:3] {
+			normals[v] = Vector{normals[v][0] + n[0], normals[v][1] + n[1], normals[v][2] + n[2], 0}
+		}
+	}
+	for i := range normals {
+		normals[i] = normalizeVector(normals[i])
+		normals[i][3] = 0
+	}
+	obj.Normals = normals
+}
@@ -0,0 +1,118 @@
+package raytracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+// plyQuad in the given format, a colored square with an edge element to skip.
+// The vertices have normals when normals is set, the face is a single quad.
+func plyQuad(format string, normals bool) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "ply\nformat %s 1.0\ncomment test\nelement vertex 4\n", format)
+	buf.WriteString("property float x\nproperty float y\nproperty float z\n")
+	if normals {
+		buf.WriteString("property float nx\nproperty float ny\nproperty float nz\n")
+	}
+	buf.WriteString("property uchar red\nproperty uchar green\nproperty uchar blue\n")
+	buf.WriteString("element edge 1\nproperty int vertex1\nproperty int vertex2\n")
+	buf.WriteString("element face 1\nproperty list uchar int vertex_indices\nend_header\n")
+
+	positions := [][3]float32{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}, {0, 1, 0}}
+	var order binary.ByteOrder
+	switch format {
+	case "binary_little_endian":
+		order = binary.LittleEndian
+	case "binary_big_endian":
+		order = binary.BigEndian
+	}
+	for i, p := range positions {
+		if order == nil {
+			fmt.Fprintf(&buf, "%v %v %v ", p[0], p[1], p[2])
+			if normals {
+				buf.WriteString("0 0 1 ")
+			}
+			fmt.Fprintf(&buf, "%d 0 255\n", i*85)
+			continue
+		}
+		_ = binary.Write(&buf, order, p)
+		if normals {
+			_ = binary.Write(&buf, order, [3]float32{0, 0, 1})
+		}
+		buf.Write([]byte{byte(i * 85), 0, 255})
+	}
+	if order == nil {
+		buf.WriteString("0 1\n4 0 1 2 3\n")
+	} else {
+		_ = binary.Write(&buf, order, []int32{0, 1})
+		buf.WriteByte(4)
+		_ = binary.Write(&buf, order, []int32{0, 1, 2, 3})
+	}
+	return buf.Bytes()
+}
+
+func TestLoadPLY(t *testing.T) {
+	want := map[string]*Object{"quad": NewObject()}
+	quad := want["quad"]
+	for i, p := range []Vector{{0, 0, 0, 1}, {1, 0, 0, 1}, {1, 1, 0, 1}, {0, 1, 0, 1}} {
+		quad.AddVertex(p, Vector{0, 0, 1, 0}, Vector{})
+		quad.Colors = append(quad.Colors, Vector{float64(i*85) / 255, 0, 1, 1})
+	}
+	quad.Materials[objDefaultMaterial] = Material{
+		Color:   Vector{1, 1, 1, 1},
+		Indices: []indice{{0, 1, 2, 1}, {0, 2, 3, 1}},
+	}
+
+	tests := []struct {
+		name    string
+		format  string
+		normals bool
+	}{
+		{"ascii", "ascii", true},
+		{"binary little endian", "binary_little_endian", true},
+		{"binary big endian", "binary_big_endian", true},
+		{"ascii without normals", "ascii", false},
+		{"binary without normals", "binary_little_endian", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files := fstest.MapFS{"scan/quad.ply": {Data: plyQuad(test.format, test.normals)}}
+			objects, err := LoadMesh(files, "scan/quad.ply")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(objects, want) {
+				t.Errorf("objects %+v, want %+v", objects["quad"], quad)
+			}
+		})
+	}
+}
+
+func TestLoadPLYErrors(t *testing.T) {
+	binaryQuad := plyQuad("binary_little_endian", true)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not ply", []byte("solid x\n")},
+		{"unknown format", []byte("ply\nformat utf8 1.0\nend_header\n")},
+		{"malformed element", []byte("ply\nformat ascii 1.0\nelement vertex\nend_header\n")},
+		{"property before element", []byte("ply\nformat ascii 1.0\nproperty float x\nend_header\n")},
+		{"unknown property type", []byte("ply\nformat binary_little_endian 1.0\nelement vertex 1\nproperty half x\nend_header\n\x00\x00")},
+		{"header without end", []byte("ply\nformat ascii 1.0\nelement vertex 1\n")},
+		{"face out of range", bytes.Replace(plyQuad("ascii", true), []byte("4 0 1 2 3"), []byte("4 0 1 2 4"), 1)},
+		{"bad number", bytes.Replace(plyQuad("ascii", true), []byte("0 1\n"), []byte("0 x\n"), 1)},
+		{"truncated binary", binaryQuad[:len(binaryQuad)-3]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := LoadMesh(fstest.MapFS{"m.ply": {Data: test.data}}, "m.ply"); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
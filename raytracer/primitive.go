@@ -0,0 +1,451 @@
+package raytracer
+
+import (
+	"log"
+	"math"
+)
+
+// Primitive types to choose from in the scene.
+const (
+	PrimitiveSphere   = "sphere"
+	PrimitivePlane    = "plane"
+	PrimitiveDisc     = "disc"
+	PrimitiveBox      = "box"
+	PrimitiveCylinder = "cylinder"
+)
+
+// Segments of the circles when light primitives are tessellated for light sampling.
+const primitiveLightSegments = 32
+
+// Primitive is an analytic shape, hit exactly instead of through triangles.
+// Position is the center of spheres and discs, a point on planes and the
+// center of the bottom cap of cylinders. Normal is the facing of planes and
+// discs and the axis of cylinders. Boxes are axis aligned between Min and Max.
+// Texture coordinates are spherical for spheres, around the axis for
+// cylinders and one texture per unit on flat surfaces.
+type Primitive struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Position Vector   `json:"position"`
+	Normal   Vector   `json:"normal"`
+	Radius   float64  `json:"radius"`
+	Height   float64  `json:"height"`
+	Min      Vector   `json:"min"`
+	Max      Vector   `json:"max"`
+	Material Material `json:"material"`
+	id       int64
+	// Triangle with the id and material of the primitive, for shading hits.
+	shading Triangle
+}
+
+// preparePrimitives splits the valid primitives into the bounded ones and the
+// infinite planes, returns the bounds of the bounded ones.
+func (s *Scene) preparePrimitives(idBase int64) []BoundingBox {
+	s.bounded = nil
+	s.unbounded = nil
+	boxes := make([]BoundingBox, 0, len(s.Primitives))
+	for i := range s.Primitives {
+		p := &s.Primitives[i]
+		if !p.prepare() {
+			log.Printf("Primitive %s of type [%s] is skipped", p.Name, p.Type)
+			continue
+		}
+		idBase++
+		p.id = idBase
+		p.shading = Triangle{id: p.id, Material: &p.Material}
+		if p.Type == PrimitivePlane {
+			s.unbounded = append(s.unbounded, p)
+			continue
+		}
+		s.bounded = append(s.bounded, p)
+		boxes = append(boxes, p.boundingBox())
+	}
+	if len(s.Primitives) > 0 {
+		log.Printf("Prepared %d primitives", len(s.bounded)+len(s.unbounded))
+	}
+	return boxes
+}
+
+// prepare the vectors of the primitive, false if it has nothing to hit.
+func (p *Primitive) prepare() bool {
+	p.Position[3] = 1
+	p.Min[3] = 1
+	p.Max[3] = 1
+	p.Normal[3] = 0
+	if vectorLength(p.Normal) < DIFF {
+		p.Normal = Vector{0, 0, 1, 0}
+	}
+	p.Normal = normalizeVector(p.Normal)
+	switch p.Type {
+	case PrimitiveSphere, PrimitiveDisc:
+		return p.Radius > 0
+	case PrimitivePlane:
+		return true
+	case PrimitiveBox:
+		for i := 0; i < 3; i++ {
+			if p.Min[i] > p.Max[i] {
+				p.Min[i], p.Max[i] = p.Max[i], p.Min[i]
+			}
+		}
+		return true
+	case PrimitiveCylinder:
+		return p.Radius > 0 && p.Height > 0
+	}
+	return false
+}
+
+// boundingBox of the bounded primitives.
+func (p *Primitive) boundingBox() BoundingBox {
+	switch p.Type {
+	case PrimitiveSphere:
+		r := Vector{p.Radius, p.Radius, p.Radius, 0}
+		return BoundingBox{subVector(p.Position, r), addVector(p.Position, r)}
+	case PrimitiveDisc:
+		return discBounds(p.Position, p.Normal, p.Radius)
+	case PrimitiveCylinder:
+		box := discBounds(p.Position, p.Normal, p.Radius)
+		box.extend(discBounds(p.top(), p.Normal, p.Radius))
+		return box
+	}
+	return BoundingBox{p.Min, p.Max}
+}
+
+// discBounds around a circle with the normal.
+func discBounds(center, normal Vector, radius float64) BoundingBox {
+	extent := Vector{}
+	for i := 0; i < 3; i++ {
+		extent[i] = radius * math.Sqrt(math.Max(0, 1-normal[i]*normal[i]))
+	}
+	return BoundingBox{subVector(center, extent), addVector(center, extent)}
+}
+
+// top cap center of cylinders.
+func (p *Primitive) top() Vector {
+	return combine(p.Position, p.Normal, 1, p.Height)
+}
+
+// raycast the primitive, keeping the hit in the intersection if it's the closest so far.
+func (p *Primitive) raycast(rayStart, rayDir *Vector, intersection *Intersection) {
+	t, normal, uv, hit := p.intersect(rayStart, rayDir)
+	if !hit {
+		return
+	}
+	intersection.Hits++
+	point := combine(*rayStart, *rayDir, 1, t)
+	point[3] = 1
+	dist := pvectorDistance(&point, rayStart)
+	if dist <= 0 || (intersection.Dist != -1 && dist >= intersection.Dist) {
+		return
+	}
+	intersection.Hit = true
+	intersection.Intersection = point
+	intersection.IntersectionNormal = normal
+	// Intersection normals face the ray like the triangle ones.
+	if sameSideTest(normal, *rayDir, 0) {
+		intersection.IntersectionNormal = scaleVector(normal, -1)
+	}
+	intersection.geometricNormal = intersection.IntersectionNormal
+	intersection.Triangle = &p.shading
+	intersection.instance = nil
+	intersection.primitive = p
+	intersection.uv = uv
+	intersection.outward = normal
+	intersection.RayStart = *rayStart
+	intersection.RayDir = *rayDir
+	intersection.Dist = dist
+	intersection.getNormal()
+}
+
+// intersect the ray with the primitive, t is in units of the ray vector.
+// Normal is the outward normal, uv the texture coordinates at the hit.
+func (p *Primitive) intersect(rayStart, rayDir *Vector) (t float64, normal, uv Vector, hit bool) {
+	switch p.Type {
+	case PrimitiveSphere:
+		return p.intersectSphere(rayStart, rayDir)
+	case PrimitivePlane:
+		return p.intersectPlane(rayStart, rayDir, p.Position, p.Normal, math.Inf(1))
+	case PrimitiveDisc:
+		return p.intersectPlane(rayStart, rayDir, p.Position, p.Normal, p.Radius)
+	case PrimitiveBox:
+		return p.intersectBox(rayStart, rayDir)
+	case PrimitiveCylinder:
+		return p.intersectCylinder(rayStart, rayDir)
+	}
+	return
+}
+
+func (p *Primitive) intersectSphere(rayStart, rayDir *Vector) (t float64, normal, uv Vector, hit bool) {
+	oc := subVector(*rayStart, p.Position)
+	a := dot(*rayDir, *rayDir)
+	b := dot(oc, *rayDir)
+	c := dot(oc, oc) - p.Radius*p.Radius
+	disc := b*b - a*c
+	if disc < 0 || a < DIFF {
+		return
+	}
+	sq := math.Sqrt(disc)
+	t = (-b - sq) / a
+	if t <= 0 {
+		// Starts inside the sphere.
+		t = (-b + sq) / a
+	}
+	if t <= 0 {
+		return
+	}
+	point := combine(*rayStart, *rayDir, 1, t)
+	normal = normalizeVector(subVector(point, p.Position))
+	normal[3] = 0
+	uv = Vector{
+		0.5 + math.Atan2(normal[1], normal[0])/(2*math.Pi),
+		0.5 + math.Asin(math.Max(-1, math.Min(1, normal[2])))/math.Pi,
+	}
+	return t, normal, uv, true
+}
+
+// intersectPlane through the center with the normal, within radius of the center.
+func (p *Primitive) intersectPlane(rayStart, rayDir *Vector, center, n Vector, radius float64) (t float64, normal, uv Vector, hit bool) {
+	denom := dot(n, *rayDir)
+	if denom < DIFF && denom > -DIFF {
+		return
+	}
+	t = dot(subVector(center, *rayStart), n) / denom
+	if t <= 0 {
+		return
+	}
+	local := subVector(combine(*rayStart, *rayDir, 1, t), center)
+	local[3] = 0
+	if vectorLength(local) > radius {
+		return
+	}
+	tangent, bitangent := orthonormalBasis(n)
+	uv = Vector{dot(local, tangent), dot(local, bitangent)}
+	if !math.IsInf(radius, 1) {
+		uv = Vector{0.5 + uv[0]/(2*radius), 0.5 + uv[1]/(2*radius)}
+	}
+	return t, n, uv, true
+}
+
+func (p *Primitive) intersectBox(rayStart, rayDir *Vector) (t float64, normal, uv Vector, hit bool) {
+	tNear := math.Inf(-1)
+	tFar := math.Inf(1)
+	nearAxis, farAxis := 0, 0
+	nearSign, farSign := -1.0, 1.0
+	for i := 0; i < 3; i++ {
+		if rayDir[i] < DIFF && rayDir[i] > -DIFF {
+			if rayStart[i] < p.Min[i] || rayStart[i] > p.Max[i] {
+				return
+			}
+			continue
+		}
+		t1 := (p.Min[i] - rayStart[i]) / rayDir[i]
+		t2 := (p.Max[i] - rayStart[i]) / rayDir[i]
+		// Sign of the outward normal of the side at t1, min sides face down the axis.
+		sign1, sign2 := -1.0, 1.0
+		if t1 > t2 {
+			t1, t2 = t2, t1
+			sign1, sign2 = sign2, sign1
+		}
+		if t1 > tNear {
+			tNear, nearAxis, nearSign = t1, i, sign1
+		}
+		if t2 < tFar {
+			tFar, farAxis, farSign = t2, i, sign2
+		}
+	}
+	if tNear > tFar || tFar <= 0 {
+		return
+	}
+	axis, sign := nearAxis, nearSign
+	t = tNear
+	if t <= 0 {
+		// Starts inside the box.
+		axis, sign, t = farAxis, farSign, tFar
+	}
+	normal[axis] = sign
+	point := combine(*rayStart, *rayDir, 1, t)
+	u := (axis + 1) % 3
+	v := (axis + 2) % 3
+	uv = Vector{
+		(point[u] - p.Min[u]) / math.Max(p.Max[u]-p.Min[u], DIFF),
+		(point[v] - p.Min[v]) / math.Max(p.Max[v]-p.Min[v], DIFF),
+	}
+	return t, normal, uv, true
+}
+
+// intersectCylinder is the closest of the side and the two caps.
+func (p *Primitive) intersectCylinder(rayStart, rayDir *Vector) (t float64, normal, uv Vector, hit bool) {
+	axis := p.Normal
+	oc := subVector(*rayStart, p.Position)
+	// Ray start and vector without their components along the axis.
+	o := combine(oc, axis, 1, -dot(oc, axis))
+	d := combine(*rayDir, axis, 1, -dot(*rayDir, axis))
+	a := dot(d, d)
+	b := dot(o, d)
+	c := dot(o, o) - p.Radius*p.Radius
+	disc := b*b - a*c
+	if a > DIFF && disc >= 0 {
+		sq := math.Sqrt(disc)
+		for _, root := range []float64{(-b - sq) / a, (-b + sq) / a} {
+			if root <= 0 {
+				continue
+			}
+			h := dot(combine(oc, *rayDir, 1, root), axis)
+			if h < 0 || h > p.Height {
+				continue
+			}
+			t, hit = root, true
+			normal = normalizeVector(combine(o, d, 1, root))
+			normal[3] = 0
+			tangent, bitangent := orthonormalBasis(axis)
+			uv = Vector{
+				0.5 + math.Atan2(dot(normal, bitangent), dot(normal, tangent))/(2*math.Pi),
+				h / p.Height,
+			}
+			break
+		}
+	}
+	caps := []struct {
+		center Vector
+		normal Vector
+	}{
+		{p.Position, scaleVector(axis, -1)},
+		{p.top(), axis},
+	}
+	for _, cap := range caps {
+		capT, capNormal, capUV, capHit := p.intersectPlane(rayStart, rayDir, cap.center, cap.normal, p.Radius)
+		if capHit && (!hit || capT < t) {
+			t, normal, uv, hit = capT, capNormal, capUV, true
+		}
+	}
+	return
+}
+
+// area of the primitive surface, infinite for planes.
+func (p *Primitive) area() float64 {
+	switch p.Type {
+	case PrimitiveSphere:
+		return 4 * math.Pi * p.Radius * p.Radius
+	case PrimitiveDisc:
+		return math.Pi * p.Radius * p.Radius
+	case PrimitiveBox:
+		size := subVector(p.Max, p.Min)
+		return 2 * (size[0]*size[1] + size[1]*size[2] + size[2]*size[0])
+	case PrimitiveCylinder:
+		return 2*math.Pi*p.Radius*p.Height + 2*math.Pi*p.Radius*p.Radius
+	}
+	return math.Inf(1)
+}
+
+// lightTriangles of light primitives, lights are sampled on triangles.
+// Light strength is scaled back to the primitive area.
+// Infinite planes can't be sampled, they only light what reflects them.
+func (p *Primitive) lightTriangles() []Triangle {
+	points := p.surface()
+	if points == nil {
+		log.Printf("Primitive %s of type [%s] is not sampled as a light", p.Name, p.Type)
+		return nil
+	}
+	triangles := make([]Triangle, len(points))
+	light := p.Material
+	area := 0.0
+	for i := range points {
+		triangles[i] = Triangle{
+			id:       p.id,
+			P1:       points[i][0],
+			P2:       points[i][1],
+			P3:       points[i][2],
+			Material: &light,
+		}
+		triangles[i].P1[3], triangles[i].P2[3], triangles[i].P3[3] = 1, 1, 1
+		normal := triangles[i].normal()
+		triangles[i].setNormals(normal, normal, normal, false)
+		area += triangles[i].area()
+	}
+	light.LightStrength *= p.area() / area
+	return triangles
+}
+
+// surface of a bounded primitive as triangles, nil for the unbounded ones.
+// Curved surfaces are tessellated around the primitive so samples on the
+// triangles are not hidden inside it.
+func (p *Primitive) surface() [][3]Vector {
+	var points [][3]Vector
+	segments := primitiveLightSegments
+	// Circles are tessellated to polygons around them.
+	outer := 1 / math.Cos(math.Pi/float64(segments))
+	switch p.Type {
+	case PrimitiveSphere:
+		rings := segments / 2
+		// Cells are inside a circle of half their diagonal, triangles a bit more.
+		cell := math.Pi / float64(rings)
+		radius := p.Radius / math.Cos(1.1*math.Hypot(cell, cell)/2)
+		vertex := func(ring, segment int) Vector {
+			theta := cell * float64(ring)
+			phi := 2 * math.Pi * float64(segment) / float64(segments)
+			return combine(p.Position, Vector{math.Sin(theta) * math.Cos(phi), math.Sin(theta) * math.Sin(phi), math.Cos(theta), 0}, 1, radius)
+		}
+		for ring := 0; ring < rings; ring++ {
+			for segment := 0; segment < segments; segment++ {
+				a, b := vertex(ring, segment), vertex(ring, segment+1)
+				c, d := vertex(ring+1, segment), vertex(ring+1, segment+1)
+				if ring > 0 {
+					points = append(points, [3]Vector{a, c, b})
+				}
+				if ring < rings-1 {
+					points = append(points, [3]Vector{b, c, d})
+				}
+			}
+		}
+	case PrimitiveDisc:
+		points = circleTriangles(p.Position, p.Normal, p.Radius*outer, segments)
+	case PrimitiveCylinder:
+		top := p.top()
+		points = append(circleTriangles(p.Position, p.Normal, p.Radius*outer, segments),
+			circleTriangles(top, p.Normal, p.Radius*outer, segments)...)
+		tangent, bitangent := orthonormalBasis(p.Normal)
+		for i := 0; i < segments; i++ {
+			a := circlePoint(tangent, bitangent, p.Radius*outer, i, segments)
+			b := circlePoint(tangent, bitangent, p.Radius*outer, i+1, segments)
+			points = append(points,
+				[3]Vector{addVector(p.Position, a), addVector(p.Position, b), addVector(top, a)},
+				[3]Vector{addVector(p.Position, b), addVector(top, b), addVector(top, a)})
+		}
+	case PrimitiveBox:
+		// Corners with the bits picking min or max per axis.
+		corner := func(bits int) Vector {
+			return Vector{
+				[2]float64{p.Min[0], p.Max[0]}[bits&1],
+				[2]float64{p.Min[1], p.Max[1]}[(bits>>1)&1],
+				[2]float64{p.Min[2], p.Max[2]}[(bits>>2)&1],
+				1,
+			}
+		}
+		// Each axis has a min and a max side, made of the corners with its bit fixed.
+		for side := 0; side < 6; side++ {
+			axis := side / 2
+			fixed := (side % 2) << axis
+			u := 1 << ((axis + 1) % 3)
+			v := 1 << ((axis + 2) % 3)
+			a, b, c, d := corner(fixed), corner(fixed|u), corner(fixed|v), corner(fixed|u|v)
+			points = append(points, [3]Vector{a, b, d}, [3]Vector{a, d, c})
+		}
+	}
+	return points
+}
+
+// circleTriangles of a polygon around the circle, as a fan from the center.
+func circleTriangles(center, normal Vector, radius float64, segments int) [][3]Vector {
+	tangent, bitangent := orthonormalBasis(normal)
+	points := make([][3]Vector, 0, segments)
+	for i := 0; i < segments; i++ {
+		a := addVector(center, circlePoint(tangent, bitangent, radius, i, segments))
+		b := addVector(center, circlePoint(tangent, bitangent, radius, i+1, segments))
+		points = append(points, [3]Vector{center, a, b})
+	}
+	return points
+}
+
+func circlePoint(tangent, bitangent Vector, radius float64, i, segments int) Vector {
+	angle := 2 * math.Pi * float64(i) / float64(segments)
+	return combine(tangent, bitangent, radius*math.Cos(angle), radius*math.Sin(angle))
+}
@@ -0,0 +1,69 @@
+package raytracer
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPrimitiveHits(t *testing.T) {
+	r := NewRenderer()
+	r.Config = DEFAULT
+	r.Config.KDTreeCache = false
+	s := NewScene(SceneOptions{})
+	_ = s.AddPrimitive(Primitive{
+		Name:     "ball",
+		Type:     PrimitiveSphere,
+		Position: Vector{0, 0, 0, 1},
+		Radius:   1,
+		Material: Material{Color: Vector{1, 0, 0, 1}, IndexOfRefraction: 1.5},
+	})
+	_ = s.AddPrimitive(Primitive{
+		Name:     "floor",
+		Type:     PrimitivePlane,
+		Position: Vector{0, 0, -2, 1},
+		Normal:   Vector{0, 0, 1, 0},
+		Material: Material{Color: Vector{0, 1, 0, 1}},
+	})
+	r.prepare(s, 4, 4)
+
+	tests := []struct {
+		name    string
+		start   Vector
+		dir     Vector
+		color   Vector
+		dist    float64
+		outward Vector
+	}{
+		{"sphere top", Vector{0, 0, 3, 1}, Vector{0, 0, -1, 0}, Vector{1, 0, 0, 1}, 2, Vector{0, 0, 1, 0}},
+		{"sphere inside", Vector{0, 0, 0, 1}, Vector{1, 0, 0, 0}, Vector{1, 0, 0, 1}, 1, Vector{1, 0, 0, 0}},
+		{"floor", Vector{3, 0, 3, 1}, Vector{0, 0, -1, 0}, Vector{0, 1, 0, 1}, 5, Vector{0, 0, 1, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hit := raycastSceneIntersect(s, test.start, test.dir)
+			if !hit.Hit {
+				t.Fatal("no hit")
+			}
+			if math.Abs(hit.Dist-test.dist) > 1e-9 {
+				t.Errorf("distance %v, want %v", hit.Dist, test.dist)
+			}
+			if hit.Triangle.Material.Color != test.color {
+				t.Errorf("color %v, want %v", hit.Triangle.Material.Color, test.color)
+			}
+			if vectorDistance(hit.vertexNormal(0), test.outward) > 1e-9 {
+				t.Errorf("outward normal %v, want %v", hit.vertexNormal(0), test.outward)
+			}
+			if dot(hit.IntersectionNormal, test.dir) > 0 {
+				t.Errorf("normal %v doesn't face the ray", hit.IntersectionNormal)
+			}
+		})
+	}
+
+	// Hits share the shading triangle of the primitive.
+	allocs := testing.AllocsPerRun(100, func() {
+		raycastSceneIntersect(s, tests[0].start, tests[0].dir)
+	})
+	if allocs > 0 {
+		t.Errorf("%v allocations per primitive hit", allocs)
+	}
+}
@@ -0,0 +1,60 @@
+package raytracer
+
+import (
+	"context"
+	"image"
+	"log"
+	"time"
+)
+
+// renderProgressive renders the pixels in passes, adding one sample to each
+// pixel in every pass. The running average is written to snapshotFile every
+// snapshot_passes passes or snapshot_seconds seconds, so a long render can be
+// inspected or stopped when it looks good enough. Without snapshotFile there
+// are no snapshots. Pixels that are already
+// below the noise threshold are skipped in later passes.
+// Cancelling ctx stops after the pixels in flight and leaves the current
+// average in img. Resumed renders continue after the last checkpointed pass,
+// done tells which pixels of the first pass are already there.
+func renderProgressive(ctx context.Context, scene *Scene, img *image.RGBA, snapshotFile string, tiles []tile, checkpoints *checkpointer, done []bool) error {
+	config := &scene.renderer.Config
+	threads := scene.renderer.renderThreads()
+	passes := config.ProgressivePasses
+	lastSnapshot := time.Now()
+	for pass := checkpoints.pass + 1; pass <= passes; pass++ {
+		log.Printf("Progressive pass %d of %d", pass, passes)
+		var err error
+		if pass == 1 {
+			err = renderTiles(ctx, threads, remainingTiles(tiles, done, scene.Width), func(x, y int) {
+				renderPixel(scene, x, y)
+				checkpoints.finish(x, y)
+			})
+		} else {
+			err = renderTiles(ctx, threads, tiles, func(x, y int) {
+				if !scene.Pixels[x][y].converged(config) {
+					scene.Pixels[x][y].addSample(samplePixel(scene, x, y))
+				}
+			})
+		}
+		if err != nil {
+			renderImage(scene, img)
+			return err
+		}
+		checkpoints.finishPass(pass)
+
+		if pass == passes {
+			break
+		}
+		byPasses := config.SnapshotPasses > 0 && pass%config.SnapshotPasses == 0
+		bySeconds := config.SnapshotSeconds > 0 && time.Since(lastSnapshot).Seconds() >= config.SnapshotSeconds
+		if snapshotFile != "" && (byPasses || bySeconds) {
+			renderImage(scene, img)
+			if err := saveImage(snapshotFile, img); err != nil {
+				log.Printf("Error saving snapshot: %s", err.Error())
+			}
+			lastSnapshot = time.Now()
+		}
+	}
+	renderImage(scene, img)
+	return nil
+}
@@ -1,5 +1,7 @@
 package raytracer
 
+import "math"
+
 // DIFF floating point precision is a killing me.
 const DIFF = 0.000000001
 
@@ -22,37 +24,74 @@ func screenToWorld(x, y, width, height int, camera Vector, proj, view Matrix) (r
 	return rayDir
 }
 
+// screenToWorldOrtho conversion for parallel projections.
+// Rays share the same direction, their origins are spread across the near plane.
+func screenToWorldOrtho(x, y, width, height int, proj, view Matrix) (rayStart, rayDir Vector) {
+	var xF, yF float64
+	xF = (2.0*float64(x))/float64(width) - 1.0
+	yF = 1.0 - (2.0*float64(y))/float64(height)
+
+	invProj := invertMatrix(proj)
+	eyeCoords := vectorTransform(Vector{xF, yF, -1.0, 1.0}, invProj)
+	eyeCoords[3] = 1.0
+	invView := invertMatrix(view)
+	rayStart = vectorTransform(eyeCoords, invView)
+	rayDir = normalizeVector(vectorTransform(Vector{0, 0, -1.0, 0}, invView))
+	return rayStart, rayDir
+}
+
+// raycastTriangleIntersect with the watertight test of Woop, Benthin and Wald.
+// Vertices are moved to a space where the ray starts at the origin and goes
+// along z, the signs of the edge functions tell if the ray passes inside.
+// Rays through a shared edge or vertex hit at least one of the triangles.
 func raycastTriangleIntersect(start, vector, p1, p2, p3 *Vector) (intersection, normal *Vector, hit bool) {
-	v1 := psubVector(p2, p1)
-	v2 := psubVector(p3, p1)
-	pVec := pcrossProduct(vector, v2)
-	det := pdot(v1, pVec)
-	if (det < DIFF) && (det > -DIFF) {
-		hit = false
-		return
+	// Largest axis of the ray is z, x and y are swapped to keep the winding.
+	kz := 0
+	if math.Abs(vector[1]) > math.Abs(vector[kz]) {
+		kz = 1
+	}
+	if math.Abs(vector[2]) > math.Abs(vector[kz]) {
+		kz = 2
+	}
+	kx := (kz + 1) % 3
+	ky := (kx + 1) % 3
+	if vector[kz] < 0 {
+		kx, ky = ky, kx
 	}
-	invDet := 1 / det
-	tvec := psubVector(start, p1)
-	u := pdot(tvec, pVec) * invDet
-	if (u < 0) || (u > 1) {
-		hit = false
+	sz := 1 / vector[kz]
+	sx := vector[kx] * sz
+	sy := vector[ky] * sz
+
+	az := p1[kz] - start[kz]
+	bz := p2[kz] - start[kz]
+	cz := p3[kz] - start[kz]
+	ax := p1[kx] - start[kx] - sx*az
+	ay := p1[ky] - start[ky] - sy*az
+	bx := p2[kx] - start[kx] - sx*bz
+	by := p2[ky] - start[ky] - sy*bz
+	cx := p3[kx] - start[kx] - sx*cz
+	cy := p3[ky] - start[ky] - sy*cz
+
+	// Scaled barycentric coordinates, a hit when they all have the same sign.
+	u := cx*by - cy*bx
+	v := ax*cy - ay*cx
+	w := bx*ay - by*ax
+	if (u < 0 || v < 0 || w < 0) && (u > 0 || v > 0 || w > 0) {
 		return
 	}
-	qvec := pcrossProduct(tvec, v1)
-	v := pdot(vector, qvec) * invDet
-	res := (v > 0) && (u+v <= 1.0)
-	if !res {
-		hit = false
+	det := u + v + w
+	if det == 0 {
 		return
 	}
-	t := pdot(v2, qvec) * invDet
+	t := (u*az + v*bz + w*cz) * sz / det
 	if t <= 0 {
-		hit = false
 		return
 	}
-	intersection = pcombine(start, vector, 1.0, t)
-	intersection[3] = 1.0
-	normal = pnormalizeVector(pcrossProduct(v1, v2))
+	// On the triangle plane, rather than along the ray, to start the next rays from.
+	point := addVectors(scaleVector(*p1, u/det), scaleVector(*p2, v/det), scaleVector(*p3, w/det))
+	point[3] = 1.0
+	intersection = &point
+	normal = pnormalizeVector(pcrossProduct(psubVector(p2, p1), psubVector(p3, p1)))
 	if sameSideTest(*normal, *vector, 0) {
 		iNormal := scaleVector(*normal, -1)
 		normal = &iNormal
@@ -171,53 +210,93 @@ func raycastNodeIntersect(rayStart, rayDir *Vector, node *Node, intersection *In
 	}
 
 	for i := range node.Triangles {
-		intersectionPoint, normal, hit := raycastTriangleIntersect(
-			rayStart,
-			rayDir,
-			&node.Triangles[i].P1,
-			&node.Triangles[i].P2,
-			&node.Triangles[i].P3,
-		)
-		if hit {
-			intersection.Hits++
-			dist := pvectorDistance(intersectionPoint, rayStart)
-			if node.Triangles[i].Material.Texture != "" {
-				temp := Intersection{
-					Hit:                true,
-					IntersectionNormal: *normal,
-					Intersection:       *intersectionPoint,
-					Triangle:           &node.Triangles[i],
-					RayDir:             *rayDir,
-					RayStart:           *rayStart,
-					Dist:               dist,
-				}
-				if temp.getColor()[3] < 1 {
-					continue
-				}
-			}
-			if dist > 0 && (intersection.Dist == -1 || dist < intersection.Dist) {
-				intersection.Hit = true
-				intersection.IntersectionNormal = *normal
-				intersection.Intersection = *intersectionPoint
-				intersection.Triangle = &node.Triangles[i]
-				intersection.RayStart = *rayStart
-				intersection.RayDir = *rayDir
-				intersection.Dist = dist
-				intersection.getNormal()
-			}
+		raycastTriangle(rayStart, rayDir, &node.Triangles[i], intersection)
+	}
+}
+
+// raycastTriangle keeps the hit in the intersection if it's the closest so far.
+// Transparent texture pixels are not hit.
+func raycastTriangle(rayStart, rayDir *Vector, triangle *Triangle, intersection *Intersection) {
+	intersectionPoint, normal, hit := raycastTriangleIntersect(
+		rayStart,
+		rayDir,
+		&triangle.P1,
+		&triangle.P2,
+		&triangle.P3,
+	)
+	if !hit {
+		return
+	}
+	intersection.Hits++
+	dist := pvectorDistance(intersectionPoint, rayStart)
+	if triangle.Material.image != nil {
+		temp := Intersection{
+			Hit:                true,
+			IntersectionNormal: *normal,
+			Intersection:       *intersectionPoint,
+			Triangle:           triangle,
+			RayDir:             *rayDir,
+			RayStart:           *rayStart,
+			Dist:               dist,
 		}
+		if temp.textureColor()[3] < 1 {
+			return
+		}
+	}
+	if dist > 0 && (intersection.Dist == -1 || dist < intersection.Dist) {
+		intersection.Hit = true
+		intersection.IntersectionNormal = *normal
+		intersection.Intersection = *intersectionPoint
+		intersection.Triangle = triangle
+		intersection.RayStart = *rayStart
+		intersection.RayDir = *rayDir
+		intersection.Dist = dist
+		intersection.geometricNormal = *normal
+		intersection.instance = nil
+		intersection.primitive = nil
+		intersection.getNormal()
 	}
 }
 
 func raycastObjectIntersect(object *Object, rayStart, rayDir *Vector) (intersection Intersection) {
 	intersection.Dist = -1
+	if object.bvh != nil {
+		raycastBVHIntersect(rayStart, rayDir, object.bvh, object.Triangles, &intersection)
+		return
+	}
 	raycastNodeIntersect(rayStart, rayDir, &object.Root, &intersection)
 	return
 }
 
+// rayOffset of secondary ray origins from the surface, relative to the
+// magnitude of the hit position like its floating point error.
+const rayOffset = 1e-9
+
+// offsetRayOrigin moves the point off the surface along its geometric normal,
+// to the side the ray goes to, so the ray doesn't hit the surface it starts on.
+func offsetRayOrigin(point, normal, ray Vector) Vector {
+	magnitude := math.Max(math.Abs(point[0]), math.Max(math.Abs(point[1]), math.Abs(point[2])))
+	offset := rayOffset * math.Max(magnitude, 1)
+	if dot(normal, ray) < 0 {
+		offset = -offset
+	}
+	origin := addVector(point, scaleVector(normal, offset))
+	origin[3] = 1
+	return origin
+}
+
+// raycastSceneBounce casts a secondary ray from the hit point.
+func raycastSceneBounce(scene *Scene, hit *Intersection, ray Vector) Intersection {
+	return raycastSceneIntersect(scene, offsetRayOrigin(hit.Intersection, hit.geometricNormal, ray), ray)
+}
+
 func raycastSceneIntersect(scene *Scene, position, ray Vector) Intersection {
-	position = addVector(position, scaleVector(ray, GlobalConfig.RayCorrection))
+	// No direction, like the fisheye pixels outside the image circle.
+	if ray == (Vector{}) {
+		return Intersection{Dist: -1, RayDir: ray}
+	}
 	intersect := raycastObjectIntersect(scene.MasterObject, &position, &ray)
+	scene.raycastShapes(&position, &ray, &intersect)
 	intersect.RayDir = ray
 	if !intersect.Hit {
 		return intersect
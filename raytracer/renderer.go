@@ -0,0 +1,192 @@
+package raytracer
+
+import (
+	"context"
+	"image"
+	"io/fs"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// Renderer owns everything a render needs apart from the scene: the
+// configuration, texture caches, the environment map and the sample cache.
+// Renderers share nothing, so scenes can be rendered concurrently in one
+// process, each with its own renderer. A renderer renders one scene at a time.
+type Renderer struct {
+	Config Config
+
+	environmentMap [][]Vector
+	sampleCache    [][]Vector
+	// Textures of the scene directories, shared by the scenes loaded from them.
+	textures map[sceneDir]*textureCache
+	mu       sync.Mutex
+}
+
+// textureCache of the texture and bump map images loaded from a file system.
+type textureCache struct {
+	files    fs.FS
+	images   map[string][][]Vector
+	bumpMaps map[string][][]Vector
+	mu       sync.Mutex
+}
+
+// NewRenderer with the default configuration.
+func NewRenderer() *Renderer {
+	return &Renderer{
+		Config:   DEFAULT,
+		textures: make(map[sceneDir]*textureCache),
+	}
+}
+
+// LoadConfig replaces the configuration with the given config file,
+// keys missing in the file keep their default values.
+func (r *Renderer) LoadConfig(filename string) error {
+	config, err := loadConfig(filename)
+	if err != nil {
+		return err
+	}
+	r.Config = config
+	return nil
+}
+
+// LoadEnvironmentMap image for the rays that don't hit anything.
+func (r *Renderer) LoadEnvironmentMap(filename string) error {
+	imageFile, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer imageFile.Close()
+	src, _, err := image.Decode(imageFile)
+	if err != nil {
+		return err
+	}
+	r.environmentMap = imageToVectors(src)
+	r.Config.EnvironmentMap = filename
+	return nil
+}
+
+// Render the active camera of the scene with the configured size.
+// Stereo cameras return both eyes in one image, side by side unless top_bottom.
+// Nothing is written to disk, cancelling ctx returns the pixels finished so far
+// along with the context error.
+func (r *Renderer) Render(ctx context.Context, scene *Scene) (image.Image, error) {
+	if len(scene.Cameras) == 0 {
+		return nil, ErrNoCamera
+	}
+	r.prepare(scene, r.Config.Width, r.Config.Height)
+	region := image.Rect(0, 0, scene.Width, scene.Height)
+
+	observer := scene.camera()
+	if observer.Stereo == "" {
+		return renderView(ctx, scene, "", region, 100)
+	}
+	observer.eye = leftEye
+	leftImg, err := renderView(ctx, scene, "", region, 100)
+	rightImg := image.NewRGBA(leftImg.Bounds())
+	if err == nil {
+		observer.eye = rightEye
+		rightImg, err = renderView(ctx, scene, "", region, 100)
+	}
+	observer.eye = 0
+	return stackImages(leftImg, rightImg, observer.Stereo != StereoTopBottom), err
+}
+
+// prepare the scene for rendering with this renderer, scene geometry is only
+// prepared once and reused by the later renders of the same scene.
+func (r *Renderer) prepare(scene *Scene, width, height int) {
+	scene.renderer = r
+	if r.environmentMap == nil && r.Config.EnvironmentMap != "" {
+		if err := r.LoadEnvironmentMap(r.Config.EnvironmentMap); err != nil {
+			log.Printf("Environment Map [%s] can't be loaded: %s\n", r.Config.EnvironmentMap, err.Error())
+		}
+	}
+	// Shared between render workers, create before they start.
+	if r.sampleCache == nil {
+		r.createCache()
+	}
+	scene.prepare(width, height)
+}
+
+func (r *Renderer) createCache() {
+	r.sampleCache = make([][]Vector, 10)
+	// Create 10 different cache variations
+	for index := 0; index < 10; index++ {
+		r.sampleCache[index] = make([]Vector, 100000)
+		for i := 0; i < 100000; i++ {
+			x := rand.Float64() - 0.5
+			y := rand.Float64() - 0.5
+			z := rand.Float64() - 0.5
+			v := normalizeVector(Vector{x, y, z, 0})
+			r.sampleCache[index][i] = v
+		}
+	}
+}
+
+// textureCache of the scene files. Scene directories keep their textures for
+// the next scenes of the renderer, other file systems get a cache of their own.
+func (r *Renderer) textureCache(files fs.FS) *textureCache {
+	dir, ok := files.(sceneDir)
+	if !ok {
+		return newTextureCache(files)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.textures[dir] == nil {
+		r.textures[dir] = newTextureCache(files)
+	}
+	return r.textures[dir]
+}
+
+func newTextureCache(files fs.FS) *textureCache {
+	return &textureCache{
+		files:    files,
+		images:   make(map[string][][]Vector),
+		bumpMaps: make(map[string][][]Vector),
+	}
+}
+
+// texture image, loaded once.
+func (c *textureCache) texture(name string) [][]Vector {
+	return c.load(c.images, name, loadImage)
+}
+
+// bumpMap image, loaded once.
+func (c *textureCache) bumpMap(name string) [][]Vector {
+	return c.load(c.bumpMaps, name, loadBumpMap)
+}
+
+func (c *textureCache) load(images map[string][][]Vector, name string, load func(fs.FS, string) [][]Vector) [][]Vector {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if img, ok := images[name]; ok {
+		return img
+	}
+	img := load(c.files, name)
+	images[name] = img
+	return img
+}
+
+// environment color in the ray direction, transparent without an environment map.
+func (r *Renderer) environment(dir Vector) Vector {
+	if r.environmentMap == nil || dir == (Vector{}) {
+		return r.Config.TransparentColor
+	}
+	u := math.Atan2(dir[0], dir[1])/(2*math.Pi) + 0.5
+	v := dir[2]*0.5 + 0.5
+	w := float64(len(r.environmentMap)) - 1
+	h := float64(len(r.environmentMap[0])) - 1
+	pixelX := int(w * u)
+	pixelY := int(h - h*v)
+	return r.environmentMap[pixelX][pixelY]
+}
+
+func (r *Renderer) renderThreads() int {
+	if r.Config.Threads > 0 {
+		return r.Config.Threads
+	}
+	return runtime.NumCPU()
+}
@@ -0,0 +1,51 @@
+package raytracer
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// wrappedFS is comparable but holds a map, it can't be a map key.
+type wrappedFS struct {
+	fs.FS
+}
+
+func TestTextureCache(t *testing.T) {
+	buf := bytes.Buffer{}
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "wood.png"), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files := fstest.MapFS{"wood.png": {Data: buf.Bytes()}}
+	tests := []struct {
+		name   string
+		a, b   fs.FS
+		shared bool
+	}{
+		{"same scene directory", sceneDir(dir), sceneDir(dir), true},
+		{"map file system", files, files, false},
+		{"wrapped map file system", wrappedFS{files}, wrappedFS{files}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewRenderer()
+			a := r.textureCache(test.a).texture("wood.png")
+			b := r.textureCache(test.b).texture("wood.png")
+			if a == nil || b == nil {
+				t.Fatal("texture not loaded")
+			}
+			if shared := &a[0] == &b[0]; shared != test.shared {
+				t.Errorf("shared %v, want %v", shared, test.shared)
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package raytracer
+
+/*
+Binary scene files (.rlb) load much faster than JSON for big scenes.
+An .rlb file is the "RLBS" magic, the format version and flags as little
+endian uint32s, then the body, gzip compressed if the compressed flag is set.
+The body starts with the lights, cameras and primitives as length prefixed
+JSON, followed by the object tree: per object its name, the shared mesh name
+of instances, matrix as float64s, then vertices as xyz float64s, normals as
+xyz float32s, texture coordinates as uv float32s and vertex colors as rgba
+float32s, each list prefixed with its length. Positions keep their full
+precision, the attributes are rounded to float32. Materials follow as their name, length
+prefixed JSON and their faces as four uint32s each (three vertices and the
+smooth flag), then the children the same way.
+The shared meshes of instances follow the objects as another object tree.
+Referenced mesh files are stored inline, textures stay as file references.
+Version 1 files have no shared mesh names and no shared meshes, versions 1
+and 2 have float32 vertices.
+*/
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// BinarySceneExtension is the file extension of binary scene files.
+const BinarySceneExtension = ".rlb"
+
+const (
+	rlbVersion    = 3
+	rlbCompressed = 1 << 0
+	// Lists are read in chunks, corrupt lengths fail at the end of the file
+	// instead of allocating everything up front.
+	rlbChunk = 1 << 16
+)
+
+var rlbMagic = [4]byte{'R', 'L', 'B', 'S'}
+
+type rlbHeader struct {
+	Magic   [4]byte
+	Version uint32
+	Flags   uint32
+}
+
+// rlbInfo is the JSON part of the body.
+type rlbInfo struct {
+	Lights     []Light     `json:"lights"`
+	Cameras    []Camera    `json:"observers"`
+	Primitives []Primitive `json:"primitives"`
+}
+
+// rlbEncoder writes the body, the first error stops writing and is kept.
+type rlbEncoder struct {
+	w   *bufio.Writer
+	err error
+	buf []float32
+}
+
+// SaveBinary writes the scene to a binary scene file, see WriteBinary.
+func (s *Scene) SaveBinary(filename string, compress bool) error {
+	log.Printf("Saving %s", filename)
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := s.WriteBinary(f, compress); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WriteBinary writes the loaded scene in the binary scene format, before it is
+// prepared for rendering. Images embedded in glTF files are not kept.
+func (s *Scene) WriteBinary(w io.Writer, compress bool) error {
+	if s.MasterObject != nil {
+		return ErrScenePrepared
+	}
+	header := rlbHeader{Magic: rlbMagic, Version: rlbVersion}
+	if compress {
+		header.Flags |= rlbCompressed
+	}
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+	e := &rlbEncoder{w: bufio.NewWriter(w)}
+	e.json(rlbInfo{Lights: s.Lights, Cameras: s.Cameras, Primitives: s.Primitives})
+	e.objects(s.Objects)
+	e.objects(s.Meshes)
+	if e.err != nil {
+		return e.err
+	}
+	if err := e.w.Flush(); err != nil {
+		return err
+	}
+	if zw != nil {
+		return zw.Close()
+	}
+	return nil
+}
+
+func (e *rlbEncoder) write(data interface{}) {
+	if e.err == nil {
+		e.err = binary.Write(e.w, binary.LittleEndian, data)
+	}
+}
+
+func (e *rlbEncoder) string(s string) {
+	e.write(uint32(len(s)))
+	if e.err == nil {
+		_, e.err = e.w.WriteString(s)
+	}
+}
+
+func (e *rlbEncoder) json(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		e.err = err
+		return
+	}
+	e.string(string(data))
+}
+
+// vectors writes the first components of each vector as float32s.
+func (e *rlbEncoder) vectors(list []Vector, components int) {
+	e.write(uint32(len(list)))
+	for i := range list {
+		for j := 0; j < components; j++ {
+			e.buf = append(e.buf, float32(list[i][j]))
+		}
+		if len(e.buf) >= rlbChunk {
+			e.write(e.buf)
+			e.buf = e.buf[:0]
+		}
+	}
+	e.write(e.buf)
+	e.buf = e.buf[:0]
+}
+
+// positions writes the xyz of each vector as float64s.
+func (e *rlbEncoder) positions(list []Vector) {
+	e.write(uint32(len(list)))
+	buf := make([]float64, 0, rlbChunk)
+	for i := range list {
+		buf = append(buf, list[i][0], list[i][1], list[i][2])
+		if len(buf) >= rlbChunk {
+			e.write(buf)
+			buf = buf[:0]
+		}
+	}
+	e.write(buf)
+}
+
+func (e *rlbEncoder) objects(objects map[string]*Object) {
+	names := sortedObjectNames(objects)
+	e.write(uint32(len(names)))
+	for _, name := range names {
+		e.object(name, objects[name])
+	}
+}
+
+func (e *rlbEncoder) object(name string, obj *Object) {
+	e.string(name)
+	e.string(obj.Instance)
+	e.write(&obj.Matrix)
+	e.positions(obj.Vertices)
+	e.vectors(obj.Normals, 3)
+	e.vectors(obj.TexCoords, 2)
+	e.vectors(obj.Colors, 4)
+
+	names := obj.materialNames()
+	e.write(uint32(len(names)))
+	for _, name := range names {
+		mat := obj.Materials[name]
+		if mat.image != nil && mat.Texture == "" || mat.bumpMap != nil && mat.BumpMap == "" {
+			log.Printf("Embedded images of material %s are not kept", name)
+		}
+		faces := make([]uint32, 0, rlbChunk)
+		e.string(name)
+		indices := mat.Indices
+		mat.Indices = nil
+		e.json(&mat)
+		e.write(uint32(len(indices)))
+		for _, face := range indices {
+			faces = append(faces, uint32(face[0]), uint32(face[1]), uint32(face[2]), uint32(face[3]))
+			if len(faces) >= rlbChunk {
+				e.write(faces)
+				faces = faces[:0]
+			}
+		}
+		e.write(faces)
+	}
+	e.objects(obj.Children)
+}
+
+// rlbDecoder reads the body, the first error stops reading and is kept.
+type rlbDecoder struct {
+	r       io.Reader
+	err     error
+	version uint32
+}
+
+func isBinaryScene(magic []byte) bool {
+	return len(magic) >= len(rlbMagic) && string(magic[:len(rlbMagic)]) == string(rlbMagic[:])
+}
+
+// readBinary scene from r, after the JSON and glTF data is sniffed.
+func (s *Scene) readBinary(r io.Reader) error {
+	header := rlbHeader{}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if header.Magic != rlbMagic {
+		return errors.New("not a binary scene")
+	}
+	if header.Version < 1 || header.Version > rlbVersion {
+		return fmt.Errorf("binary scene version %d, expected up to %d", header.Version, rlbVersion)
+	}
+	if header.Flags&rlbCompressed != 0 {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	d := &rlbDecoder{r: bufio.NewReader(r), version: header.Version}
+	info := rlbInfo{}
+	d.json(&info)
+	s.Lights = info.Lights
+	s.Cameras = info.Cameras
+	s.Primitives = info.Primitives
+	s.Objects = d.objects()
+	if d.version >= 2 {
+		s.Meshes = d.objects()
+	}
+	return d.err
+}
+
+func (d *rlbDecoder) read(data interface{}) {
+	if d.err == nil {
+		d.err = binary.Read(d.r, binary.LittleEndian, data)
+		if d.err == io.EOF {
+			d.err = io.ErrUnexpectedEOF
+		}
+	}
+}
+
+// chunkSize of the next read with remaining elements left.
+func chunkSize(remaining int) int {
+	if remaining < rlbChunk {
+		return remaining
+	}
+	return rlbChunk
+}
+
+func (d *rlbDecoder) count() int {
+	var n uint32
+	d.read(&n)
+	return int(n)
+}
+
+func (d *rlbDecoder) bytes() []byte {
+	n := d.count()
+	var data []byte
+	for d.err == nil && len(data) < n {
+		chunk := make([]byte, chunkSize(n-len(data)))
+		d.read(chunk)
+		data = append(data, chunk...)
+	}
+	return data
+}
+
+func (d *rlbDecoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *rlbDecoder) json(v interface{}) {
+	data := d.bytes()
+	if d.err == nil {
+		d.err = json.Unmarshal(data, v)
+	}
+}
+
+// vectors reads vectors with the given number of components, the missing
+// components are zero and w is the given one.
+func (d *rlbDecoder) vectors(components int, w float64) []Vector {
+	n := d.count()
+	if n == 0 || d.err != nil {
+		return nil
+	}
+	var result []Vector
+	buf := make([]float32, 0, rlbChunk*components)
+	for d.err == nil && len(result) < n {
+		chunk := buf[:chunkSize(n-len(result))*components]
+		d.read(chunk)
+		for i := 0; i < len(chunk); i += components {
+			v := Vector{0, 0, 0, w}
+			for j := 0; j < components; j++ {
+				v[j] = float64(chunk[i+j])
+			}
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// positions reads xyz float64s with w 1, float32s before version 3.
+func (d *rlbDecoder) positions() []Vector {
+	if d.version < 3 {
+		return d.vectors(3, 1)
+	}
+	n := d.count()
+	if n == 0 || d.err != nil {
+		return nil
+	}
+	var result []Vector
+	buf := make([]float64, 0, rlbChunk*3)
+	for d.err == nil && len(result) < n {
+		chunk := buf[:chunkSize(n-len(result))*3]
+		d.read(chunk)
+		for i := 0; i < len(chunk); i += 3 {
+			result = append(result, Vector{chunk[i], chunk[i+1], chunk[i+2], 1})
+		}
+	}
+	return result
+}
+
+func (d *rlbDecoder) objects() map[string]*Object {
+	n := d.count()
+	if n == 0 || d.err != nil {
+		return nil
+	}
+	objects := make(map[string]*Object)
+	for i := 0; i < n && d.err == nil; i++ {
+		name := d.string()
+		objects[name] = d.object()
+	}
+	return objects
+}
+
+func (d *rlbDecoder) object() *Object {
+	obj := &Object{Materials: make(map[string]Material)}
+	if d.version >= 2 {
+		obj.Instance = d.string()
+	}
+	d.read(&obj.Matrix)
+	obj.Vertices = d.positions()
+	obj.Normals = d.vectors(3, 0)
+	obj.TexCoords = d.vectors(2, 0)
+	obj.Colors = d.vectors(4, 0)
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		name := d.string()
+		mat := Material{}
+		d.json(&mat)
+		faces := d.count()
+		buf := make([]uint32, 0, rlbChunk*4)
+		for d.err == nil && len(mat.Indices) < faces {
+			chunk := buf[:chunkSize(faces-len(mat.Indices))*4]
+			d.read(chunk)
+			for j := 0; j < len(chunk); j += 4 {
+				face := indice{int64(chunk[j]), int64(chunk[j+1]), int64(chunk[j+2]), int64(chunk[j+3])}
+				if face[0] >= int64(len(obj.Vertices)) || face[1] >= int64(len(obj.Vertices)) || face[2] >= int64(len(obj.Vertices)) {
+					d.err = fmt.Errorf("material %s face out of %d vertices", name, len(obj.Vertices))
+					break
+				}
+				mat.Indices = append(mat.Indices, face)
+			}
+		}
+		obj.Materials[name] = mat
+	}
+	if d.err == nil && len(obj.Vertices) != len(obj.Normals) {
+		d.err = fmt.Errorf("object with %d vertices and %d normals", len(obj.Vertices), len(obj.Normals))
+	}
+	obj.Children = d.objects()
+	return obj
+}
@@ -0,0 +1,114 @@
+package raytracer
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// rlbScene with coordinates too big for float32 and float32 exact attributes.
+func rlbScene() *Scene {
+	s := NewScene(SceneOptions{})
+	grid := NewObject()
+	grid.Materials["wood"] = Material{Color: Vector{0.5, 0.25, 1, 1}, Texture: "wood.png", Glossiness: 0.5}
+	for i := 0; i < 4; i++ {
+		offset := 1e7 + float64(i)*0.123456789
+		grid.AddVertex(Vector{offset, -offset, 3.000000001, 1}, Vector{0, -1, 0, 0}, Vector{0.25 * float64(i), 0.5, 0, 0})
+		grid.Colors = append(grid.Colors, Vector{0.5, 0.25, 0.125, 1})
+	}
+	_ = grid.AddFace("wood", 0, 1, 2, true)
+	_ = grid.AddFace("wood", 0, 2, 3, false)
+	child := NewObject()
+	child.Materials["metal"] = Material{Color: Vector{1, 1, 1, 1}, Light: true, LightStrength: 3, EmissionColor: Vector{1, 0.5, 0, 1}}
+	child.AddVertex(Vector{1, 2, 3, 1}, Vector{0, 0, 1, 0}, Vector{})
+	child.AddVertex(Vector{4, 5, 6, 1}, Vector{0, 0, 1, 0}, Vector{})
+	child.AddVertex(Vector{7, 8, 9.5, 1}, Vector{0, 0, 1, 0}, Vector{})
+	_ = child.AddFace("metal", 0, 1, 2, false)
+	grid.Children = map[string]*Object{"child": child}
+	_ = s.AddObject("grid", grid)
+
+	instance := NewObject()
+	instance.Instance = "bolt"
+	instance.Matrix[3] = Vector{10, 20, 30, 1}
+	_ = s.AddObject("bolt.001", instance)
+	bolt := NewObject()
+	bolt.Materials["steel"] = Material{Color: Vector{0.75, 0.75, 0.75, 1}}
+	bolt.AddVertex(Vector{0, 0, 0, 1}, Vector{1, 0, 0, 0}, Vector{})
+	bolt.AddVertex(Vector{1, 0, 0, 1}, Vector{1, 0, 0, 0}, Vector{})
+	bolt.AddVertex(Vector{0, 1, 0, 1}, Vector{1, 0, 0, 0}, Vector{})
+	_ = bolt.AddFace("steel", 0, 1, 2, false)
+	_ = s.AddMesh("bolt", bolt)
+
+	_ = s.AddLight(Light{Position: Vector{1, 2, 3, 1}, Color: Vector{1, 1, 1, 1}, Active: true, LightStrength: 2, Spot: true, InnerAngle: 30, OuterAngle: 45})
+	_ = s.AddPrimitive(Primitive{Name: "ball", Type: PrimitiveSphere, Position: Vector{0, 0, 1, 1}, Radius: 1, Material: Material{Color: Vector{1, 0, 0, 1}}})
+	s.AddCamera(Camera{Position: Vector{0, -10, 2, 1}, Target: Vector{0, 0, 0, 1}, Up: Vector{0, 0, 1, 0}, Fov: 40, Perspective: true})
+	return s
+}
+
+func TestBinarySceneRoundtrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		compress bool
+	}{
+		{"plain", false},
+		{"compressed", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := rlbScene()
+			buf := bytes.Buffer{}
+			if err := want.WriteBinary(&buf, test.compress); err != nil {
+				t.Fatal(err)
+			}
+			got := NewScene(SceneOptions{})
+			if err := got.load(&buf); err != nil {
+				t.Fatal(err)
+			}
+			for name, obj := range want.Objects {
+				if !reflect.DeepEqual(got.Objects[name], obj) {
+					t.Errorf("object %s\ngot  %+v\nwant %+v", name, got.Objects[name], obj)
+				}
+			}
+			if len(got.Objects) != len(want.Objects) {
+				t.Errorf("%d objects, want %d", len(got.Objects), len(want.Objects))
+			}
+			if !reflect.DeepEqual(got.Meshes, want.Meshes) {
+				t.Errorf("meshes\ngot  %+v\nwant %+v", got.Meshes, want.Meshes)
+			}
+			if !reflect.DeepEqual(got.Lights, want.Lights) {
+				t.Errorf("lights\ngot  %+v\nwant %+v", got.Lights, want.Lights)
+			}
+			if !reflect.DeepEqual(got.Primitives, want.Primitives) {
+				t.Errorf("primitives\ngot  %+v\nwant %+v", got.Primitives, want.Primitives)
+			}
+			if !reflect.DeepEqual(got.Cameras, want.Cameras) {
+				t.Errorf("cameras\ngot  %+v\nwant %+v", got.Cameras, want.Cameras)
+			}
+		})
+	}
+}
+
+func TestBinarySceneErrors(t *testing.T) {
+	buf := bytes.Buffer{}
+	if err := rlbScene().WriteBinary(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	future := append([]byte{}, data...)
+	future[4] = rlbVersion + 1
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated header", data[:6]},
+		{"truncated body", data[:len(data)-1]},
+		{"future version", future},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := NewScene(SceneOptions{}).load(bytes.NewReader(test.data)); err == nil {
+				t.Error("loaded a broken scene")
+			}
+		})
+	}
+}
@@ -1,31 +1,13 @@
 package raytracer
 
 import (
+	"math"
 	"math/rand"
 	"sort"
 )
 
-var sampleCache [][]Vector
-
-func createCache() {
-	sampleCache = make([][]Vector, 10)
-	// Create 10 different cache variations
-	for index := 0; index < 10; index++ {
-		sampleCache[index] = make([]Vector, 100000)
-		for i := 0; i < 100000; i++ {
-			x := rand.Float64() - 0.5
-			y := rand.Float64() - 0.5
-			z := rand.Float64() - 0.5
-			v := normalizeVector(Vector{x, y, z, 0})
-			sampleCache[index][i] = v
-		}
-	}
-}
-
-func createSamples(normal Vector, limit int, shifting float64) []Vector {
-	if sampleCache == nil {
-		createCache()
-	}
+func (r *Renderer) createSamples(normal Vector, limit int, shifting float64) []Vector {
+	sampleCache := r.sampleCache
 	index := rand.Int() % 10
 
 	result := make([]Vector, 0, limit)
@@ -74,3 +56,50 @@ func sampleTriangle(triangle Triangle, count int) []Vector {
 	}
 	return result
 }
+
+// cosineSampleHemisphere returns a random direction around normal,
+// more likely to be close to the normal, proportional to the cosine.
+func cosineSampleHemisphere(normal Vector) Vector {
+	r1 := rand.Float64()
+	r2 := rand.Float64()
+	phi := 2 * math.Pi * r1
+	r := math.Sqrt(r2)
+	tangent, bitangent := orthonormalBasis(normal)
+	dir := combine(tangent, bitangent, r*math.Cos(phi), r*math.Sin(phi))
+	dir = combine(dir, normal, 1.0, math.Sqrt(1-r2))
+	dir[3] = 0
+	return normalizeVector(dir)
+}
+
+// orthonormalBasis finds two unit vectors perpendicular to the normal and each other.
+func orthonormalBasis(normal Vector) (tangent, bitangent Vector) {
+	helper := Vector{1, 0, 0, 0}
+	if math.Abs(normal[0]) > 0.9 {
+		helper = Vector{0, 1, 0, 0}
+	}
+	tangent = normalizeVector(crossProduct(helper, normal))
+	bitangent = crossProduct(normal, tangent)
+	return tangent, bitangent
+}
+
+// sampleAperture returns a random point on a unit lens. Lenses with less than
+// three blades are round, others are regular polygons rotated by degrees.
+func sampleAperture(blades int, rotation float64) (x, y float64) {
+	if blades < 3 {
+		r := math.Sqrt(rand.Float64())
+		theta := 2 * math.Pi * rand.Float64()
+		return r * math.Cos(theta), r * math.Sin(theta)
+	}
+	// Pick one of the equal sized blade triangles around the center and
+	// sample a point uniformly inside it.
+	blade := float64(rand.Intn(blades))
+	step := 2 * math.Pi / float64(blades)
+	rot := rotation * math.Pi / 180.0
+	a, b := rand.Float64(), rand.Float64()
+	if a+b > 1 {
+		a, b = 1-a, 1-b
+	}
+	x = a*math.Cos(blade*step+rot) + b*math.Cos((blade+1)*step+rot)
+	y = a*math.Sin(blade*step+rot) + b*math.Sin((blade+1)*step+rot)
+	return x, y
+}
@@ -1,24 +1,28 @@
 package raytracer
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
-	"image"
+	"errors"
+	"fmt"
 	_ "image/jpeg" // fuck you go-linter
 	_ "image/png"  // fuck you go-linter
-	"io/ioutil"
+	"io"
+	"io/fs"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
-
-	"github.com/cheggaaa/pb"
 )
 
-// EnvironmentMap cache.
-var EnvironmentMap [][]Vector
-var hasEnvironmentMap bool
-
 // Light structure.
+// Spot lights shine from Position towards Direction, fully inside the
+// InnerAngle cone and fading out to the OuterAngle cone, angles are the full
+// cone angles in degrees. SpotFalloff is the exponent of the fade, 1 if unset.
 type Light struct {
 	Position      Vector  `json:"position"`
 	Color         Vector  `json:"color"`
@@ -26,24 +30,25 @@ type Light struct {
 	LightStrength float64 `json:"light_strength"`
 	Directional   bool    `json:"directional_light"`
 	Direction     Vector  `json:"direction"`
+	Spot          bool    `json:"spot_light"`
+	InnerAngle    float64 `json:"inner_cone_angle"`
+	OuterAngle    float64 `json:"outer_cone_angle"`
+	SpotFalloff   float64 `json:"spot_falloff"`
 	Samples       []Vector
+	emitter       bool
+	// Geometric normal of lights on a surface, rays start off the surface.
+	normal Vector
+	// Cosines of the spot cone half angles.
+	cosInner float64
+	cosOuter float64
 }
 
-// Camera structure.
-type Camera struct {
-	Position    Vector  `json:"position"`
-	Target      Vector  `json:"target"`
-	Up          Vector  `json:"up"`
-	Fov         float64 `json:"fov"`
-	AspectRatio float64 `json:"aspect_ratio"`
-	Zoom        float64 `json:"zoom"`
-	Near        float64 `json:"near"`
-	Far         float64 `json:"far"`
-	Perspective bool    `json:"perspective"`
-	Projection  *Matrix `json:"projection"`
-	view        Matrix
-	width       int
-	height      int
+// rayOrigin of the rays cast from the light in the direction.
+func (l *Light) rayOrigin(ray Vector) Vector {
+	if l.normal == (Vector{}) {
+		return l.Position
+	}
+	return offsetRayOrigin(l.Position, l.normal, ray)
 }
 
 // PixelStorage to Store pixel information before turning it into a png
@@ -54,106 +59,179 @@ type PixelStorage struct {
 	Color             Vector
 	AmbientColor      Vector
 	Depth             float64
+	Samples           int
 	X                 int
 	Y                 int
+	m2                float64
+}
+
+// addSample to the running average of the pixel color, also keeps the
+// running variance of the luminance (Welford's method) to measure noise.
+func (p *PixelStorage) addSample(color Vector) {
+	sample := luminance(color)
+	delta := sample - luminance(p.Color)
+	p.Samples++
+	p.Color = combine(p.Color, color, 1.0-1.0/float64(p.Samples), 1.0/float64(p.Samples))
+	p.m2 += delta * (sample - luminance(p.Color))
+}
+
+// noise is the standard error of the pixel luminance.
+func (p *PixelStorage) noise() float64 {
+	if p.Samples < 2 {
+		return math.Inf(1)
+	}
+	variance := p.m2 / float64(p.Samples-1)
+	return math.Sqrt(variance / float64(p.Samples))
+}
+
+func (p *PixelStorage) converged(config *Config) bool {
+	return p.Samples >= config.MinSamples && p.noise() <= config.NoiseThreshold
 }
 
 // Scene main structure.
 type Scene struct {
 	Objects        map[string]*Object `json:"objects"`
+	Meshes         map[string]*Object `json:"meshes"`
+	Primitives     []Primitive        `json:"primitives"`
 	MasterObject   *Object
 	Lights         []Light  `json:"lights"`
 	Cameras        []Camera `json:"observers"`
+	ActiveCamera   int
 	Pixels         [][]PixelStorage
 	Width          int
 	Height         int
 	ShortRadius    float64
 	InputFilename  string
 	OutputFilename string
+	SampleMap      bool
+	Resume         bool
+	renderer       *Renderer
+	files          fs.FS
+	// geometryHash of the objects, taken before they are merged.
+	geometry [sha256.Size]byte
+	// renderHash of the scene as it is defined, before lights are sampled.
+	hash         [sha256.Size]byte
+	emitters     []*Triangle
+	emitterAreas []float64
+	// Caustic photons, nil unless they are rendered.
+	photons *photonMap
+	// Flattened shared meshes and the objects instancing them, until prepared.
+	meshParts       map[string]map[string]*Object
+	instanceObjects map[string]*Object
+	instances       []instance
+	bounded         []*Primitive
+	unbounded       []*Primitive
+	shapeTree       *bvh
+}
+
+// ErrScenePrepared is returned when changing a scene that is already prepared for rendering.
+var ErrScenePrepared = errors.New("scene is already prepared")
+
+// SceneOptions for scenes that don't come from a scene file.
+// Textures and meshes are resolved in Files, the working directory if it is nil.
+type SceneOptions struct {
+	Files fs.FS
 }
 
-// Init scene.
-func (s *Scene) Init(sceneFile, configFile, environmentMap string) error {
+// sceneDir opens files as they are given, absolute or relative to the working
+// directory, and falls back to the scene directory; exporters write texture
+// paths either way.
+type sceneDir string
+
+func (d sceneDir) Open(name string) (fs.File, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return os.Open(filepath.Join(string(d), name))
+	}
+	return f, err
+}
+
+// Init scene from the scene JSON file, a binary scene or a glTF file.
+func (s *Scene) Init(sceneFile string) error {
 	log.Print("Initializing the scene")
-	if configFile == "" {
-		log.Print("No config set, setting defaults")
-		GlobalConfig = DEFAULT
-	} else {
-		err := loadConfig(configFile)
-		if err != nil {
-			return err
-		}
+	start := time.Now()
+	log.Printf("Loading file: %s\n", sceneFile)
+	if isGLTF(sceneFile) {
+		s.InputFilename = sceneFile
+		s.files = sceneDir(filepath.Dir(sceneFile))
+		return s.loadGLTF(s.files, sceneFile)
 	}
-	if GlobalConfig.EnvironmentMap != "" && environmentMap == "" {
-		environmentMap = GlobalConfig.EnvironmentMap
+	file, err := os.Open(sceneFile)
+	if err != nil {
+		return err
 	}
-	if environmentMap != "" {
-		s.loadEnvironmentMap(environmentMap)
+	defer file.Close()
+	if err := s.load(file); err != nil {
+		return fmt.Errorf("%s: %w", sceneFile, err)
+	}
+	s.InputFilename = sceneFile
+	s.files = sceneDir(filepath.Dir(sceneFile))
+	if err := s.loadMeshes(); err != nil {
+		return err
 	}
-	return s.loadJSON(sceneFile)
+	log.Printf("Loaded scene in %f seconds\n", time.Since(start).Seconds())
+	return nil
 }
 
-func (s *Scene) loadEnvironmentMap(mapFilename string) {
-	imageFile, err := os.Open(mapFilename)
-	if err != nil {
-		log.Printf("Environment Map [%s] can't be opened\n", mapFilename)
-		imageFile.Close() // defer has over-head
-		return
+// LoadScene from scene JSON or a binary scene, errors are returned instead of logged.
+func LoadScene(r io.Reader, opts SceneOptions) (*Scene, error) {
+	s := &Scene{files: opts.Files}
+	if err := s.load(r); err != nil {
+		return nil, err
 	}
-	src, _, err := image.Decode(imageFile)
-	if err != nil {
-		log.Printf("Error reading image file [%s]: [%s]\n", mapFilename, err.Error())
-		imageFile.Close()
-		return
+	if err := s.loadMeshes(); err != nil {
+		return nil, err
 	}
+	return s, nil
+}
 
-	imgBounds := src.Bounds().Max
-	EnvironmentMap = make([][]Vector, imgBounds.X)
-	for i := 0; i < imgBounds.X; i++ {
-		EnvironmentMap[i] = make([]Vector, imgBounds.Y)
-		for j := 0; j < imgBounds.Y; j++ {
-			r, g, b, a := src.At(i, j).RGBA()
-			r, g, b, a = r>>8, g>>8, b>>8, a>>8
-
-			result := Vector{
-				float64(r) / 255,
-				float64(g) / 255,
-				float64(b) / 255,
-				float64(a) / 255,
-			}
-			EnvironmentMap[i][j] = result
-		}
+// load JSON or a binary scene, told apart by the magic bytes of binary scenes.
+func (s *Scene) load(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(rlbMagic))
+	if isBinaryScene(magic) {
+		log.Printf("Reading binary scene\n")
+		return s.readBinary(br)
 	}
-	imageFile.Close()
-	hasEnvironmentMap = true
+	return s.loadJSON(br)
 }
 
-func (s *Scene) loadJSON(jsonFile string) error {
-	start := time.Now()
-	log.Printf("Loading file: %s\n", jsonFile)
-	file, err := ioutil.ReadFile(jsonFile)
-	if err != nil {
-		log.Fatalf("Error while reading file: %s", err.Error())
-		return err
-	}
+func (s *Scene) loadJSON(r io.Reader) error {
 	log.Printf("Unmarshal JSON\n")
-	err = json.Unmarshal(file, &s)
-	if err != nil {
-		log.Fatalf("Error unmarshalling %s", err.Error())
-		return err
+	return json.NewDecoder(r).Decode(s)
+}
+
+func (s *Scene) mergeAll() {
+	gigaMesh := s.masterObject()
+	// Objects are merged in name order, the KDTree cache relies on it.
+	for _, name := range sortedObjectNames(s.Objects) {
+		gigaMesh.Triangles = append(gigaMesh.Triangles, s.Objects[name].Triangles...)
+		s.Objects[name] = nil
 	}
-	s.InputFilename = jsonFile
-	log.Printf("Fixing object Ws\n")
-	for name := range s.Objects {
-		s.Objects[name].fixW()
-		s.Objects[name].calcRadius()
+	// Triangle ids tell the surfaces apart, unique within the scene.
+	for i := range gigaMesh.Triangles {
+		gigaMesh.Triangles[i].id = int64(i + 1)
 	}
+	gigaMesh.calcRadius()
+	s.buildTree(&gigaMesh)
+	log.Printf("Object ready")
+	s.Objects = nil
+	s.MasterObject = &gigaMesh
+}
 
-	log.Printf("Loaded scene in %f seconds\n", time.Since(start).Seconds())
-	return nil
+// buildTree of the object with the configured accelerator.
+func (s *Scene) buildTree(o *Object) {
+	if s.renderer.Config.Accelerator == AcceleratorBVH {
+		log.Printf("Build BVH")
+		o.BVH(s.renderer.renderThreads())
+	} else {
+		log.Printf("Build KDTree")
+		o.KDTree()
+	}
 }
 
-func (s *Scene) mergeAll() {
+// masterObject with the materials of all scene objects, without triangles.
+func (s *Scene) masterObject() Object {
 	gigaMesh := Object{
 		Matrix: identityHmgMatrix,
 	}
@@ -163,88 +241,104 @@ func (s *Scene) mergeAll() {
 		for k, m := range s.Objects[obj].Materials {
 			gigaMesh.Materials[k] = m
 		}
-		gigaMesh.Triangles = append(gigaMesh.Triangles, s.Objects[obj].Triangles...)
-		s.Objects[obj] = nil
 	}
-	gigaMesh.calcRadius()
-	log.Printf("Build KDTree")
-	gigaMesh.KDTree()
-	log.Printf("Built %d nodes with %d max depth, object ready", totalNodes, maxDepth)
-	s.Objects = nil
-	s.MasterObject = &gigaMesh
+	return gigaMesh
 }
 
 func (s *Scene) prepare(width, height int) {
 	s.Width = width
 	s.Height = height
+	if s.MasterObject != nil {
+		log.Printf("Scene is already prepared")
+		return
+	}
 	// Order of below calls is important!
 	log.Printf("Init scene")
-	s.flatten()
-	// log.Printf("After flatten")
-	// PrintMemUsage()
-	s.processObjects()
-	// log.Printf("After objects processing")
-	// PrintMemUsage()
-	s.mergeAll()
+	s.prepareObjects()
 	// log.Printf("After mergeall")
 	// PrintMemUsage()
-	s.parseMaterials()
+	s.prepareShapes()
 	s.fixLightPos()
+	// Sampled lights are random, they are not part of the hash.
+	s.hash = s.renderHash()
 	s.loadLights()
-	s.prepareMatrices()
 	log.Printf("After parse materials")
 	PrintMemUsage()
-	s.scanPixels()
-	log.Printf("When we prep scene")
-	PrintMemUsage()
-	if GlobalConfig.RenderCaustics {
+	if s.renderer.Config.RenderCaustics {
 		s.buildPhotonMap()
 	}
 	log.Printf("Done init scene")
 }
 
-func (s *Scene) prepareMatrices() {
-	view := viewMatrix(s.Cameras[0].Position, s.Cameras[0].Target, s.Cameras[0].Up)
-	projectionMatrix := perspectiveProjection(
-		s.Cameras[0].Fov,
-		float64(s.Width)/float64(s.Height),
-		s.Cameras[0].Near,
-		s.Cameras[0].Far,
-	)
-	if s.Cameras[0].Projection == nil {
-		s.Cameras[0].Projection = &projectionMatrix
+// prepareObjects flattens the scene objects and merges them into the master
+// object with its tree, read from the KD-tree cache when it is up to date.
+// Returns true when the cache was used.
+func (s *Scene) prepareObjects() bool {
+	s.fixObjects()
+	s.flatten()
+	// log.Printf("After flatten")
+	// PrintMemUsage()
+	// Triangles refer to copies of the materials, textures must be there before.
+	s.parseMaterials()
+	s.splitInstances()
+	s.geometry = s.geometryHash()
+	cache := s.kdCache()
+	if cache.load(s) {
+		return true
 	}
+	s.processObjects()
+	// log.Printf("After objects processing")
+	// PrintMemUsage()
+	s.mergeAll()
+	cache.save(s)
+	return false
+}
 
-	s.Cameras[0].view = view
-	s.Cameras[0].width = s.Width
-	s.Cameras[0].height = s.Height
+// prepareCamera sets up the active camera and casts the primary rays of the tiles.
+// Scene geometry must already be prepared, it is shared between cameras.
+func (s *Scene) prepareCamera(ctx context.Context, tiles []tile) error {
+	log.Printf("Prepare camera %s", s.camera().label(s.ActiveCamera))
+	s.prepareMatrices()
+	s.allocatePixels()
+	if err := s.scanPixels(ctx, tiles); err != nil {
+		return err
+	}
+	log.Printf("When we prep camera")
+	PrintMemUsage()
+	return nil
 }
 
-func (s *Scene) scanPixels() {
-	log.Printf("Scanning pixels on view")
-	bar := pb.StartNew(s.Width * s.Height)
+func (s *Scene) prepareMatrices() {
+	s.camera().prepare(s.Width, s.Height)
+}
+
+func (s *Scene) allocatePixels() {
 	s.Pixels = make([][]PixelStorage, s.Width)
 	for i := 0; i < s.Width; i++ {
 		s.Pixels[i] = make([]PixelStorage, s.Height)
 		for j := 0; j < s.Height; j++ {
-			s.Pixels[i][j].Color = GlobalConfig.TransparentColor
+			s.Pixels[i][j].Color = s.renderer.Config.TransparentColor
 		}
 	}
 	log.Println("After pixel storage")
 	PrintMemUsage()
+}
 
-	for i := 0; i < s.Width; i++ {
-		for j := 0; j < s.Height; j++ {
-			rayDir := screenToWorld(i, j, s.Width, s.Height, s.Cameras[0].Position, *s.Cameras[0].Projection, s.Cameras[0].view)
-			bestHit := raycastSceneIntersect(s, s.Cameras[0].Position, rayDir)
-			s.Pixels[i][j].WorldLocation = bestHit
-			bar.Increment()
-		}
+// scanPixels casts the primary rays, only for the pixels that will be rendered.
+func (s *Scene) scanPixels(ctx context.Context, tiles []tile) error {
+	log.Printf("Scanning pixels on view")
+	observer := s.camera()
+	err := renderTiles(ctx, s.renderer.renderThreads(), tiles, func(i, j int) {
+		rayStart, rayDir := observer.ray(i, j, s.Width, s.Height)
+		s.Pixels[i][j].WorldLocation = raycastSceneIntersect(s, rayStart, rayDir)
+	})
+	if err != nil {
+		return err
 	}
 	log.Printf("After pixel raycasts")
 	PrintMemUsage()
-	bar.Finish()
 	log.Printf("Done scanning pixels")
+	return nil
 }
 
 func (s *Scene) buildPhotonMap() {
@@ -253,24 +347,33 @@ func (s *Scene) buildPhotonMap() {
 }
 
 func (s *Scene) loadLights() {
-	for i := range s.MasterObject.Triangles {
-		if !s.MasterObject.Triangles[i].Material.Light {
-			continue
+	for i := range s.Lights {
+		if s.Lights[i].Directional && s.Lights[i].Samples == nil {
+			s.Lights[i].Samples = sampleSphere(sunRadius, s.renderer.Config.LightSampleCount)
 		}
-		mat := s.MasterObject.Triangles[i].Material
-		lights := sampleTriangle(s.MasterObject.Triangles[i], GlobalConfig.LightSampleCount)
-		strength := s.MasterObject.Triangles[i].Material.LightStrength
+		if s.Lights[i].Spot {
+			s.Lights[i].prepareSpot()
+		}
+	}
+	for _, triangle := range s.lightTriangles() {
+		mat := triangle.Material
+		lights := sampleTriangle(*triangle, s.renderer.Config.LightSampleCount)
+		normal := triangle.normal()
+		strength := triangle.Material.LightStrength
 		for li := range lights {
 			light := Light{
 				Position:      lights[li],
-				Color:         mat.Color,
+				Color:         mat.lightColor(),
 				Active:        true,
 				LightStrength: strength,
+				emitter:       true,
+				normal:        normal,
 				// HitExceptions: make(map[int64]bool),
 			}
 			s.Lights = append(s.Lights, light)
 		}
 	}
+	s.collectEmitters()
 }
 
 // Lights have 0 as w but they are not vectors, they are positions;
@@ -281,9 +384,39 @@ func (s *Scene) fixLightPos() {
 	}
 }
 
+// fixObjects sets the w of the object vectors, JSON and the builder leave them as they are.
+func (s *Scene) fixObjects() {
+	log.Printf("Fixing object Ws\n")
+	for name := range s.Objects {
+		s.Objects[name].fixW()
+		s.Objects[name].calcRadius()
+	}
+	for name := range s.Meshes {
+		s.Meshes[name].fixW()
+	}
+}
+
+// sortedObjectNames to go through the objects in the same order each time.
+func sortedObjectNames(objects map[string]*Object) []string {
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (s *Scene) flatten() {
 	log.Printf("Flatten Scene Objects\n")
 	s.Objects = flattenSceneObjects(s.Objects)
+	// Shared meshes are flattened in their own space.
+	s.meshParts = make(map[string]map[string]*Object)
+	for name, mesh := range s.Meshes {
+		if mesh.Matrix == (Matrix{}) {
+			mesh.Matrix = identityHmgMatrix
+		}
+		s.meshParts[name] = flattenSceneObjects(map[string]*Object{name: mesh})
+	}
 }
 
 // Flatten Scene Objects and move them to root
@@ -312,36 +445,55 @@ func (s *Scene) processObjects() {
 		log.Printf("Prepare object %s", k)
 		obj := s.Objects[k]
 		log.Printf("Local to absolute")
-		absoluteVertices := localToAbsoluteList(obj.Vertices, obj.Matrix)
-		for i := 0; i < len(absoluteVertices); i++ {
-			obj.Vertices[i] = absoluteVertices[i]
-		}
+		obj.toAbsolute()
 		log.Printf("Unify triangles")
 		obj.UnifyTriangles()
-		totalNodes = 0
-		maxDepth = 0
 		s.Objects[k] = obj
 	}
 }
 
 // Parse all material images and store them in scene object
 // so we won't have to open and read for each pixel.
-// TODO: Free material image if it is not being used.
-// TODO: This method is complex and has more than one responsibility
+// Materials with the same texture share the images.
 // NOTE: This function assumes that objects are already flattened!
 func (s *Scene) parseMaterials() {
 	log.Printf("Parse material textures\n")
-	scenePath := filepath.Dir(s.InputFilename)
-	BumpMapNormals = make(map[string][][]Vector)
-	Images = make(map[string][][]Vector)
-	for m := range s.MasterObject.Materials {
-		mat := s.MasterObject.Materials[m]
-		if _, ok := Images[mat.Texture]; ok {
-			continue
+	textures := s.renderer.textureCache(s.fileSystem())
+	objects := make([]*Object, 0, len(s.Objects))
+	for _, obj := range s.Objects {
+		objects = append(objects, obj)
+	}
+	for _, parts := range s.meshParts {
+		for _, obj := range parts {
+			objects = append(objects, obj)
 		}
-		if mat.Texture != "" {
-			loadImage(scenePath, mat.Texture)
-			loadBumpMap(scenePath, mat.Texture)
+	}
+	parse := func(mat Material) Material {
+		// Images embedded in the scene file are already there.
+		if mat.Texture != "" && mat.image == nil {
+			mat.image = textures.texture(mat.Texture)
 		}
+		if !s.renderer.Config.RenderBumpMap {
+			mat.bumpMap = nil
+		} else if bumpFile := mat.bumpMapFile(); bumpFile != "" && mat.bumpMap == nil {
+			mat.bumpMap = textures.bumpMap(bumpFile)
+		}
+		return mat
+	}
+	for _, obj := range objects {
+		for name, mat := range obj.Materials {
+			obj.Materials[name] = parse(mat)
+		}
+	}
+	for i := range s.Primitives {
+		s.Primitives[i].Material = parse(s.Primitives[i].Material)
+	}
+}
+
+// fileSystem textures and meshes are resolved in.
+func (s *Scene) fileSystem() fs.FS {
+	if s.files == nil {
+		return sceneDir(".")
 	}
+	return s.files
 }
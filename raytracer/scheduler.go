@@ -0,0 +1,118 @@
+package raytracer
+
+import (
+	"context"
+	"image"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/cheggaaa/pb"
+)
+
+// tile is a block of pixels rendered by a single worker.
+type tile struct {
+	bounds image.Rectangle
+	pixels []image.Point
+}
+
+// renderRegion is the part of the image to render, whole image unless
+// --left --right --top --bottom are given.
+func renderRegion(width, height, left, right, top, bottom int) image.Rectangle {
+	if right+left > 0 {
+		return image.Rect(left, top, right, bottom).Intersect(image.Rect(0, 0, width, height))
+	}
+	return image.Rect(0, 0, width, height)
+}
+
+// makeTiles splits the region into tiles ordered in a spiral from the center,
+// so the interesting part of the image shows up first and neighbour pixels
+// are rendered close in time. Percent picks a random subset of each tile.
+func makeTiles(region image.Rectangle, size, percent int) []tile {
+	if size < 1 {
+		size = 32
+	}
+	tiles := make([]tile, 0)
+	for y := region.Min.Y; y < region.Max.Y; y += size {
+		for x := region.Min.X; x < region.Max.X; x += size {
+			bounds := image.Rect(x, y, x+size, y+size).Intersect(region)
+			pixels := make([]image.Point, 0, bounds.Dx()*bounds.Dy())
+			for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
+				for i := bounds.Min.X; i < bounds.Max.X; i++ {
+					pixels = append(pixels, image.Point{X: i, Y: j})
+				}
+			}
+			if percent < 100 {
+				rand.Shuffle(len(pixels), func(i, j int) { pixels[i], pixels[j] = pixels[j], pixels[i] })
+				pixels = pixels[:percent*len(pixels)/100]
+			}
+			tiles = append(tiles, tile{bounds: bounds, pixels: pixels})
+		}
+	}
+
+	center := region.Min.Add(region.Max).Div(2)
+	ring := func(t tile) int {
+		mid := t.bounds.Min.Add(t.bounds.Max).Div(2).Sub(center)
+		return int(math.Max(math.Abs(float64(mid.X)), math.Abs(float64(mid.Y)))) / size
+	}
+	angle := func(t tile) float64 {
+		mid := t.bounds.Min.Add(t.bounds.Max).Div(2).Sub(center)
+		return math.Atan2(float64(mid.Y), float64(mid.X))
+	}
+	sort.SliceStable(tiles, func(i, j int) bool {
+		ri, rj := ring(tiles[i]), ring(tiles[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return angle(tiles[i]) < angle(tiles[j])
+	})
+	return tiles
+}
+
+func countPixels(tiles []tile) (total int) {
+	for i := range tiles {
+		total += len(tiles[i].pixels)
+	}
+	return total
+}
+
+// renderTiles runs render for each pixel of the tiles on a bounded pool of
+// workers, each worker takes the next tile when it is done with its own.
+// Workers stop between pixels once ctx is done, pixels left behind keep
+// whatever they had and the context error is returned.
+func renderTiles(ctx context.Context, threads int, tiles []tile, render func(x, y int)) error {
+	log.Printf("Render %d tiles with %d threads", len(tiles), threads)
+	bar := pb.StartNew(countPixels(tiles))
+
+	queue := make(chan *tile)
+	var wg sync.WaitGroup
+	for w := 0; w < threads; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range queue {
+				for _, p := range t.pixels {
+					if ctx.Err() != nil {
+						return
+					}
+					render(p.X, p.Y)
+					bar.Increment()
+				}
+			}
+		}()
+	}
+feed:
+	for i := range tiles {
+		select {
+		case queue <- &tiles[i]:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	bar.Finish()
+	return ctx.Err()
+}
@@ -0,0 +1,139 @@
+package raytracer
+
+/*
+STL importer for ASCII and binary files, all solids of the file become one
+flat shaded object. Axes are kept as they are in the file, CAD tools mostly
+write Z up already.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"math"
+	"path"
+	"strings"
+)
+
+const (
+	stlHeaderSize   = 80
+	stlTriangleSize = 50
+)
+
+func loadSTL(files fs.FS, name string) (map[string]*Object, error) {
+	f, err := files.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	obj := NewObject()
+	mat := Material{Color: Vector{1, 1, 1, 1}}
+	// Binary files may start with "solid" too, their size tells them apart.
+	if isBinarySTL(data) {
+		err = readBinarySTL(data, obj, &mat)
+	} else {
+		err = readASCIISTL(data, obj, &mat)
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj.Materials[objDefaultMaterial] = mat
+	objName := strings.TrimSuffix(path.Base(name), path.Ext(name))
+	return map[string]*Object{objName: obj}, nil
+}
+
+func isBinarySTL(data []byte) bool {
+	if len(data) < stlHeaderSize+4 {
+		return false
+	}
+	count := int(binary.LittleEndian.Uint32(data[stlHeaderSize:]))
+	return len(data) == stlHeaderSize+4+count*stlTriangleSize
+}
+
+func readBinarySTL(data []byte, obj *Object, mat *Material) error {
+	count := int(binary.LittleEndian.Uint32(data[stlHeaderSize:]))
+	data = data[stlHeaderSize+4:]
+	value := func(b []byte, i int) float64 {
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b[i*4:])))
+	}
+	for i := 0; i < count; i++ {
+		b := data[i*stlTriangleSize:]
+		normal := Vector{value(b, 0), value(b, 1), value(b, 2), 0}
+		var corners [3]Vector
+		for j := range corners {
+			corners[j] = Vector{value(b, 3+j*3), value(b, 4+j*3), value(b, 5+j*3), 1}
+		}
+		addSTLFacet(obj, mat, normal, corners)
+	}
+	return nil
+}
+
+func readASCIISTL(data []byte, obj *Object, mat *Material) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	var normal Vector
+	var corners [3]Vector
+	vertices := 0
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "facet":
+			if len(fields) != 5 || fields[1] != "normal" {
+				return fmt.Errorf("line %d: malformed facet", line)
+			}
+			v, err := parseFloats(fields[2:], 3)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			normal = Vector{v[0], v[1], v[2], 0}
+			vertices = 0
+		case "vertex":
+			if vertices == 3 {
+				return fmt.Errorf("line %d: facet with more than 3 vertices", line)
+			}
+			v, err := parseFloats(fields[1:], 3)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			corners[vertices] = Vector{v[0], v[1], v[2], 1}
+			vertices++
+		case "endfacet":
+			if vertices != 3 {
+				return fmt.Errorf("line %d: facet with %d vertices", line, vertices)
+			}
+			addSTLFacet(obj, mat, normal, corners)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(mat.Indices) == 0 {
+		return errors.New("no facets, not an STL file")
+	}
+	return nil
+}
+
+// addSTLFacet with its own vertices, zero facet normals are calculated from the vertices.
+func addSTLFacet(obj *Object, mat *Material, normal Vector, corners [3]Vector) {
+	if vectorNorm(normal) == 0 {
+		normal = crossProduct(subVector(corners[1], corners[0]), subVector(corners[2], corners[0]))
+	}
+	normal = normalizeVector(normal)
+	normal[3] = 0
+	first := int64(len(obj.Vertices))
+	for _, c := range corners {
+		obj.AddVertex(c, normal, Vector{})
+	}
+	mat.Indices = append(mat.Indices, indice{first, first + 1, first + 2, 0})
+}
@@ -0,0 +1,107 @@
+package raytracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+// stlFacets of a unit square, the first facet normal is left for the loader.
+var stlFacets = []struct {
+	normal  [3]float32
+	corners [3][3]float32
+}{
+	{[3]float32{0, 0, 0}, [3][3]float32{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}}},
+	{[3]float32{0, 0, 2}, [3][3]float32{{0, 0, 0}, {1, 1, 0}, {0, 1, 0}}},
+}
+
+// binarySTL of the facets, the header starts with "solid" like some
+// exporters write it.
+func binarySTL() []byte {
+	var buf bytes.Buffer
+	header := make([]byte, stlHeaderSize)
+	copy(header, "solid square")
+	buf.Write(header)
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(stlFacets)))
+	for _, f := range stlFacets {
+		_ = binary.Write(&buf, binary.LittleEndian, f.normal)
+		_ = binary.Write(&buf, binary.LittleEndian, f.corners)
+		_ = binary.Write(&buf, binary.LittleEndian, uint16(0))
+	}
+	return buf.Bytes()
+}
+
+const asciiSTL = `solid square
+  facet normal 0 0 0
+    outer loop
+      vertex 0 0 0
+      vertex 1 0 0
+      vertex 1 1 0
+    endloop
+  endfacet
+  facet normal 0 0 2
+    outer loop
+      vertex 0 0 0
+      vertex 1 1 0
+      vertex 0 1 0
+    endloop
+  endfacet
+endsolid square
+`
+
+func TestLoadSTL(t *testing.T) {
+	square := NewObject()
+	mat := Material{Color: Vector{1, 1, 1, 1}}
+	for i, f := range stlFacets {
+		for _, c := range f.corners {
+			square.AddVertex(Vector{float64(c[0]), float64(c[1]), float64(c[2]), 1}, Vector{0, 0, 1, 0}, Vector{})
+		}
+		first := int64(i * 3)
+		mat.Indices = append(mat.Indices, indice{first, first + 1, first + 2, 0})
+	}
+	square.Materials[objDefaultMaterial] = mat
+	want := map[string]*Object{"square": square}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"ascii", []byte(asciiSTL)},
+		{"binary", binarySTL()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			objects, err := LoadMesh(fstest.MapFS{"cad/square.stl": {Data: test.data}}, "cad/square.stl")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(objects, want) {
+				t.Errorf("objects %+v, want %+v", objects["square"], square)
+			}
+		})
+	}
+}
+
+func TestLoadSTLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"no facets", "solid empty\nendsolid empty\n"},
+		{"truncated binary", string(binarySTL()[:120])},
+		{"malformed facet", "solid x\nfacet 0 0 1\nendfacet\n"},
+		{"bad vertex", "solid x\nfacet normal 0 0 1\nvertex 0 x 0\n"},
+		{"two vertices", "solid x\nfacet normal 0 0 1\nvertex 0 0 0\nvertex 1 0 0\nendfacet\n"},
+		{"four vertices", "solid x\nfacet normal 0 0 1\nvertex 0 0 0\nvertex 1 0 0\nvertex 1 1 0\nvertex 0 1 0\nendfacet\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := LoadMesh(fstest.MapFS{"m.stl": {Data: []byte(test.data)}}, "m.stl"); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
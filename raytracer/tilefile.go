@@ -0,0 +1,219 @@
+package raytracer
+
+/*
+Tiles are rendered blocks of an image with raw float colors, used to stitch
+region renders and distributed renders into the final image.
+A .rlt tile file is the "RLT1" magic, the full image size and the tile bounds
+as little endian uint32s, followed by RGBA float32s for each pixel of the
+tile, row by row.
+*/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TileExtension is the file extension of raw tile files.
+const TileExtension = ".rlt"
+
+// maxImageSize is the longest image side of a tile, tile sizes come from
+// files and workers and are checked before anything is allocated for them.
+const maxImageSize = 1 << 16
+
+var tileMagic = [4]byte{'R', 'L', 'T', '1'}
+
+// ErrNotTileFile is returned when reading a file without the tile magic bytes.
+var ErrNotTileFile = errors.New("not a raylar tile file")
+
+// tileData is a rendered block of a Width x Height image.
+type tileData struct {
+	Width  int
+	Height int
+	Bounds image.Rectangle
+	Pixels []float32
+}
+
+type tileHeader struct {
+	Magic  [4]byte
+	Width  uint32
+	Height uint32
+	MinX   uint32
+	MinY   uint32
+	MaxX   uint32
+	MaxY   uint32
+}
+
+// tileFromPixels copies the rendered colors inside bounds.
+func tileFromPixels(scene *Scene, bounds image.Rectangle) *tileData {
+	t := &tileData{
+		Width:  scene.Width,
+		Height: scene.Height,
+		Bounds: bounds,
+		Pixels: make([]float32, 0, bounds.Dx()*bounds.Dy()*4),
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := scene.Pixels[x][y].Color
+			t.Pixels = append(t.Pixels, float32(c[0]), float32(c[1]), float32(c[2]), float32(c[3]))
+		}
+	}
+	return t
+}
+
+func (t *tileData) validate() error {
+	if err := t.checkBounds(); err != nil {
+		return err
+	}
+	if len(t.Pixels) != t.Bounds.Dx()*t.Bounds.Dy()*4 {
+		return fmt.Errorf("tile %v has %d values", t.Bounds, len(t.Pixels))
+	}
+	return nil
+}
+
+func (t *tileData) checkBounds() error {
+	if t.Width > maxImageSize || t.Height > maxImageSize {
+		return fmt.Errorf("tile of a %dx%d image, larger than %d", t.Width, t.Height, maxImageSize)
+	}
+	full := image.Rect(0, 0, t.Width, t.Height)
+	if t.Bounds.Empty() || !t.Bounds.In(full) {
+		return fmt.Errorf("tile %v outside of %dx%d image", t.Bounds, t.Width, t.Height)
+	}
+	return nil
+}
+
+// paste copies the pixels of a tile inside this one.
+func (t *tileData) paste(src *tileData) {
+	width := t.Bounds.Dx()
+	n := src.Bounds.Dx() * 4
+	i := 0
+	for y := src.Bounds.Min.Y; y < src.Bounds.Max.Y; y++ {
+		start := ((y-t.Bounds.Min.Y)*width + src.Bounds.Min.X - t.Bounds.Min.X) * 4
+		copy(t.Pixels[start:start+n], src.Pixels[i:i+n])
+		i += n
+	}
+}
+
+// draw the tile into the full size image.
+func (t *tileData) draw(img *image.RGBA) {
+	i := 0
+	for y := t.Bounds.Min.Y; y < t.Bounds.Max.Y; y++ {
+		for x := t.Bounds.Min.X; x < t.Bounds.Max.X; x++ {
+			p := t.Pixels[i : i+4]
+			img.Set(x, y, toRGBA(Vector{float64(p[0]), float64(p[1]), float64(p[2]), float64(p[3])}))
+			i += 4
+		}
+	}
+}
+
+func isTileFile(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), TileExtension)
+}
+
+func writeTile(w io.Writer, t *tileData) error {
+	header := tileHeader{
+		Magic:  tileMagic,
+		Width:  uint32(t.Width),
+		Height: uint32(t.Height),
+		MinX:   uint32(t.Bounds.Min.X),
+		MinY:   uint32(t.Bounds.Min.Y),
+		MaxX:   uint32(t.Bounds.Max.X),
+		MaxY:   uint32(t.Bounds.Max.Y),
+	}
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, t.Pixels)
+}
+
+func readTile(r io.Reader) (*tileData, error) {
+	header := tileHeader{}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != tileMagic {
+		return nil, ErrNotTileFile
+	}
+	t := &tileData{
+		Width:  int(header.Width),
+		Height: int(header.Height),
+		Bounds: image.Rect(int(header.MinX), int(header.MinY), int(header.MaxX), int(header.MaxY)),
+	}
+	if err := t.checkBounds(); err != nil {
+		return nil, err
+	}
+	// Read in chunks, a short file fails before the whole tile is allocated.
+	n := t.Bounds.Dx() * t.Bounds.Dy() * 4
+	t.Pixels = make([]float32, 0, chunkSize(n))
+	for len(t.Pixels) < n {
+		chunk := make([]float32, chunkSize(n-len(t.Pixels)))
+		if err := binary.Read(r, binary.LittleEndian, chunk); err != nil {
+			return nil, err
+		}
+		t.Pixels = append(t.Pixels, chunk...)
+	}
+	return t, nil
+}
+
+func saveTile(filename string, t *tileData) error {
+	log.Printf("Saving tile %s", filename)
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := writeTile(w, t); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func loadTile(filename string) (*tileData, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t, err := readTile(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return t, nil
+}
+
+// MergeTiles stitches tile files, rendered on any number of machines, into
+// one image. Pixels no tile covers are left transparent.
+func MergeTiles(output string, files []string) error {
+	var img *image.RGBA
+	width, height := 0, 0
+	for _, filename := range files {
+		t, err := loadTile(filename)
+		if err != nil {
+			return err
+		}
+		if img == nil {
+			width, height = t.Width, t.Height
+			img = image.NewRGBA(image.Rect(0, 0, width, height))
+		}
+		if t.Width != width || t.Height != height {
+			return fmt.Errorf("%s: tile of a %dx%d image, merging %dx%d", filename, t.Width, t.Height, width, height)
+		}
+		t.draw(img)
+	}
+	if img == nil {
+		return errors.New("no tiles to merge")
+	}
+	return saveImage(output, img)
+}
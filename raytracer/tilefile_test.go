@@ -0,0 +1,48 @@
+package raytracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestReadTile(t *testing.T) {
+	tile := &tileData{Width: 8, Height: 4, Bounds: image.Rect(2, 1, 5, 3), Pixels: make([]float32, 3*2*4)}
+	for i := range tile.Pixels {
+		tile.Pixels[i] = float32(i) / 10
+	}
+	valid := bytes.Buffer{}
+	if err := writeTile(&valid, tile); err != nil {
+		t.Fatal(err)
+	}
+	header := func(h tileHeader) []byte {
+		b := bytes.Buffer{}
+		_ = binary.Write(&b, binary.LittleEndian, &h)
+		return b.Bytes()
+	}
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"valid", valid.Bytes(), true},
+		{"truncated", valid.Bytes()[:valid.Len()-1], false},
+		{"not a tile", []byte("RLBS0000000000000000000000000000"), false},
+		{"outside the image", header(tileHeader{Magic: tileMagic, Width: 8, Height: 4, MaxX: 9, MaxY: 4}), false},
+		{"huge image", header(tileHeader{Magic: tileMagic, Width: 1 << 31, Height: 1 << 31, MaxX: 1 << 31, MaxY: 1 << 31}), false},
+		{"huge tile without pixels", header(tileHeader{Magic: tileMagic, Width: maxImageSize, Height: maxImageSize, MaxX: maxImageSize, MaxY: maxImageSize}), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readTile(bytes.NewReader(test.data))
+			if (err == nil) != test.ok {
+				t.Fatalf("error %v, want ok %v", err, test.ok)
+			}
+			if test.ok && !reflect.DeepEqual(got, tile) {
+				t.Errorf("read %+v, want %+v", got, tile)
+			}
+		})
+	}
+}
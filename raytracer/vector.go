@@ -38,6 +38,15 @@ func addVector(v1, v2 Vector) Vector {
 	}
 }
 
+func multiplyVector(v1, v2 Vector) Vector {
+	return Vector{
+		v1[0] * v2[0],
+		v1[1] * v2[1],
+		v1[2] * v2[2],
+		v1[3] * v2[3],
+	}
+}
+
 func addVectors(vList ...Vector) Vector {
 	total := vList[0]
 	for i, v := range vList {
@@ -256,6 +265,10 @@ func reflectVector(v, n Vector) Vector {
 	return combine(v, n, 1.0, -2*dot(v, n))
 }
 
+func luminance(v Vector) float64 {
+	return 0.2126*v[0] + 0.7152*v[1] + 0.0722*v[2]
+}
+
 func vectorSum(v Vector) float64 {
 	return v[0] + v[1] + v[2]
 }
@@ -272,3 +285,19 @@ func refractVector(v, n Vector, ior float64) Vector {
 	}
 	return subVector(scaleVector(v, ior), scaleVector(n, (ior*nDotI+math.Sqrt(k))))
 }
+
+// toFloat32 stores the first len(dst) components of the vector.
+func toFloat32(dst []float32, v Vector) {
+	for i := range dst {
+		dst[i] = float32(v[i])
+	}
+}
+
+// fromFloat32 vector of the stored components, the rest are 0.
+func fromFloat32(src []float32) Vector {
+	v := Vector{}
+	for i := range src {
+		v[i] = float64(src[i])
+	}
+	return v
+}